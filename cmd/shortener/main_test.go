@@ -2,13 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"io"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,15 +25,31 @@ import (
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/adapter/memory"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/adapter/psql"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/log"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/metrics"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/pkg/config"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/policy"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/ratelimit"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/server"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/storage"
 	sfile "github.com/winkor4/taktaev-yandex-dev-uri.git/internal/storage/file"
 	smemory "github.com/winkor4/taktaev-yandex-dev-uri.git/internal/storage/memory"
 	spsql "github.com/winkor4/taktaev-yandex-dev-uri.git/internal/storage/psql"
-
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/tracing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 // go test -coverprofile coverage.out ./... -coverpkg ./...
@@ -42,6 +67,20 @@ func TestApp(t *testing.T) {
 		testAPI(t, srv, dbName)
 		testAPIBatch(t, srv, dbName)
 		testAPIDelete(t, srv, dbName)
+		testAPIExportImport(t, srv, dbName)
+		testAPIUserURLsPage(t, srv, dbName)
+		testAPIEditURL(t, srv, dbName)
+		testAPIRestore(t, srv, dbName)
+		testAPINormalize(t, srv, dbName)
+		testAPIV2(t, srv, dbName)
+		testAPIPassword(t, srv, dbName)
+		testAPIMaxClicks(t, srv, dbName)
+		testAPIRules(t, srv, dbName)
+		testAPISplit(t, srv, dbName)
+		testAPIRedirectStatus(t, srv, dbName)
+		testAPITemplate(t, srv, dbName)
+		testAPIQR(t, srv, dbName)
+		testAPIPreview(t, srv, dbName)
 		srv.Close()
 	}
 }
@@ -74,7 +113,7 @@ func newTestServer(t *testing.T, dbName string) *httptest.Server {
 		repo = memory.NewRepository(db)
 	}
 
-	logger, err := log.New()
+	logger, err := log.New(log.Config{Level: cfg.LogLevel, Format: cfg.LogFormat})
 	require.NoError(t, err)
 
 	srv := server.New(server.Config{
@@ -157,8 +196,8 @@ func testAPI(t *testing.T, srv *httptest.Server, dbName string) {
 	require.NoError(t, err)
 
 	pingStatus := make(map[string]int)
-	pingStatus[""] = http.StatusInternalServerError
-	pingStatus["file"] = http.StatusInternalServerError
+	pingStatus[""] = http.StatusOK
+	pingStatus["file"] = http.StatusOK
 	pingStatus["dsn"] = http.StatusOK
 
 	testTable := []testData{
@@ -448,6 +487,7 @@ func testAPIBatch(t *testing.T, srv *httptest.Server, dbName string) {
 		}
 		resSchema struct {
 			CorrelationID string `json:"correlation_id"`
+			Status        string `json:"status"`
 			ShortURL      string `json:"short_url"`
 		}
 	)
@@ -473,14 +513,17 @@ func testAPIBatch(t *testing.T, srv *httptest.Server, dbName string) {
 	resData := []resSchema{
 		{
 			CorrelationID: "1111",
+			Status:        "created",
 			ShortURL:      "http://localhost:8080/f623e4d83928fb684b01a5972aba8346",
 		},
 		{
 			CorrelationID: "2222",
+			Status:        "created",
 			ShortURL:      "http://localhost:8080/f3ed5bff46a78b51cb66659582054012",
 		},
 		{
 			CorrelationID: "3333",
+			Status:        "created",
 			ShortURL:      "http://localhost:8080/6be5bdb4593aa12fed172b6764730a52",
 		},
 	}
@@ -636,3 +679,2976 @@ func testAPIDelete(t *testing.T, srv *httptest.Server, dbName string) {
 		})
 	}
 }
+
+func testAPIExportImport(t *testing.T, srv *httptest.Server, dbName string) {
+
+	type want struct {
+		statusCode  int
+		contentType string
+		body        string
+	}
+
+	type testData struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   want
+	}
+
+	request, err := http.NewRequest(http.MethodPost, srv.URL+"/", strings.NewReader("https://export.example.com/1"))
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "text/plain")
+	r, err := srv.Client().Do(request)
+	require.NoError(t, err)
+	err = r.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, r.StatusCode)
+
+	var user string
+	for _, c := range r.Cookies() {
+		if c.Name == "auth_token" {
+			user = c.Value
+		}
+	}
+	require.NotEmpty(t, user)
+
+	testTable := []testData{
+		{
+			name:   dbName + " Выполнить Get /api/user/urls/export?format=csv",
+			method: http.MethodGet,
+			path:   "/api/user/urls/export?format=csv",
+			want: want{
+				statusCode:  http.StatusOK,
+				contentType: "text/csv",
+				body: "short_url,original_url,created_at,deleted,deleted_at,password_hash,max_clicks,variants,redirect_status,interstitial,rules,template\n" +
+					"http://localhost:8080/61f340f82fc7f7e5268d208b73d6bc06,https://export.example.com/1,*,,,,,,,,,\n",
+			},
+		},
+		{
+			name:   dbName + " Выполнить Get /api/user/urls/export?format=ndjson",
+			method: http.MethodGet,
+			path:   "/api/user/urls/export?format=ndjson",
+			want: want{
+				statusCode:  http.StatusOK,
+				contentType: "application/x-ndjson",
+				body:        `{"short_url":"http://localhost:8080/61f340f82fc7f7e5268d208b73d6bc06","original_url":"https://export.example.com/1","created_at":"*"}` + "\n",
+			},
+		},
+		{
+			name:   dbName + " Выполнить Get /api/user/urls/export?format=xml",
+			method: http.MethodGet,
+			path:   "/api/user/urls/export?format=xml",
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   dbName + " Выполнить Post /api/user/urls/import?format=ndjson",
+			method: http.MethodPost,
+			path:   "/api/user/urls/import?format=ndjson",
+			body: `{"original_url":"https://export.example.com/1"}` + "\n" +
+				`{"original_url":"https://export.example.com/2"}` + "\n" +
+				`{"original_url":""}` + "\n" +
+				`not json` + "\n",
+			want: want{
+				statusCode:  http.StatusOK,
+				contentType: "application/json",
+				body: `{"created":1,"conflict":1,"invalid":2,"failed":0,"rows":[
+					{"row":1,"original_url":"https://export.example.com/1","short_url":"http://localhost:8080/61f340f82fc7f7e5268d208b73d6bc06","status":"conflict"},
+					{"row":2,"original_url":"https://export.example.com/2","short_url":"http://localhost:8080/e2d0ddefc095ff2c4ca414ac0c718f12","status":"created"},
+					{"row":3,"original_url":"","status":"invalid","error":"URL parameter is missing"},
+					{"row":4,"original_url":"","status":"invalid","error":"can't unmarshal row"}]}`,
+			},
+		},
+		{
+			name:   dbName + " Выполнить Get /api/user/urls/export после импорта",
+			method: http.MethodGet,
+			path:   "/api/user/urls/export?format=json",
+			want: want{
+				statusCode:  http.StatusOK,
+				contentType: "application/json",
+				body: `[{"short_url":"http://localhost:8080/61f340f82fc7f7e5268d208b73d6bc06","original_url":"https://export.example.com/1","created_at":"*"},
+					{"short_url":"http://localhost:8080/e2d0ddefc095ff2c4ca414ac0c718f12","original_url":"https://export.example.com/2","created_at":"*"}]`,
+			},
+		},
+	}
+
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			request, err := http.NewRequest(testData.method, srv.URL+testData.path, strings.NewReader(testData.body))
+			require.NoError(t, err)
+			request.AddCookie(&http.Cookie{
+				Name:  "auth_token",
+				Value: user,
+			})
+
+			r, err := srv.Client().Do(request)
+			require.NoError(t, err)
+
+			rBody, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			err = r.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, testData.want.statusCode, r.StatusCode)
+			if testData.want.statusCode != http.StatusOK {
+				return
+			}
+			assert.Equal(t, testData.want.contentType, r.Header.Get("Content-Type"))
+			if testData.want.contentType == "application/json" {
+				assert.JSONEq(t, testData.want.body, maskCreatedAt(string(rBody)))
+				return
+			}
+			assert.Equal(t, testData.want.body, maskCreatedAt(string(rBody)))
+		})
+	}
+}
+
+// maskCreatedAt заменяет время создания ссылок в выгрузке на *.
+func maskCreatedAt(body string) string {
+	return createdAtPattern.ReplaceAllString(body, "$1*")
+}
+
+var createdAtPattern = regexp.MustCompile(`("created_at":"|,)\d{4}-\d\d-\d\dT[^",]*`)
+
+func testAPIUserURLsPage(t *testing.T, srv *httptest.Server, dbName string) {
+
+	type (
+		itemSchema struct {
+			ShortURL    string `json:"short_url"`
+			OriginalURL string `json:"original_url"`
+		}
+		pageSchema struct {
+			Items      []itemSchema `json:"items"`
+			Total      int          `json:"total"`
+			NextCursor string       `json:"next_cursor"`
+		}
+	)
+
+	ourls := []string{
+		"https://page.example.com/0",
+		"https://page.example.com/1",
+		"https://sub.page.example.com/2",
+		"https://other.example.org/page",
+	}
+
+	var user string
+	for _, ourl := range ourls {
+		request, err := http.NewRequest(http.MethodPost, srv.URL+"/", strings.NewReader(ourl))
+		require.NoError(t, err)
+		request.Header.Set("Content-Type", "text/plain")
+		if user != "" {
+			request.AddCookie(&http.Cookie{Name: "auth_token", Value: user})
+		}
+		r, err := srv.Client().Do(request)
+		require.NoError(t, err)
+		err = r.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, r.StatusCode)
+		for _, c := range r.Cookies() {
+			if c.Name == "auth_token" && user == "" {
+				user = c.Value
+			}
+		}
+	}
+
+	getPage := func(t *testing.T, query string) (int, pageSchema) {
+		request, err := http.NewRequest(http.MethodGet, srv.URL+"/api/user/urls?"+query, nil)
+		require.NoError(t, err)
+		request.AddCookie(&http.Cookie{Name: "auth_token", Value: user})
+		r, err := srv.Client().Do(request)
+		require.NoError(t, err)
+		defer func() {
+			err = r.Body.Close()
+			require.NoError(t, err)
+		}()
+
+		var page pageSchema
+		if r.StatusCode == http.StatusOK {
+			err = json.NewDecoder(r.Body).Decode(&page)
+			require.NoError(t, err)
+		}
+		return r.StatusCode, page
+	}
+
+	originals := func(page pageSchema) []string {
+		out := make([]string, 0, len(page.Items))
+		for _, item := range page.Items {
+			out = append(out, item.OriginalURL)
+		}
+		return out
+	}
+
+	t.Run(dbName+" Выполнить Get /api/user/urls постранично", func(t *testing.T) {
+		status, page := getPage(t, "limit=3")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, 4, page.Total)
+		assert.Equal(t, ourls[:3], originals(page))
+		require.NotEmpty(t, page.NextCursor)
+
+		status, page = getPage(t, "limit=3&cursor="+page.NextCursor)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, ourls[3:], originals(page))
+		assert.Empty(t, page.NextCursor)
+	})
+
+	t.Run(dbName+" Выполнить Get /api/user/urls с сортировкой", func(t *testing.T) {
+		status, page := getPage(t, "sort=-created_at&limit=2")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, []string{ourls[3], ourls[2]}, originals(page))
+	})
+
+	t.Run(dbName+" Выполнить Get /api/user/urls с фильтрами", func(t *testing.T) {
+		status, page := getPage(t, "domain=page.example.com")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, 3, page.Total)
+		assert.Equal(t, ourls[:3], originals(page))
+
+		status, page = getPage(t, "q=PAGE")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, 4, page.Total)
+
+		status, page = getPage(t, "q=/page&domain=example.org")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, ourls[3:], originals(page))
+	})
+
+	t.Run(dbName+" Выполнить Get /api/user/urls с неверными параметрами", func(t *testing.T) {
+		status, _ := getPage(t, "cursor=bad")
+		assert.Equal(t, http.StatusBadRequest, status)
+		status, _ = getPage(t, "limit=0")
+		assert.Equal(t, http.StatusBadRequest, status)
+		status, _ = getPage(t, "sort=key")
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+}
+
+// shortenAs сокращает ссылку от имени пользователя и возвращает ключ и пользователя.
+func shortenAs(t *testing.T, srv *httptest.Server, user string, ourl string) (string, string) {
+	request, err := http.NewRequest(http.MethodPost, srv.URL+"/", strings.NewReader(ourl))
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "text/plain")
+	if user != "" {
+		request.AddCookie(&http.Cookie{Name: "auth_token", Value: user})
+	}
+
+	r, err := srv.Client().Do(request)
+	require.NoError(t, err)
+	rBody, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	err = r.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, r.StatusCode)
+
+	for _, c := range r.Cookies() {
+		if c.Name == "auth_token" {
+			user = c.Value
+		}
+	}
+	return strings.ReplaceAll(string(rBody), "http://localhost:8080/", ""), user
+}
+
+func testAPIEditURL(t *testing.T, srv *httptest.Server, dbName string) {
+
+	type want struct {
+		statusCode  int
+		body        string
+		redirectURL string
+	}
+
+	type testData struct {
+		name   string
+		method string
+		path   string
+		user   string
+		body   string
+		want   want
+	}
+
+	key, owner := shortenAs(t, srv, "", "https://edit.example.com/old")
+	_, stranger := shortenAs(t, srv, "", "https://edit.example.com/other")
+
+	testTable := []testData{
+		{
+			name:   dbName + " Выполнить Patch /api/user/urls/{key}",
+			method: http.MethodPatch,
+			path:   "/api/user/urls/" + key,
+			user:   owner,
+			body:   `{"original_url":"https://edit.example.com/new"}`,
+			want: want{
+				statusCode:  http.StatusOK,
+				body:        `{"short_url":"http://localhost:8080/` + key + `","original_url":"https://edit.example.com/new","revision":2}`,
+				redirectURL: "https://edit.example.com/new",
+			},
+		},
+		{
+			name:   dbName + " Выполнить Patch /api/user/urls/{key} чужой ссылки",
+			method: http.MethodPatch,
+			path:   "/api/user/urls/" + key,
+			user:   stranger,
+			body:   `{"original_url":"https://edit.example.com/hijack"}`,
+			want: want{
+				statusCode:  http.StatusNotFound,
+				redirectURL: "https://edit.example.com/new",
+			},
+		},
+		{
+			name:   dbName + " Выполнить Patch /api/user/urls/{key} на существующую ссылку",
+			method: http.MethodPatch,
+			path:   "/api/user/urls/" + key,
+			user:   owner,
+			body:   `{"original_url":"https://edit.example.com/other"}`,
+			want: want{
+				statusCode:  http.StatusConflict,
+				redirectURL: "https://edit.example.com/new",
+			},
+		},
+		{
+			name:   dbName + " Выполнить Get /api/user/urls/{key}/revisions",
+			method: http.MethodGet,
+			path:   "/api/user/urls/" + key + "/revisions",
+			user:   owner,
+			want: want{
+				statusCode: http.StatusOK,
+				body:       `[{"revision":1,"original_url":"https://edit.example.com/old"},{"revision":2,"original_url":"https://edit.example.com/new"}]`,
+			},
+		},
+		{
+			name:   dbName + " Выполнить Post /api/user/urls/{key}/revisions/1/rollback",
+			method: http.MethodPost,
+			path:   "/api/user/urls/" + key + "/revisions/1/rollback",
+			user:   owner,
+			want: want{
+				statusCode:  http.StatusOK,
+				body:        `{"short_url":"http://localhost:8080/` + key + `","original_url":"https://edit.example.com/old","revision":3}`,
+				redirectURL: "https://edit.example.com/old",
+			},
+		},
+		{
+			name:   dbName + " Выполнить Post /api/user/urls/{key}/revisions/9/rollback",
+			method: http.MethodPost,
+			path:   "/api/user/urls/" + key + "/revisions/9/rollback",
+			user:   owner,
+			want: want{
+				statusCode: http.StatusNotFound,
+			},
+		},
+	}
+
+	client := srv.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			request, err := http.NewRequest(testData.method, srv.URL+testData.path, strings.NewReader(testData.body))
+			require.NoError(t, err)
+			request.Header.Set("Content-Type", "application/json")
+			request.AddCookie(&http.Cookie{Name: "auth_token", Value: testData.user})
+
+			r, err := client.Do(request)
+			require.NoError(t, err)
+			rBody, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			err = r.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, testData.want.statusCode, r.StatusCode)
+			if testData.want.body != "" {
+				assert.JSONEq(t, testData.want.body, stripCreatedAt(t, rBody))
+			}
+
+			if testData.want.redirectURL == "" {
+				return
+			}
+			r, err = client.Get(srv.URL + "/" + key)
+			require.NoError(t, err)
+			err = r.Body.Close()
+			require.NoError(t, err)
+			assert.Equal(t, testData.want.redirectURL, r.Header.Get("Location"))
+		})
+	}
+
+	t.Run(dbName+" Сокращение исходного и нового адреса после Patch", func(t *testing.T) {
+		edited, owner := shortenAs(t, srv, "", "https://edit.example.com/before")
+		status, _ := doJSON(t, srv, http.MethodPatch, "/api/user/urls/"+edited, owner,
+			`{"original_url":"https://edit.example.com/after"}`)
+		require.Equal(t, http.StatusOK, status)
+
+		status, body := doJSON(t, srv, http.MethodPost, "/api/shorten", owner, `{"url":"https://edit.example.com/after"}`)
+		assert.Equal(t, http.StatusConflict, status)
+		assert.JSONEq(t, `{"result":"http://localhost:8080/`+edited+`"}`, string(body))
+
+		again, _ := shortenAs(t, srv, owner, "https://edit.example.com/before")
+		assert.NotEqual(t, edited, again)
+		assert.Len(t, again, len(edited))
+
+		r, err := client.Get(srv.URL + "/" + again)
+		require.NoError(t, err)
+		require.NoError(t, r.Body.Close())
+		assert.Equal(t, "https://edit.example.com/before", r.Header.Get("Location"))
+		r, err = client.Get(srv.URL + "/" + edited)
+		require.NoError(t, err)
+		require.NoError(t, r.Body.Close())
+		assert.Equal(t, "https://edit.example.com/after", r.Header.Get("Location"))
+	})
+}
+
+// stripCreatedAt удаляет из JSON ответа поля created_at, которые зависят от времени.
+func stripCreatedAt(t *testing.T, body []byte) string {
+	var data any
+	err := json.Unmarshal(body, &data)
+	require.NoError(t, err)
+
+	var strip func(v any)
+	strip = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			delete(v, "created_at")
+			for _, item := range v {
+				strip(item)
+			}
+		case []any:
+			for _, item := range v {
+				strip(item)
+			}
+		}
+	}
+	strip(data)
+
+	out, err := json.Marshal(data)
+	require.NoError(t, err)
+	return string(out)
+}
+
+// problem разбирает ответ с ошибкой в формате application/problem+json и возвращает код и описание ошибки.
+func problem(t *testing.T, r *http.Response, body []byte) (string, string) {
+	require.Equal(t, "application/problem+json", r.Header.Get("Content-Type"))
+
+	var res struct {
+		Type   string `json:"type"`
+		Title  string `json:"title"`
+		Status int    `json:"status"`
+		Detail string `json:"detail"`
+		Code   string `json:"code"`
+	}
+	require.NoError(t, json.Unmarshal(body, &res))
+	assert.Equal(t, r.StatusCode, res.Status)
+	assert.Equal(t, http.StatusText(r.StatusCode), res.Title)
+	assert.Equal(t, "urn:shortener:problem:"+res.Code, res.Type)
+	return res.Code, res.Detail
+}
+
+// doJSON выполняет запрос от имени пользователя с JSON телом и возвращает статус и тело ответа.
+func doJSON(t *testing.T, srv *httptest.Server, method string, path string, user string, body string) (int, []byte) {
+	request, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "application/json")
+	if user != "" {
+		request.AddCookie(&http.Cookie{Name: "auth_token", Value: user})
+	}
+
+	client := srv.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	r, err := client.Do(request)
+	require.NoError(t, err)
+	rBody, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	err = r.Body.Close()
+	require.NoError(t, err)
+	return r.StatusCode, rBody
+}
+
+// linkKey возвращает ключ созданной ссылки из ответа POST /api/shorten или POST /api/v2/links.
+// Ссылки с настройками получают случайный ключ, поэтому его нельзя вычислить по адресу.
+func linkKey(t *testing.T, body []byte) string {
+	var res struct {
+		Result   string `json:"result"`
+		ShortURL string `json:"short_url"`
+	}
+	require.NoError(t, json.Unmarshal(body, &res))
+	return strings.TrimPrefix(res.Result+res.ShortURL, "http://localhost:8080/")
+}
+
+func testAPIRestore(t *testing.T, srv *httptest.Server, dbName string) {
+
+	key, owner := shortenAs(t, srv, "", "https://restore.example.com/1")
+	_, stranger := shortenAs(t, srv, "", "https://restore.example.com/2")
+
+	status, _ := doJSON(t, srv, http.MethodDelete, "/api/user/urls", owner, `["`+key+`"]`)
+	require.Equal(t, http.StatusAccepted, status)
+	time.Sleep(time.Millisecond * 100)
+
+	t.Run(dbName+" Выполнить Post /api/user/urls/restore чужой ссылки", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodPost, "/api/user/urls/restore", stranger, `["`+key+`"]`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `{"restored":[]}`, string(body))
+
+		status, _ = doJSON(t, srv, http.MethodGet, "/"+key, "", "")
+		assert.Equal(t, http.StatusGone, status)
+	})
+
+	t.Run(dbName+" Выполнить Post /api/user/urls/restore", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodPost, "/api/user/urls/restore", owner, `["`+key+`"]`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `{"restored":["`+key+`"]}`, string(body))
+
+		status, _ = doJSON(t, srv, http.MethodGet, "/"+key, "", "")
+		assert.Equal(t, http.StatusTemporaryRedirect, status)
+
+		status, body = doJSON(t, srv, http.MethodGet, "/api/user/urls", owner, "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `[{"short_url":"http://localhost:8080/`+key+`","original_url":"https://restore.example.com/1"}]`, string(body))
+	})
+}
+
+func testAPIV2(t *testing.T, srv *httptest.Server, dbName string) {
+	type link struct {
+		ID          string    `json:"id"`
+		ShortURL    string    `json:"short_url"`
+		OriginalURL string    `json:"original_url"`
+		CreatedAt   time.Time `json:"created_at"`
+	}
+
+	user := uuid.New().String()
+	ourl := "https://v2.example.com/1"
+	key := model.ShortKey(ourl)
+	key2 := model.ShortKey("https://v2.example.com/2")
+
+	var created link
+	t.Run(dbName+" Выполнить Post /api/v2/links", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodPost, "/api/v2/links", user, `{"original_url":"`+ourl+`"}`)
+		require.Equal(t, http.StatusCreated, status)
+		require.NoError(t, json.Unmarshal(body, &created))
+		assert.Equal(t, key, created.ID)
+		assert.Equal(t, "http://localhost:8080/"+key, created.ShortURL)
+		assert.Equal(t, ourl, created.OriginalURL)
+		assert.WithinDuration(t, time.Now(), created.CreatedAt, time.Minute)
+
+		status, body = doJSON(t, srv, http.MethodPost, "/api/v2/links", user, `{"original_url":"`+ourl+`"}`)
+		require.Equal(t, http.StatusOK, status)
+		var existing link
+		require.NoError(t, json.Unmarshal(body, &existing))
+		assert.Equal(t, created.ID, existing.ID)
+		assert.True(t, created.CreatedAt.Equal(existing.CreatedAt))
+	})
+
+	batch := `[{"correlation_id":"1","original_url":"` + ourl + `"},` +
+		`{"correlation_id":"2","original_url":"https://v2.example.com/2"},` +
+		`{"correlation_id":"3","original_url":"not a url"}]`
+	t.Run(dbName+" Выполнить Post /api/v2/links/batch", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodPost, "/api/v2/links/batch", user, batch)
+		assert.Equal(t, http.StatusMultiStatus, status)
+		assert.JSONEq(t, `{"items":[
+			{"correlation_id":"1","status":"exists","link":{"id":"`+key+`","short_url":"http://localhost:8080/`+key+`","original_url":"`+ourl+`"}},
+			{"correlation_id":"2","status":"created","link":{"id":"`+key2+`","short_url":"http://localhost:8080/`+key2+`","original_url":"https://v2.example.com/2"}},
+			{"correlation_id":"3","status":"invalid","error":"invalid URL"}
+		],"summary":{"created":1,"exists":1,"invalid":1,"failed":0}}`, stripCreatedAt(t, body))
+
+		status, body = doJSON(t, srv, http.MethodPost, "/api/v2/links/batch", user, batch)
+		assert.Equal(t, http.StatusMultiStatus, status)
+		assert.Contains(t, string(body), `"summary":{"created":0,"exists":2,"invalid":1,"failed":0}`)
+
+		status, body = doJSON(t, srv, http.MethodPost, "/api/v2/links/batch", user, `[{"correlation_id":"1","original_url":"https://v2.example.com/2"}]`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, string(body), `"summary":{"created":0,"exists":1,"invalid":0,"failed":0}`)
+	})
+
+	t.Run(dbName+" Ответы v1 не зависят от v2", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodPost, "/api/shorten/batch", user,
+			`[{"correlation_id":"1","original_url":"`+ourl+`"}]`)
+		assert.Equal(t, http.StatusCreated, status)
+		assert.JSONEq(t, `[{"correlation_id":"1","status":"exists","short_url":"http://localhost:8080/`+key+`"}]`, string(body))
+
+		status, body = doJSON(t, srv, http.MethodGet, "/api/user/urls", user, "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, string(body), `{"short_url":"http://localhost:8080/`+key+`","original_url":"`+ourl+`"}`)
+	})
+
+	t.Run(dbName+" Выполнить Get /api/v2/links", func(t *testing.T) {
+		status, _ := doJSON(t, srv, http.MethodGet, "/api/v2/links", "", "")
+		assert.Equal(t, http.StatusUnauthorized, status)
+
+		status, body := doJSON(t, srv, http.MethodGet, "/api/v2/links?limit=1", user, "")
+		assert.Equal(t, http.StatusOK, status)
+		var page struct {
+			Items      []link `json:"items"`
+			Total      int    `json:"total"`
+			NextCursor string `json:"next_cursor"`
+		}
+		require.NoError(t, json.Unmarshal(body, &page))
+		require.Len(t, page.Items, 1)
+		assert.Equal(t, created, page.Items[0])
+		assert.Equal(t, 2, page.Total)
+		assert.NotEmpty(t, page.NextCursor)
+	})
+
+	t.Run(dbName+" Выполнить Delete /api/v2/links/{id}", func(t *testing.T) {
+		status, _ := doJSON(t, srv, http.MethodDelete, "/api/v2/links/"+key, user, "")
+		assert.Equal(t, http.StatusAccepted, status)
+
+		assert.Eventually(t, func() bool {
+			status, _ := doJSON(t, srv, http.MethodGet, "/"+key, "", "")
+			return status == http.StatusGone
+		}, time.Second, time.Millisecond*20)
+	})
+}
+
+// newMemoryServer создает сервер с хранилищем в памяти и измененной конфигурацией.
+func newMemoryServer(t *testing.T, configure func(cfg *config.Config)) *httptest.Server {
+	srv, admin := newMemoryServers(t, configure)
+	admin.Close()
+	return srv
+}
+
+// newMemoryServers создает сервер с хранилищем в памяти и его служебный сервер.
+func newMemoryServers(t *testing.T, configure func(cfg *config.Config)) (*httptest.Server, *httptest.Server) {
+	cfg, err := config.Parse()
+	require.NoError(t, err)
+	configure(cfg)
+
+	logger, err := log.New(log.Config{Level: cfg.LogLevel, Format: cfg.LogFormat})
+	require.NoError(t, err)
+
+	pol, err := policy.New(cfg.PolicyFile)
+	require.NoError(t, err)
+
+	m := metrics.New()
+	s := server.New(server.Config{
+		URLRepo: metrics.NewRepository(memory.NewRepository(smemory.New()), "memory", m),
+		Cfg:     cfg,
+		Logger:  logger,
+		Policy:  pol,
+		Metrics: m,
+	})
+	s.Workers()
+	return httptest.NewServer(server.SrvRouter(s)), httptest.NewServer(server.AdminRouter(s))
+}
+
+func TestPurge(t *testing.T) {
+	srv := newMemoryServer(t, func(cfg *config.Config) {
+		cfg.DeleteRetention = time.Millisecond * 50
+		cfg.PurgeInterval = time.Millisecond * 20
+	})
+	defer srv.Close()
+
+	key, user := shortenAs(t, srv, "", "https://purge.example.com/1")
+	status, _ := doJSON(t, srv, http.MethodDelete, "/api/user/urls", user, `["`+key+`"]`)
+	require.Equal(t, http.StatusAccepted, status)
+
+	time.Sleep(time.Millisecond * 200)
+
+	status, body := doJSON(t, srv, http.MethodPost, "/api/user/urls/restore", user, `["`+key+`"]`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"restored":[]}`, string(body))
+
+	status, _ = doJSON(t, srv, http.MethodGet, "/"+key, "", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func testAPINormalize(t *testing.T, srv *httptest.Server, dbName string) {
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+
+	type testData struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		want        want
+	}
+
+	testTable := []testData{
+		{
+			name:        dbName + " Выполнить Post / с ненормализованной ссылкой",
+			path:        "/",
+			contentType: "text/plain",
+			body:        "HTTP://Normalize.Example.com:80/",
+			want: want{
+				statusCode: http.StatusCreated,
+				body:       "http://localhost:8080/2ccc4ebad276fd34cf9b6942279a3520",
+			},
+		},
+		{
+			name:        dbName + " Выполнить Post / с той же ссылкой в каноничном виде",
+			path:        "/",
+			contentType: "text/plain",
+			body:        "http://normalize.example.com",
+			want: want{
+				statusCode: http.StatusConflict,
+				body:       "http://localhost:8080/2ccc4ebad276fd34cf9b6942279a3520",
+			},
+		},
+		{
+			name:        dbName + " Выполнить Post / с javascript ссылкой",
+			path:        "/",
+			contentType: "text/plain",
+			body:        "javascript:alert(1)",
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
+		{
+			name:        dbName + " Выполнить Post /api/shorten с текстом вместо ссылки",
+			path:        "/api/shorten",
+			contentType: "application/json",
+			body:        `{"url":"hello"}`,
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
+		{
+			name:        dbName + " Выполнить Post /api/shorten/batch с невалидной ссылкой",
+			path:        "/api/shorten/batch",
+			contentType: "application/json",
+			body:        `[{"correlation_id":"1","original_url":"https://Normalize.Example.com/batch"},{"correlation_id":"2","original_url":"ftp://normalize.example.com"}]`,
+			want: want{
+				statusCode: http.StatusMultiStatus,
+				body: `[{"correlation_id":"1","status":"created","short_url":"http://localhost:8080/ddc54c5db7b9d8519e504fd08b3108db"},
+					{"correlation_id":"2","status":"invalid","error":"URL scheme is not allowed"}]`,
+			},
+		},
+	}
+
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodPost, srv.URL+testData.path, strings.NewReader(testData.body))
+			require.NoError(t, err)
+			request.Header.Set("Content-Type", testData.contentType)
+
+			r, err := srv.Client().Do(request)
+			require.NoError(t, err)
+			rBody, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			err = r.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, testData.want.statusCode, r.StatusCode)
+			switch {
+			case testData.want.body == "":
+			case testData.contentType == "application/json":
+				assert.JSONEq(t, testData.want.body, string(rBody))
+			default:
+				assert.Equal(t, testData.want.body, string(rBody))
+			}
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	err := os.WriteFile(policyFile, []byte(`{"block_domains":["blocked.example.com"],"block_patterns":["/phish/"]}`), 0666)
+	require.NoError(t, err)
+
+	srv := newMemoryServer(t, func(cfg *config.Config) {
+		cfg.PolicyFile = policyFile
+		cfg.PolicyReload = time.Millisecond * 20
+	})
+	defer srv.Close()
+
+	type want struct {
+		statusCode int
+		code       string
+		body       string
+	}
+
+	type testData struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		want        want
+	}
+
+	testTable := []testData{
+		{
+			name:        "Выполнить Post / с запрещенным доменом",
+			path:        "/",
+			contentType: "text/plain",
+			body:        "https://blocked.example.com/login",
+			want: want{
+				statusCode: http.StatusUnprocessableEntity,
+				code:       "url_rejected",
+				body:       "domain \"blocked.example.com\" is blocked",
+			},
+		},
+		{
+			name:        "Выполнить Post / с поддоменом запрещенного домена",
+			path:        "/",
+			contentType: "text/plain",
+			body:        "https://www.Blocked.example.com",
+			want: want{
+				statusCode: http.StatusUnprocessableEntity,
+				code:       "url_rejected",
+				body:       "domain \"www.blocked.example.com\" is blocked",
+			},
+		},
+		{
+			name:        "Выполнить Post /api/shorten с запрещенным шаблоном",
+			path:        "/api/shorten",
+			contentType: "application/json",
+			body:        `{"url":"https://fine.example.com/phish/1"}`,
+			want: want{
+				statusCode: http.StatusUnprocessableEntity,
+				code:       "url_rejected",
+				body:       "URL matches blocked pattern \"/phish/\"",
+			},
+		},
+		{
+			name:        "Выполнить Post /api/shorten/batch с запрещенным доменом",
+			path:        "/api/shorten/batch",
+			contentType: "application/json",
+			body:        `[{"correlation_id":"1","original_url":"https://blocked.example.com"}]`,
+			want: want{
+				statusCode: http.StatusUnprocessableEntity,
+				body:       `[{"correlation_id":"1","status":"invalid","error":"domain \"blocked.example.com\" is blocked"}]` + "\n",
+			},
+		},
+	}
+
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodPost, srv.URL+testData.path, strings.NewReader(testData.body))
+			require.NoError(t, err)
+			request.Header.Set("Content-Type", testData.contentType)
+
+			r, err := srv.Client().Do(request)
+			require.NoError(t, err)
+			rBody, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			err = r.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, testData.want.statusCode, r.StatusCode)
+			if testData.want.code != "" {
+				code, detail := problem(t, r, rBody)
+				assert.Equal(t, testData.want.code, code)
+				assert.Equal(t, testData.want.body, detail)
+				return
+			}
+			assert.Equal(t, testData.want.body, string(rBody))
+		})
+	}
+
+	t.Run("Выполнить Get /{id} после запрета домена", func(t *testing.T) {
+		key, _ := shortenAs(t, srv, "", "https://fine.example.com/page")
+
+		status, _ := doJSON(t, srv, http.MethodGet, "/"+key, "", "")
+		require.Equal(t, http.StatusTemporaryRedirect, status)
+
+		err := os.WriteFile(policyFile, []byte(`{"block_domains":["blocked.example.com","fine.example.com"]}`), 0666)
+		require.NoError(t, err)
+		future := time.Now().Add(time.Minute)
+		err = os.Chtimes(policyFile, future, future)
+		require.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			status, _ := doJSON(t, srv, http.MethodGet, "/"+key, "", "")
+			return status == http.StatusForbidden
+		}, time.Second, time.Millisecond*20)
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	srv := newMemoryServer(t, func(cfg *config.Config) {
+		cfg.RateShorten = ratelimit.Limit{Rate: 2.0 / 60, Burst: 2}
+	})
+	defer srv.Close()
+
+	post := func(user string, ourl string) *http.Response {
+		request, err := http.NewRequest(http.MethodPost, srv.URL+"/api/shorten", strings.NewReader(`{"url":"`+ourl+`"}`))
+		require.NoError(t, err)
+		request.Header.Set("Content-Type", "application/json")
+		request.AddCookie(&http.Cookie{Name: "auth_token", Value: user})
+		r, err := srv.Client().Do(request)
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, r.Body)
+		require.NoError(t, err)
+		require.NoError(t, r.Body.Close())
+		return r
+	}
+
+	key, _ := shortenAs(t, srv, "limited-user", "https://rate.example.com/0")
+
+	r := post("limited-user", "https://rate.example.com/1")
+	assert.Equal(t, http.StatusCreated, r.StatusCode)
+	assert.Equal(t, "2", r.Header.Get("RateLimit-Limit"))
+	assert.Equal(t, "0", r.Header.Get("RateLimit-Remaining"))
+
+	r = post("limited-user", "https://rate.example.com/2")
+	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode)
+	assert.Equal(t, "30", r.Header.Get("Retry-After"))
+
+	// Новая cookie не дает клиенту новый лимит.
+	r = post("other-user", "https://rate.example.com/2")
+	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode)
+
+	status, _ := doJSON(t, srv, http.MethodGet, "/"+key, "limited-user", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, status)
+}
+
+func TestRateLimitProxy(t *testing.T) {
+	// post отправляет запрос на сокращение через прокси, который передал X-Forwarded-For.
+	post := func(t *testing.T, srv *httptest.Server, forwardedFor string) int {
+		request, err := http.NewRequest(http.MethodPost, srv.URL+"/api/shorten", strings.NewReader(`{"url":"https://proxy.example.com/"}`))
+		require.NoError(t, err)
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-Forwarded-For", forwardedFor)
+		r, err := srv.Client().Do(request)
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, r.Body)
+		require.NoError(t, err)
+		require.NoError(t, r.Body.Close())
+		return r.StatusCode
+	}
+	limit := ratelimit.Limit{Rate: 1.0 / 60, Burst: 1}
+
+	t.Run("Доверенный прокси", func(t *testing.T) {
+		srv := newMemoryServer(t, func(cfg *config.Config) {
+			cfg.RateShorten = limit
+			cfg.TrustedProxies = []string{"127.0.0.0/8", "10.0.0.0/8"}
+		})
+		defer srv.Close()
+
+		assert.Equal(t, http.StatusCreated, post(t, srv, "203.0.113.1"))
+		assert.Equal(t, http.StatusTooManyRequests, post(t, srv, "203.0.113.1, 10.0.0.5"))
+		assert.Equal(t, http.StatusConflict, post(t, srv, "203.0.113.2"), "у другого клиента за прокси свой лимит")
+		// Адреса левее первого недоверенного подставил клиент, они не меняют ключ.
+		assert.Equal(t, http.StatusTooManyRequests, post(t, srv, "198.51.100.7, 203.0.113.1"))
+	})
+
+	t.Run("Без доверенных прокси заголовок не используется", func(t *testing.T) {
+		srv := newMemoryServer(t, func(cfg *config.Config) {
+			cfg.RateShorten = limit
+		})
+		defer srv.Close()
+
+		assert.Equal(t, http.StatusCreated, post(t, srv, "203.0.113.1"))
+		assert.Equal(t, http.StatusTooManyRequests, post(t, srv, "203.0.113.2"))
+	})
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	t.Setenv("RATE_LIMIT_SHORTEN", "0")
+	t.Setenv("RATE_LIMIT_BATCH", "5/s")
+	cfg, err := config.Parse()
+	require.NoError(t, err)
+	assert.True(t, cfg.RateShorten.Unlimited(), "0 в окружении отключает лимит")
+	assert.Equal(t, ratelimit.Limit{Rate: 5, Burst: 5}, cfg.RateBatch)
+	assert.False(t, cfg.RateRedirect.Unlimited(), "без переменной окружения действует значение флага")
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.0.0/16")
+	cfg, err = config.Parse()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.0.0/16"}, cfg.TrustedProxies)
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.1")
+	_, err = config.Parse()
+	assert.Error(t, err)
+}
+
+func TestLogLevelConfig(t *testing.T) {
+	cfg, err := config.Parse()
+	require.NoError(t, err)
+	assert.Equal(t, zapcore.InfoLevel, cfg.LogLevel, "без переменной окружения действует значение флага")
+
+	t.Setenv("LOG_LEVEL", "debug")
+	cfg, err = config.Parse()
+	require.NoError(t, err)
+	assert.Equal(t, zapcore.DebugLevel, cfg.LogLevel)
+
+	t.Setenv("LOG_LEVEL", "verbose")
+	_, err = config.Parse()
+	assert.Error(t, err)
+}
+
+func TestAdminConfig(t *testing.T) {
+	cfg, err := config.Parse()
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:8081", cfg.AdminAdr, "без переменной окружения действует значение флага")
+
+	t.Setenv("ADMIN_ADDRESS", "localhost:9091")
+	cfg, err = config.Parse()
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:9091", cfg.AdminAdr)
+
+	t.Setenv("ADMIN_ADDRESS", "")
+	cfg, err = config.Parse()
+	require.NoError(t, err)
+	assert.Empty(t, cfg.AdminAdr, "пустой адрес в окружении выключает служебный сервер")
+}
+
+func TestMetrics(t *testing.T) {
+	srv, admin := newMemoryServers(t, func(cfg *config.Config) {})
+	defer srv.Close()
+	defer admin.Close()
+
+	key, user := shortenAs(t, srv, "", "https://metrics.example.com/1")
+	status, _ := doJSON(t, srv, http.MethodGet, "/"+key, user, "")
+	require.Equal(t, http.StatusTemporaryRedirect, status)
+	status, _ = doJSON(t, srv, http.MethodGet, "/unknown", user, "")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = doJSON(t, srv, http.MethodGet, "/ping", user, "")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = doJSON(t, srv, http.MethodDelete, "/api/user/urls", user, `["`+key+`"]`)
+	require.Equal(t, http.StatusAccepted, status)
+
+	status, body := doJSON(t, admin, http.MethodGet, "/metrics", "", "")
+	require.Equal(t, http.StatusOK, status)
+
+	for _, line := range []string{
+		`shortener_http_requests_total{method="POST",route="/",status="201"} 1`,
+		`shortener_http_requests_total{method="GET",route="/{id}",status="307"} 1`,
+		`shortener_http_requests_total{method="DELETE",route="/api/user/urls",status="202"} 1`,
+		`shortener_http_request_duration_seconds_count{method="GET",route="/{id}",status="400"} 1`,
+		`shortener_redirects_total{result="found"} 1`,
+		`shortener_redirects_total{result="not_found"} 1`,
+		`shortener_storage_operation_duration_seconds_count{backend="memory",method="SaveURL",result="ok"} 1`,
+		`shortener_storage_operation_duration_seconds_count{backend="memory",method="GetURL",result="ok"} 2`,
+		`shortener_storage_pings_total{backend="memory",result="ok"} 1`,
+		`shortener_storage_up 1`,
+		`shortener_delete_queue_depth`,
+	} {
+		assert.Contains(t, string(body), line)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	cfg, err := config.Parse()
+	require.NoError(t, err)
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	s := server.New(server.Config{
+		URLRepo: memory.NewRepository(smemory.New()),
+		Cfg:     cfg,
+		Logger:  &log.Logger{SugaredLogger: zap.New(core).Sugar()},
+	})
+	srv := httptest.NewServer(server.SrvRouter(s))
+	defer srv.Close()
+
+	get := func(requestID string) *http.Response {
+		request, err := http.NewRequest(http.MethodGet, srv.URL+"/unknown", nil)
+		require.NoError(t, err)
+		request.AddCookie(&http.Cookie{Name: "auth_token", Value: "logged-user"})
+		if requestID != "" {
+			request.Header.Set("X-Request-ID", requestID)
+		}
+		r, err := srv.Client().Do(request)
+		require.NoError(t, err)
+		require.NoError(t, r.Body.Close())
+		return r
+	}
+
+	r := get("req-42")
+	assert.Equal(t, "req-42", r.Header.Get("X-Request-ID"))
+
+	entries := logs.FilterMessage("Request handled").AllUntimed()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "req-42", fields["request_id"])
+	assert.Equal(t, "logged-user", fields["user_id"])
+
+	r = get("bad id")
+	generated := r.Header.Get("X-Request-ID")
+	_, err = uuid.Parse(generated)
+	assert.NoError(t, err)
+
+	r = get("")
+	assert.NotEmpty(t, r.Header.Get("X-Request-ID"))
+	assert.NotEqual(t, generated, r.Header.Get("X-Request-ID"))
+}
+
+func TestTracing(t *testing.T) {
+	cfg, err := config.Parse()
+	require.NoError(t, err)
+	logger, err := log.New(log.Config{Level: cfg.LogLevel, Format: cfg.LogFormat})
+	require.NoError(t, err)
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer func() {
+		require.NoError(t, tp.Shutdown(context.Background()))
+	}()
+
+	s := server.New(server.Config{
+		URLRepo:        tracing.NewRepository(memory.NewRepository(smemory.New()), "memory", tp),
+		Cfg:            cfg,
+		Logger:         logger,
+		TracerProvider: tp,
+	})
+	srv := httptest.NewServer(server.SrvRouter(s))
+	defer srv.Close()
+
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID = "00f067aa0ba902b7"
+	)
+	request, err := http.NewRequest(http.MethodPost, srv.URL+"/api/shorten", strings.NewReader(`{"url":"https://trace.example.com"}`))
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	r, err := srv.Client().Do(request)
+	require.NoError(t, err)
+	require.NoError(t, r.Body.Close())
+	require.Equal(t, http.StatusCreated, r.StatusCode)
+	assert.Contains(t, r.Header.Get("traceparent"), traceID)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+
+	handler, ok := byName["POST /api/shorten"]
+	require.True(t, ok)
+	assert.Equal(t, traceID, handler.SpanContext.TraceID().String())
+	assert.Equal(t, parentSpanID, handler.Parent.SpanID().String())
+	assert.True(t, handler.Parent.IsRemote())
+
+	save, ok := byName["URLRepository.SaveURL"]
+	require.True(t, ok)
+	assert.Equal(t, traceID, save.SpanContext.TraceID().String())
+	assert.Equal(t, handler.SpanContext.SpanID(), save.Parent.SpanID())
+}
+
+func TestAdmin(t *testing.T) {
+
+	get := func(srv *httptest.Server, path string, token string) int {
+		request, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		r, err := srv.Client().Do(request)
+		require.NoError(t, err)
+		require.NoError(t, r.Body.Close())
+		return r.StatusCode
+	}
+
+	t.Run("public router has no admin endpoints", func(t *testing.T) {
+		srv := newMemoryServer(t, func(cfg *config.Config) {})
+		defer srv.Close()
+
+		assert.Equal(t, http.StatusNotFound, get(srv, "/debug/pprof/", ""))
+		assert.Equal(t, http.StatusNotFound, get(srv, "/debug/pprof/cmdline", ""))
+		assert.NotEqual(t, http.StatusOK, get(srv, "/metrics", ""))
+	})
+
+	t.Run("loopback only by default", func(t *testing.T) {
+		srv, admin := newMemoryServers(t, func(cfg *config.Config) {})
+		defer srv.Close()
+		defer admin.Close()
+
+		assert.Equal(t, http.StatusOK, get(admin, "/debug/pprof/", ""))
+		assert.Equal(t, http.StatusOK, get(admin, "/metrics", ""))
+	})
+
+	t.Run("bearer token", func(t *testing.T) {
+		srv, admin := newMemoryServers(t, func(cfg *config.Config) {
+			cfg.AdminToken = "secret"
+		})
+		defer srv.Close()
+		defer admin.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, get(admin, "/metrics", ""))
+		assert.Equal(t, http.StatusUnauthorized, get(admin, "/metrics", "wrong"))
+		assert.Equal(t, http.StatusOK, get(admin, "/metrics", "secret"))
+		assert.Equal(t, http.StatusOK, get(admin, "/debug/pprof/heap", "secret"))
+	})
+
+	t.Run("trusted subnet", func(t *testing.T) {
+		srv, admin := newMemoryServers(t, func(cfg *config.Config) {
+			cfg.TrustedSubnet = "10.0.0.0/8"
+		})
+		defer srv.Close()
+		defer admin.Close()
+		assert.Equal(t, http.StatusForbidden, get(admin, "/metrics", ""))
+
+		srv, admin = newMemoryServers(t, func(cfg *config.Config) {
+			cfg.TrustedSubnet = "127.0.0.0/8"
+		})
+		defer srv.Close()
+		defer admin.Close()
+		assert.Equal(t, http.StatusOK, get(admin, "/metrics", ""))
+	})
+}
+
+func TestHealth(t *testing.T) {
+	cfg, err := config.Parse()
+	require.NoError(t, err)
+	logger, err := log.New(log.Config{Level: cfg.LogLevel, Format: cfg.LogFormat})
+	require.NoError(t, err)
+
+	fname := filepath.Join(t.TempDir(), "health.json")
+	db, err := sfile.New(fname)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.CloseFile())
+	}()
+
+	s := server.New(server.Config{
+		URLRepo: file.NewRepository(db),
+		Cfg:     cfg,
+		Logger:  logger,
+	})
+	srv := httptest.NewServer(server.SrvRouter(s))
+	defer srv.Close()
+
+	status, body := doJSON(t, srv, http.MethodGet, "/healthz", "", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"status":"ok"}`, string(body))
+
+	admin := httptest.NewServer(server.AdminRouter(s))
+	defer admin.Close()
+
+	// Публичный ответ не раскрывает текст ошибок, служебный - раскрывает.
+	status, body = doJSON(t, srv, http.MethodGet, "/readyz", "", "")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.JSONEq(t, `{"status":"fail","checks":{
+		"storage":{"status":"ok"},
+		"file_writable":{"status":"ok"},
+		"delete_worker":{"status":"fail"}
+	}}`, string(body))
+	status, body = doJSON(t, admin, http.MethodGet, "/readyz", "", "")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.JSONEq(t, `{"status":"fail","checks":{
+		"storage":{"status":"ok"},
+		"file_writable":{"status":"ok"},
+		"delete_worker":{"status":"fail","error":"delete worker is not running"}
+	}}`, string(body))
+
+	s.Workers()
+	status, body = doJSON(t, srv, http.MethodGet, "/readyz", "", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"status":"ok","checks":{
+		"storage":{"status":"ok"},
+		"file_writable":{"status":"ok"},
+		"delete_worker":{"status":"ok"}
+	}}`, string(body))
+
+	// Файл подменили: писать по пути можно, но хранилище пишет в старый файл.
+	require.NoError(t, os.Remove(fname))
+	require.NoError(t, os.WriteFile(fname, nil, 0666))
+	status, body = doJSON(t, admin, http.MethodGet, "/readyz", "", "")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.JSONEq(t, `{"status":"fail","checks":{
+		"storage":{"status":"fail","error":"storage file was replaced"},
+		"file_writable":{"status":"ok"},
+		"delete_worker":{"status":"ok"}
+	}}`, string(body))
+
+	require.NoError(t, os.Remove(fname))
+	status, body = doJSON(t, srv, http.MethodGet, "/readyz", "", "")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	var res struct {
+		Checks map[string]struct {
+			Status string `json:"status"`
+		} `json:"checks"`
+	}
+	require.NoError(t, json.Unmarshal(body, &res))
+	assert.Equal(t, "fail", res.Checks["storage"].Status)
+	assert.Equal(t, "fail", res.Checks["file_writable"].Status)
+	assert.Equal(t, "ok", res.Checks["delete_worker"].Status)
+
+	status, _ = doJSON(t, srv, http.MethodGet, "/healthz", "", "")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+// contractTransport проверяет каждый ответ сервера по спецификации OpenAPI.
+type contractTransport struct {
+	t      *testing.T
+	base   http.RoundTripper
+	router routers.Router
+}
+
+func (ct *contractTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := ct.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	route, pathParams, err := ct.router.FindRoute(req)
+	if err != nil {
+		ct.t.Errorf("%s %s: no operation in spec: %v", req.Method, req.URL.Path, err)
+		return res, nil
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.Body.Close(); err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	err = openapi3filter.ValidateResponse(req.Context(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{
+			Request:    req,
+			PathParams: pathParams,
+			Route:      route,
+		},
+		Status:  res.StatusCode,
+		Header:  res.Header,
+		Body:    io.NopCloser(bytes.NewReader(body)),
+		Options: &openapi3filter.Options{IncludeResponseStatus: true},
+	})
+	if err != nil {
+		ct.t.Errorf("%s %s: response %d doesn't match spec: %v", req.Method, req.URL.Path, res.StatusCode, err)
+	}
+	return res, nil
+}
+
+// loadSpec загружает спецификацию, которую отдает сервер.
+func loadSpec(t *testing.T, srv *httptest.Server) *openapi3.T {
+	status, body := doJSON(t, srv, http.MethodGet, "/api/openapi.json", "", "")
+	require.Equal(t, http.StatusOK, status)
+
+	doc, err := openapi3.NewLoader().LoadFromData(body)
+	require.NoError(t, err)
+	require.NoError(t, doc.Validate(context.Background()))
+	return doc
+}
+
+// TestOpenAPIRoutes проверяет, что спецификация описывает ровно те маршруты, которые обслуживает сервер.
+func TestOpenAPIRoutes(t *testing.T) {
+	cfg, err := config.Parse()
+	require.NoError(t, err)
+	logger, err := log.New(log.Config{Level: cfg.LogLevel, Format: cfg.LogFormat})
+	require.NoError(t, err)
+
+	s := server.New(server.Config{
+		URLRepo: memory.NewRepository(smemory.New()),
+		Cfg:     cfg,
+		Logger:  logger,
+	})
+	router := server.SrvRouter(s)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	doc := loadSpec(t, srv)
+
+	inSpec := make(map[string]bool)
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			inSpec[method+" "+path] = true
+		}
+	}
+
+	routed := make(map[string]bool)
+	err = chi.Walk(router, func(method string, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if route != "/" {
+			route = strings.TrimSuffix(route, "/")
+		}
+		routed[method+" "+route] = true
+		return nil
+	})
+	require.NoError(t, err)
+
+	for op := range routed {
+		assert.True(t, inSpec[op], "route %s is not described in spec", op)
+	}
+	for op := range inSpec {
+		assert.True(t, routed[op], "spec operation %s is not routed", op)
+	}
+}
+
+// TestOpenAPIContract проверяет ответы обработчиков по спецификации и ошибки проверки запросов.
+func TestOpenAPIContract(t *testing.T) {
+	openapi3filter.RegisterBodyDecoder("application/x-ndjson", openapi3filter.FileBodyDecoder)
+	openapi3filter.RegisterBodyDecoder("image/png", openapi3filter.FileBodyDecoder)
+	openapi3filter.RegisterBodyDecoder("image/svg+xml", openapi3filter.FileBodyDecoder)
+	openapi3filter.RegisterBodyDecoder("text/html", openapi3filter.FileBodyDecoder)
+
+	srv := newMemoryServer(t, func(cfg *config.Config) {})
+	defer srv.Close()
+
+	specRouter, err := gorillamux.NewRouter(loadSpec(t, srv))
+	require.NoError(t, err)
+
+	client := &http.Client{
+		Transport: &contractTransport{t: t, base: srv.Client().Transport, router: specRouter},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	do := func(method string, path string, user string, contentType string, body string) (int, string) {
+		request, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if contentType != "" {
+			request.Header.Set("Content-Type", contentType)
+		}
+		if user != "" {
+			request.AddCookie(&http.Cookie{Name: "auth_token", Value: user})
+		}
+		r, err := client.Do(request)
+		require.NoError(t, err)
+		rBody, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, r.Body.Close())
+		return r.StatusCode, string(rBody)
+	}
+
+	user := uuid.New().String()
+	ourl := "https://contract.example.com/1"
+	key := model.ShortKey(ourl)
+
+	steps := []struct {
+		method      string
+		path        string
+		user        string
+		contentType string
+		body        string
+		status      int
+		detail      string
+	}{
+		{http.MethodGet, "/api/openapi.json", "", "", "", http.StatusOK, ""},
+		{http.MethodGet, "/ping", "", "", "", http.StatusOK, ""},
+		{http.MethodGet, "/healthz", "", "", "", http.StatusOK, ""},
+		{http.MethodGet, "/readyz", "", "", "", http.StatusOK, ""},
+		{http.MethodGet, "/api/user/urls", "", "", "", http.StatusUnauthorized, ""},
+		{http.MethodGet, "/api/user/urls", user, "", "", http.StatusNoContent, ""},
+		{http.MethodPost, "/", user, "text/plain", ourl, http.StatusCreated, ""},
+		{http.MethodPost, "/", user, "text/plain", ourl, http.StatusConflict, ""},
+		{http.MethodPost, "/", user, "text/plain", "not a url", http.StatusBadRequest, ""},
+		{http.MethodPost, "/api/shorten", user, "application/json", `{"url":"https://contract.example.com/2"}`, http.StatusCreated, ""},
+		{http.MethodPost, "/api/shorten", user, "application/json", `{"url":"https://contract.example.com/2"}`, http.StatusConflict, ""},
+		{http.MethodPost, "/api/shorten/batch", user, "application/json",
+			`[{"correlation_id":"1","original_url":"https://contract.example.com/3"},{"correlation_id":"2","original_url":"bad"}]`,
+			http.StatusMultiStatus, ""},
+		{http.MethodPost, "/api/shorten/batch", user, "application/json", `[{"correlation_id":"1","original_url":"bad"}]`,
+			http.StatusUnprocessableEntity, ""},
+		{http.MethodPost, "/api/shorten/batch", user, "application/json", `[]`, http.StatusBadRequest, "batch is empty"},
+		{http.MethodPost, "/api/shorten/stream", user, "application/x-ndjson",
+			`{"correlation_id":"1","original_url":"https://contract.example.com/12"}` + "\n" + `{"correlation_id":"2"`,
+			http.StatusOK, ""},
+		{http.MethodGet, "/" + key, "", "", "", http.StatusTemporaryRedirect, ""},
+		{http.MethodGet, "/" + key + "+", "", "", "", http.StatusOK, ""},
+		{http.MethodGet, "/" + key + "?preview=1", "", "", "", http.StatusOK, ""},
+		{http.MethodGet, "/unknown", "", "", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/user/urls", user, "", "", http.StatusOK, ""},
+		{http.MethodGet, "/api/user/urls?limit=1&sort=-created_at", user, "", "", http.StatusOK, ""},
+		{http.MethodPatch, "/api/user/urls/" + key, user, "application/json", `{"original_url":"https://contract.example.com/4"}`, http.StatusOK, ""},
+		{http.MethodPatch, "/api/user/urls/unknown", user, "application/json", `{"original_url":"https://contract.example.com/5"}`, http.StatusNotFound, ""},
+		{http.MethodGet, "/api/user/urls/" + key + "/revisions", user, "", "", http.StatusOK, ""},
+		{http.MethodPost, "/api/user/urls/" + key + "/revisions/1/rollback", user, "", "", http.StatusOK, ""},
+		{http.MethodPost, "/api/user/urls/" + key + "/revisions/9/rollback", user, "", "", http.StatusNotFound, ""},
+		{http.MethodPut, "/api/user/urls/" + key + "/rules", user, "application/json",
+			`[{"device":"mobile","query":{"ref":"*"},"target":"https://contract.example.com/m"}]`, http.StatusOK, ""},
+		{http.MethodPut, "/api/user/urls/" + key + "/rules", user, "application/json", `[{"from":"9:00","target":"https://contract.example.com/m"}]`, http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/user/urls/" + key + "/rules", user, "", "", http.StatusOK, ""},
+		{http.MethodGet, "/api/user/urls/unknown/rules", user, "", "", http.StatusNotFound, ""},
+		{http.MethodGet, "/api/user/urls/" + key + "/stats", user, "", "", http.StatusOK, ""},
+		{http.MethodGet, "/api/user/urls/unknown/stats", user, "", "", http.StatusNotFound, ""},
+		{http.MethodPut, "/api/user/urls/" + key + "/template", user, "application/json",
+			`{"params":{"utm_source":"{key}"},"pass_query":["gclid"]}`, http.StatusOK, ""},
+		{http.MethodPut, "/api/user/urls/" + key + "/template", user, "application/json", `{"params":{"utm_source":"{user}"}}`, http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/user/urls/" + key + "/template", user, "", "", http.StatusOK, ""},
+		{http.MethodGet, "/api/user/urls/unknown/template", user, "", "", http.StatusNotFound, ""},
+		{http.MethodGet, "/api/user/urls/export", user, "", "", http.StatusOK, ""},
+		{http.MethodGet, "/api/user/urls/export?format=csv", user, "", "", http.StatusOK, ""},
+		{http.MethodGet, "/api/user/urls/export?format=ndjson", user, "", "", http.StatusOK, ""},
+		{http.MethodPost, "/api/user/urls/import", user, "application/json",
+			`[{"original_url":"https://contract.example.com/6"},{"original_url":"bad"}]`, http.StatusOK, ""},
+		{http.MethodPost, "/api/user/urls/import?format=csv", user, "text/csv",
+			"original_url\nhttps://contract.example.com/7\n", http.StatusOK, ""},
+		{http.MethodGet, "/" + key + "/qr", "", "", "", http.StatusOK, ""},
+		{http.MethodGet, "/" + key + "/qr?format=svg&size=128&margin=2&ecc=H", "", "", "", http.StatusOK, ""},
+		{http.MethodGet, "/unknown/qr", "", "", "", http.StatusNotFound, ""},
+		{http.MethodGet, "/api/user/urls/" + key + "/qr", user, "", "", http.StatusOK, ""},
+		{http.MethodGet, "/api/user/urls/unknown/qr", user, "", "", http.StatusNotFound, ""},
+		{http.MethodPost, "/api/user/urls/" + key + "/access-token", user, "", "", http.StatusBadRequest, "url has no password"},
+		{http.MethodDelete, "/api/user/urls", user, "application/json", `["` + key + `"]`, http.StatusAccepted, ""},
+		{http.MethodPost, "/api/user/urls/restore", user, "application/json", `["unknown"]`, http.StatusOK, ""},
+		{http.MethodPost, "/api/v2/links", user, "application/json", `{"original_url":"https://contract.example.com/10"}`, http.StatusCreated, ""},
+		{http.MethodPost, "/api/v2/links", user, "application/json", `{"original_url":"https://contract.example.com/10"}`, http.StatusOK, ""},
+		{http.MethodPost, "/api/v2/links/batch", user, "application/json",
+			`[{"correlation_id":"1","original_url":"https://contract.example.com/10"},{"correlation_id":"2","original_url":"bad"}]`,
+			http.StatusMultiStatus, ""},
+		{http.MethodPost, "/api/v2/links/batch", user, "application/json", `[{"correlation_id":"1","original_url":"bad"}]`,
+			http.StatusUnprocessableEntity, ""},
+		{http.MethodGet, "/api/v2/links?limit=1", user, "", "", http.StatusOK, ""},
+		{http.MethodGet, "/api/v2/links", "", "", "", http.StatusUnauthorized, ""},
+		{http.MethodDelete, "/api/v2/links/" + model.ShortKey("https://contract.example.com/10"), user, "", "", http.StatusAccepted, ""},
+		{http.MethodPost, "/api/v2/links", user, "application/json", `{"url":"https://contract.example.com/11"}`, http.StatusBadRequest,
+			`invalid request body at /original_url: property "original_url" is missing`},
+
+		// Запросы, которые отклоняет проверка по спецификации.
+		{http.MethodPost, "/api/shorten", user, "application/json", `{"url":`, http.StatusBadRequest,
+			"malformed request body: unexpected EOF"},
+		{http.MethodPost, "/api/shorten", user, "application/json", `{}`, http.StatusBadRequest,
+			`invalid request body at /url: property "url" is missing`},
+		{http.MethodPost, "/api/shorten", user, "application/json", `{"url":1}`, http.StatusBadRequest,
+			"invalid request body at /url: value must be a string"},
+		{http.MethodPost, "/api/shorten/batch", user, "application/json", `[{"correlation_id":"1","original_url":1}]`,
+			http.StatusBadRequest, "invalid request body at /0/original_url: value must be a string"},
+		{http.MethodPost, "/api/shorten/batch", user, "application/json", `{"original_url":"https://contract.example.com/8"}`,
+			http.StatusBadRequest, "invalid request body at /: value must be an array"},
+		{http.MethodPatch, "/api/user/urls/" + key, user, "application/json", `{"url":"https://contract.example.com/9"}`,
+			http.StatusBadRequest, `invalid request body at /original_url: property "original_url" is missing`},
+		{http.MethodDelete, "/api/user/urls", user, "application/json", `[1]`, http.StatusBadRequest,
+			"invalid request body at /0: value must be a string"},
+		{http.MethodPost, "/api/user/urls/restore", user, "application/json", ``, http.StatusBadRequest,
+			"malformed request body: value is required but missing"},
+		{http.MethodGet, "/api/user/urls?limit=0", user, "", "", http.StatusBadRequest,
+			`invalid query parameter "limit": number must be at least 1`},
+		{http.MethodGet, "/api/user/urls?sort=name", user, "", "", http.StatusBadRequest,
+			`invalid query parameter "sort": value is not one of the allowed values ["created_at","-created_at"]`},
+		{http.MethodGet, "/api/user/urls/export?format=xml", user, "", "", http.StatusBadRequest,
+			`invalid query parameter "format": value is not one of the allowed values ["csv","json","ndjson"]`},
+		{http.MethodPost, "/api/user/urls/" + key + "/revisions/first/rollback", user, "", "", http.StatusBadRequest,
+			`invalid path parameter "revision": value first: an invalid integer: invalid syntax`},
+		{http.MethodGet, "/" + key + "/qr?size=10", "", "", "", http.StatusBadRequest,
+			`invalid query parameter "size": number must be at least 64`},
+		{http.MethodGet, "/" + key + "/qr?ecc=X", "", "", "", http.StatusBadRequest,
+			`invalid query parameter "ecc": value is not one of the allowed values ["L","M","Q","H"]`},
+	}
+
+	for _, step := range steps {
+		t.Run(step.method+" "+step.path, func(t *testing.T) {
+			status, body := do(step.method, step.path, step.user, step.contentType, step.body)
+			assert.Equal(t, step.status, status, body)
+			if step.detail != "" {
+				var res struct {
+					Detail string `json:"detail"`
+				}
+				require.NoError(t, json.Unmarshal([]byte(body), &res))
+				assert.Equal(t, step.detail, res.Detail)
+			}
+		})
+	}
+}
+
+// failingRepo - хранилище, которое не может сохранить ссылки.
+type failingRepo struct {
+	model.URLRepository
+}
+
+func (failingRepo) SaveURL(ctx context.Context, urls []model.URL) error {
+	return errors.New("disk is full")
+}
+
+func TestProblemResponses(t *testing.T) {
+	cfg, err := config.Parse()
+	require.NoError(t, err)
+	logger, err := log.New(log.Config{Level: cfg.LogLevel, Format: cfg.LogFormat})
+	require.NoError(t, err)
+
+	s := server.New(server.Config{
+		URLRepo: failingRepo{URLRepository: memory.NewRepository(smemory.New())},
+		Cfg:     cfg,
+		Logger:  logger,
+	})
+	srv := httptest.NewServer(server.SrvRouter(s))
+	defer srv.Close()
+
+	do := func(method string, path string, user string, contentType string, body string) (*http.Response, []byte) {
+		request, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		request.Header.Set("Content-Type", contentType)
+		request.Header.Set("X-Request-ID", "problem-test")
+		if user != "" {
+			request.AddCookie(&http.Cookie{Name: "auth_token", Value: user})
+		}
+		r, err := srv.Client().Do(request)
+		require.NoError(t, err)
+		rBody, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, r.Body.Close())
+		return r, rBody
+	}
+
+	testTable := []struct {
+		name        string
+		method      string
+		path        string
+		user        string
+		contentType string
+		body        string
+		status      int
+		code        string
+	}{
+		{"Ошибка сохранения в Post /", http.MethodPost, "/", "", "text/plain", "https://problem.example.com/1",
+			http.StatusInternalServerError, "internal_error"},
+		{"Ошибка сохранения в Post /api/shorten", http.MethodPost, "/api/shorten", "", "application/json", `{"url":"https://problem.example.com/2"}`,
+			http.StatusInternalServerError, "internal_error"},
+		{"Неверный Content-Type", http.MethodPost, "/api/shorten", "", "text/plain", `{"url":"https://problem.example.com/4"}`,
+			http.StatusBadRequest, "unsupported_content_type"},
+		{"Невалидная ссылка", http.MethodPost, "/", "", "text/plain", "not a url", http.StatusBadRequest, "invalid_url"},
+		{"Неизвестная ссылка", http.MethodGet, "/unknown", "", "", "", http.StatusBadRequest, "not_found"},
+		{"Пользователь не определен", http.MethodGet, "/api/user/urls", "", "", "", http.StatusUnauthorized, "unauthorized"},
+		{"Неизвестный формат", http.MethodGet, "/api/user/urls/export?format=xml", uuid.New().String(), "", "",
+			http.StatusBadRequest, "invalid_parameter"},
+	}
+
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			r, body := do(testData.method, testData.path, testData.user, testData.contentType, testData.body)
+			assert.Equal(t, testData.status, r.StatusCode)
+
+			code, _ := problem(t, r, body)
+			assert.Equal(t, testData.code, code)
+
+			// В ответе ровно один объект: после ошибки обработчик ничего не дописывает.
+			dec := json.NewDecoder(bytes.NewReader(body))
+			var res struct {
+				RequestID string `json:"request_id"`
+				Instance  string `json:"instance"`
+			}
+			require.NoError(t, dec.Decode(&res))
+			assert.False(t, dec.More())
+			assert.Equal(t, "problem-test", res.RequestID)
+			assert.Equal(t, strings.Split(testData.path, "?")[0], res.Instance)
+		})
+	}
+}
+
+// partialRepo - хранилище, которое не сохраняет ссылки на fail.example.com, а остальные сохраняет.
+type partialRepo struct {
+	model.URLRepository
+}
+
+func (r partialRepo) SaveURL(ctx context.Context, urls []model.URL) error {
+	for i := range urls {
+		if strings.Contains(urls[i].OriginalURL, "fail.example.com") {
+			urls[i].Err = errors.New("disk is full")
+			continue
+		}
+		if err := r.URLRepository.SaveURL(ctx, urls[i:i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestBatchPartialSave(t *testing.T) {
+	cfg, err := config.Parse()
+	require.NoError(t, err)
+	logger, err := log.New(log.Config{Level: cfg.LogLevel, Format: cfg.LogFormat})
+	require.NoError(t, err)
+
+	newServer := func(repo model.URLRepository) *httptest.Server {
+		s := server.New(server.Config{URLRepo: repo, Cfg: cfg, Logger: logger})
+		srv := httptest.NewServer(server.SrvRouter(s))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	srv := newServer(partialRepo{URLRepository: memory.NewRepository(smemory.New())})
+	failing := newServer(failingRepo{URLRepository: memory.NewRepository(smemory.New())})
+
+	ok := "https://partial.example.com/1"
+	key := model.ShortKey(ok)
+	batch := `[{"correlation_id":"1","original_url":"` + ok + `"},` +
+		`{"correlation_id":"2","original_url":"https://fail.example.com/2"},` +
+		`{"correlation_id":"3","original_url":"not a url"}]`
+
+	t.Run("v1 отвечает 207 и сохраняет валидные ссылки", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodPost, "/api/shorten/batch", "", batch)
+		assert.Equal(t, http.StatusMultiStatus, status)
+		assert.JSONEq(t, `[
+			{"correlation_id":"1","status":"created","short_url":"http://localhost:8080/`+key+`"},
+			{"correlation_id":"2","status":"failed","error":"can't save url"},
+			{"correlation_id":"3","status":"invalid","error":"invalid URL"}
+		]`, string(body))
+
+		status, _ = doJSON(t, srv, http.MethodGet, "/"+key, "", "")
+		assert.Equal(t, http.StatusTemporaryRedirect, status)
+	})
+
+	t.Run("v2 отвечает 207 и считает несохраненные ссылки", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodPost, "/api/v2/links/batch", "", batch)
+		assert.Equal(t, http.StatusMultiStatus, status)
+		assert.Contains(t, string(body), `"summary":{"created":0,"exists":1,"invalid":1,"failed":1}`)
+	})
+
+	t.Run("Несохраненная ссылка не создается", func(t *testing.T) {
+		status, _ := doJSON(t, srv, http.MethodPost, "/api/shorten", "", `{"url":"https://fail.example.com/single"}`)
+		assert.Equal(t, http.StatusInternalServerError, status)
+		status, _ = doJSON(t, srv, http.MethodPost, "/api/v2/links", "", `{"original_url":"https://fail.example.com/single"}`)
+		assert.Equal(t, http.StatusInternalServerError, status)
+		r, _ := doRedirect(t, srv, http.MethodGet, "/"+model.ShortKey("https://fail.example.com/single"), nil, "")
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	})
+
+	t.Run("Загрузка считает несохраненные ссылки", func(t *testing.T) {
+		_, user := shortenAs(t, srv, "", "https://partial.example.com/import")
+		status, body := doJSON(t, srv, http.MethodPost, "/api/user/urls/import", user,
+			`[{"original_url":"https://partial.example.com/import/1"},{"original_url":"https://fail.example.com/import"}]`)
+		require.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `{"created":1,"conflict":0,"invalid":0,"failed":1,"rows":[
+			{"row":1,"original_url":"https://partial.example.com/import/1","short_url":"http://localhost:8080/`+
+			model.ShortKey("https://partial.example.com/import/1")+`","status":"created"},
+			{"row":2,"original_url":"https://fail.example.com/import","status":"failed","error":"can't save url"}
+		]}`, string(body))
+	})
+
+	t.Run("Ошибка хранилища помечает все ссылки", func(t *testing.T) {
+		status, body := doJSON(t, failing, http.MethodPost, "/api/shorten/batch", "", batch)
+		assert.Equal(t, http.StatusMultiStatus, status)
+		assert.JSONEq(t, `[
+			{"correlation_id":"1","status":"failed","error":"can't save url"},
+			{"correlation_id":"2","status":"failed","error":"can't save url"},
+			{"correlation_id":"3","status":"invalid","error":"invalid URL"}
+		]`, string(body))
+	})
+}
+
+func TestBatchLimits(t *testing.T) {
+	srv := newMemoryServer(t, func(cfg *config.Config) {
+		cfg.BatchMaxItems = 2
+		cfg.BatchMaxBytes = 256
+	})
+	defer srv.Close()
+
+	item := func(i int) string {
+		return fmt.Sprintf(`{"correlation_id":"%d","original_url":"https://limits.example.com/%d"}`, i, i)
+	}
+
+	testTable := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+		detail string
+	}{
+		{"Пачка в пределах лимитов", "/api/shorten/batch", "[" + item(1) + "," + item(2) + "]", http.StatusCreated, ""},
+		{"Слишком много ссылок в v1", "/api/shorten/batch", "[" + item(1) + "," + item(2) + "," + item(3) + "]",
+			http.StatusRequestEntityTooLarge, "batch has 3 urls, limit is 2"},
+		{"Слишком много ссылок в v2", "/api/v2/links/batch", "[" + item(1) + "," + item(2) + "," + item(3) + "]",
+			http.StatusRequestEntityTooLarge, "batch has 3 urls, limit is 2"},
+		{"Слишком большое тело", "/api/shorten/batch",
+			`[{"correlation_id":"1","original_url":"https://limits.example.com/` + strings.Repeat("a", 300) + `"}]`,
+			http.StatusRequestEntityTooLarge, "batch exceeds 256 bytes"},
+	}
+
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodPost, srv.URL+testData.path, strings.NewReader(testData.body))
+			require.NoError(t, err)
+			request.Header.Set("Content-Type", "application/json")
+			r, err := srv.Client().Do(request)
+			require.NoError(t, err)
+			rBody, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.NoError(t, r.Body.Close())
+
+			assert.Equal(t, testData.status, r.StatusCode)
+			if testData.detail == "" {
+				return
+			}
+			code, detail := problem(t, r, rBody)
+			assert.Equal(t, "payload_too_large", code)
+			assert.Equal(t, testData.detail, detail)
+		})
+	}
+
+	t.Run("Загрузка ограничена как пачка", func(t *testing.T) {
+		user := uuid.New().String()
+		imports := []struct {
+			body   string
+			detail string
+		}{
+			{"original_url\nhttps://limits.example.com/1\nhttps://limits.example.com/2\nhttps://limits.example.com/3\n",
+				"import has 3 rows, limit is 2"},
+			{"original_url\nhttps://limits.example.com/" + strings.Repeat("a", 300) + "\n", "batch exceeds 256 bytes"},
+		}
+		for _, imp := range imports {
+			request, err := http.NewRequest(http.MethodPost, srv.URL+"/api/user/urls/import", strings.NewReader(imp.body))
+			require.NoError(t, err)
+			request.Header.Set("Content-Type", "text/csv")
+			request.AddCookie(&http.Cookie{Name: "auth_token", Value: user})
+			r, err := srv.Client().Do(request)
+			require.NoError(t, err)
+			rBody, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.NoError(t, r.Body.Close())
+
+			assert.Equal(t, http.StatusRequestEntityTooLarge, r.StatusCode)
+			_, detail := problem(t, r, rBody)
+			assert.Equal(t, imp.detail, detail)
+		}
+
+		status, _ := doJSON(t, srv, http.MethodPost, "/api/user/urls/import", user, "["+item(1)+","+item(2)+","+item(3)+"]")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	})
+}
+
+func TestExportImportSettings(t *testing.T) {
+	srv := newMemoryServer(t, func(cfg *config.Config) {})
+	defer srv.Close()
+
+	_, owner := shortenAs(t, srv, "", "https://roundtrip.example.com/deleted")
+	status, body := doJSON(t, srv, http.MethodPost, "/api/v2/links", owner,
+		`{"original_url":"https://roundtrip.example.com/settings","password":"secret","max_clicks":5,`+
+			`"redirect_status":301,"interstitial":true}`)
+	require.Equal(t, http.StatusCreated, status)
+	key := linkKey(t, body)
+	status, _ = doJSON(t, srv, http.MethodPut, "/api/user/urls/"+key+"/rules", owner,
+		`[{"device":"mobile","target":"https://roundtrip.example.com/mobile"}]`)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = doJSON(t, srv, http.MethodPut, "/api/user/urls/"+key+"/template", owner,
+		`{"params":{"utm_source":"roundtrip"}}`)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = doJSON(t, srv, http.MethodDelete, "/api/user/urls", owner,
+		`["`+model.ShortKey("https://roundtrip.example.com/deleted")+`"]`)
+	require.Equal(t, http.StatusAccepted, status)
+
+	// exported возвращает выгрузку пользователя без полей, которые не переносятся при загрузке.
+	exported := func(t *testing.T, user string) []map[string]any {
+		status, body := doJSON(t, srv, http.MethodGet, "/api/user/urls/export", user, "")
+		require.Equal(t, http.StatusOK, status)
+		var recs []map[string]any
+		require.NoError(t, json.Unmarshal(body, &recs))
+		for _, rec := range recs {
+			assert.NotEmpty(t, rec["created_at"])
+			delete(rec, "short_url")
+			delete(rec, "created_at")
+		}
+		return recs
+	}
+
+	var recs []map[string]any
+	require.Eventually(t, func() bool {
+		recs = exported(t, owner)
+		return len(recs) == 2 && recs[0]["deleted"] == true
+	}, time.Second, time.Millisecond*20)
+	assert.NotEmpty(t, recs[0]["deleted_at"])
+	settings := recs[1]
+	assert.Equal(t, "https://roundtrip.example.com/settings", settings["original_url"])
+	assert.NotEmpty(t, settings["password_hash"])
+	assert.EqualValues(t, 5, settings["max_clicks"])
+	assert.EqualValues(t, 301, settings["redirect_status"])
+	assert.Equal(t, true, settings["interstitial"])
+	assert.Len(t, settings["rules"], 1)
+	assert.NotEmpty(t, settings["template"])
+
+	for _, format := range []string{"json", "csv", "ndjson"} {
+		t.Run("Загрузка в формате "+format, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodGet, srv.URL+"/api/user/urls/export?format="+format, nil)
+			require.NoError(t, err)
+			request.AddCookie(&http.Cookie{Name: "auth_token", Value: owner})
+			r, err := srv.Client().Do(request)
+			require.NoError(t, err)
+			export, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.NoError(t, r.Body.Close())
+
+			user := uuid.New().String()
+			request, err = http.NewRequest(http.MethodPost, srv.URL+"/api/user/urls/import?format="+format, bytes.NewReader(export))
+			require.NoError(t, err)
+			request.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+			request.AddCookie(&http.Cookie{Name: "auth_token", Value: user})
+			r, err = srv.Client().Do(request)
+			require.NoError(t, err)
+			rBody, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.NoError(t, r.Body.Close())
+			require.Equal(t, http.StatusOK, r.StatusCode)
+			assert.Contains(t, string(rBody), `"created":1,"conflict":0,"invalid":1,"failed":0`)
+			assert.Contains(t, string(rBody), `"error":"deleted url is not imported"`)
+
+			assert.Equal(t, []map[string]any{settings}, exported(t, user))
+		})
+	}
+}
+
+func TestShortenStream(t *testing.T) {
+	srv := newMemoryServer(t, func(cfg *config.Config) {})
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	request, err := http.NewRequest(http.MethodPost, srv.URL+"/api/shorten/stream", pr)
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "application/x-ndjson")
+
+	line := func(i int) string {
+		return fmt.Sprintf(`{"correlation_id":"%d","original_url":"https://stream.example.com/%d"}`+"\n", i, i)
+	}
+	const first = 100
+	go func() {
+		for i := 0; i < first; i++ {
+			_, _ = io.WriteString(pw, line(i))
+		}
+	}()
+
+	r, err := srv.Client().Do(request)
+	require.NoError(t, err)
+	defer r.Body.Close()
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+
+	type result struct {
+		CorrelationID string `json:"correlation_id"`
+		Status        string `json:"status"`
+		ShortURL      string `json:"short_url"`
+		Error         string `json:"error"`
+	}
+	dec := json.NewDecoder(r.Body)
+	read := func() result {
+		var res result
+		require.NoError(t, dec.Decode(&res))
+		return res
+	}
+
+	// Первая пачка приходит в ответ до того, как клиент закончил тело.
+	for i := 0; i < first; i++ {
+		res := read()
+		assert.Equal(t, strconv.Itoa(i), res.CorrelationID)
+		assert.Equal(t, "created", res.Status)
+		assert.Equal(t, "http://localhost:8080/"+model.ShortKey(fmt.Sprintf("https://stream.example.com/%d", i)), res.ShortURL)
+	}
+
+	_, err = io.WriteString(pw, line(0)+"not json\n"+`{"correlation_id":"x","original_url":"bad"}`+"\n")
+	require.NoError(t, err)
+	require.NoError(t, pw.Close())
+
+	assert.Equal(t, result{CorrelationID: "0", Status: "exists",
+		ShortURL: "http://localhost:8080/" + model.ShortKey("https://stream.example.com/0")}, read())
+	assert.Equal(t, result{Status: "invalid", Error: "can't unmarshal row 102"}, read())
+	assert.Equal(t, result{CorrelationID: "x", Status: "invalid", Error: "invalid URL"}, read())
+	assert.False(t, dec.More())
+}
+
+// doRedirect переходит по короткой ссылке, не следуя перенаправлению.
+func doRedirect(t *testing.T, srv *httptest.Server, method string, path string, header http.Header, form string) (*http.Response, []byte) {
+	request, err := http.NewRequest(method, srv.URL+path, strings.NewReader(form))
+	require.NoError(t, err)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if form != "" {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	client := srv.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	r, err := client.Do(request)
+	require.NoError(t, err)
+	rBody, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	require.NoError(t, r.Body.Close())
+	return r, rBody
+}
+
+func testAPIPassword(t *testing.T, srv *httptest.Server, dbName string) {
+	ourl := "https://password.example.com/doc"
+	plain, user := shortenAs(t, srv, "", ourl)
+
+	// Ссылка с паролем на уже сокращенный адрес получает собственный ключ.
+	status, body := doJSON(t, srv, http.MethodPost, "/api/shorten", user, `{"url":"`+ourl+`","password":"secret"}`)
+	require.Equal(t, http.StatusCreated, status)
+	key := linkKey(t, body)
+	require.NotEqual(t, plain, key)
+
+	t.Run(dbName+" Выполнить Get /{id} без пароля по ключу адреса", func(t *testing.T) {
+		r, _ := doRedirect(t, srv, http.MethodGet, "/"+plain, nil, "")
+		assert.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+		assert.Equal(t, ourl, r.Header.Get("Location"))
+	})
+
+	testTable := []struct {
+		name     string
+		path     string
+		password string
+		status   int
+		code     string
+	}{
+		{"Без пароля", "/" + key, "", http.StatusUnauthorized, "password_required"},
+		{"Неверный пароль", "/" + key, "wrong", http.StatusForbidden, "wrong_password"},
+		{"Пароль в заголовке", "/" + key, "secret", http.StatusTemporaryRedirect, ""},
+		{"Пароль в параметре не принимается", "/" + key + "?password=secret", "", http.StatusUnauthorized, "password_required"},
+		{"Поддельный токен", "/" + key + "?token=9999999999.deadbeef", "", http.StatusUnauthorized, "password_required"},
+	}
+	for _, testData := range testTable {
+		t.Run(dbName+" Выполнить Get /{id} с паролем: "+testData.name, func(t *testing.T) {
+			header := http.Header{}
+			if testData.password != "" {
+				header.Set("X-Link-Password", testData.password)
+			}
+			r, body := doRedirect(t, srv, http.MethodGet, testData.path, header, "")
+			assert.Equal(t, testData.status, r.StatusCode)
+			if testData.code != "" {
+				code, _ := problem(t, r, body)
+				assert.Equal(t, testData.code, code)
+				return
+			}
+			assert.Equal(t, ourl, r.Header.Get("Location"))
+		})
+	}
+
+	t.Run(dbName+" Выполнить Post /api/user/urls/{key}/access-token", func(t *testing.T) {
+		path := "/api/user/urls/" + key + "/access-token"
+		status, body := doJSON(t, srv, http.MethodPost, path, user, "")
+		require.Equal(t, http.StatusCreated, status)
+		var res struct {
+			Token     string    `json:"token"`
+			ShortURL  string    `json:"short_url"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}
+		require.NoError(t, json.Unmarshal(body, &res))
+		assert.Equal(t, "http://localhost:8080/"+key+"?token="+url.QueryEscape(res.Token), res.ShortURL)
+		assert.WithinDuration(t, time.Now().Add(24*time.Hour), res.ExpiresAt, time.Minute)
+
+		r, _ := doRedirect(t, srv, http.MethodGet, strings.TrimPrefix(res.ShortURL, "http://localhost:8080"), nil, "")
+		assert.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+		assert.Equal(t, ourl, r.Header.Get("Location"))
+
+		// Токен действует только для своей ссылки.
+		status, body = doJSON(t, srv, http.MethodPost, "/api/v2/links", user, `{"original_url":"`+ourl+`","password":"secret"}`)
+		require.Equal(t, http.StatusCreated, status)
+		r, _ = doRedirect(t, srv, http.MethodGet, "/"+linkKey(t, body)+"?token="+url.QueryEscape(res.Token), nil, "")
+		assert.Equal(t, http.StatusUnauthorized, r.StatusCode)
+
+		status, _ = doJSON(t, srv, http.MethodPost, "/api/user/urls/"+plain+"/access-token", user, "")
+		assert.Equal(t, http.StatusBadRequest, status)
+		status, _ = doJSON(t, srv, http.MethodPost, path, uuid.New().String(), "")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run(dbName+" Выполнить Post /api/v2/links с паролем", func(t *testing.T) {
+		v2url := "https://password.example.com/v2"
+		status, body := doJSON(t, srv, http.MethodPost, "/api/v2/links", "", `{"original_url":"`+v2url+`","password":"v2secret"}`)
+		require.Equal(t, http.StatusCreated, status)
+		key := linkKey(t, body)
+
+		// Повторное сокращение с другим паролем создает новую ссылку, а не возвращает прежнюю.
+		status, body = doJSON(t, srv, http.MethodPost, "/api/v2/links", "", `{"original_url":"`+v2url+`","password":"other"}`)
+		require.Equal(t, http.StatusCreated, status)
+		assert.NotEqual(t, key, linkKey(t, body))
+
+		r, _ := doRedirect(t, srv, http.MethodGet, "/"+key, nil, "")
+		assert.Equal(t, http.StatusUnauthorized, r.StatusCode)
+		r, _ = doRedirect(t, srv, http.MethodGet, "/"+key, http.Header{"X-Link-Password": {"other"}}, "")
+		assert.Equal(t, http.StatusForbidden, r.StatusCode)
+		r, _ = doRedirect(t, srv, http.MethodGet, "/"+key, http.Header{"X-Link-Password": {"v2secret"}}, "")
+		assert.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+		assert.Equal(t, v2url, r.Header.Get("Location"))
+	})
+}
+
+func TestLinkPassword(t *testing.T) {
+	srv := newMemoryServer(t, func(cfg *config.Config) {
+		cfg.RatePassword = ratelimit.Limit{Rate: 2.0 / 60, Burst: 2}
+	})
+	defer srv.Close()
+
+	ourl := "https://password.example.com/form"
+	status, body := doJSON(t, srv, http.MethodPost, "/api/shorten", "", `{"url":"`+ourl+`","password":"secret"}`)
+	require.Equal(t, http.StatusCreated, status)
+	key := linkKey(t, body)
+	browser := http.Header{"Accept": {"text/html,application/xhtml+xml"}}
+
+	t.Run("Браузер получает форму ввода пароля", func(t *testing.T) {
+		r, body := doRedirect(t, srv, http.MethodGet, "/"+key, browser, "")
+		assert.Equal(t, http.StatusUnauthorized, r.StatusCode)
+		assert.Equal(t, "text/html; charset=utf-8", r.Header.Get("Content-Type"))
+		assert.Contains(t, string(body), `<form method="post">`)
+		assert.NotContains(t, string(body), ourl)
+	})
+
+	t.Run("Неверный пароль из формы", func(t *testing.T) {
+		r, body := doRedirect(t, srv, http.MethodPost, "/"+key, browser, "password=wrong")
+		assert.Equal(t, http.StatusForbidden, r.StatusCode)
+		assert.Contains(t, string(body), "Неверный пароль")
+	})
+
+	t.Run("Верный пароль из формы", func(t *testing.T) {
+		r, _ := doRedirect(t, srv, http.MethodPost, "/"+key, browser, "password=secret")
+		assert.Equal(t, http.StatusSeeOther, r.StatusCode)
+		assert.Equal(t, ourl, r.Header.Get("Location"))
+	})
+
+	t.Run("Верный пароль не расходует попытки", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			r, _ := doRedirect(t, srv, http.MethodPost, "/"+key, browser, "password=secret")
+			assert.Equal(t, http.StatusSeeOther, r.StatusCode)
+		}
+	})
+
+	t.Run("Попытки ввода пароля ограничены", func(t *testing.T) {
+		r, _ := doRedirect(t, srv, http.MethodPost, "/"+key, browser, "password=wrong")
+		assert.Equal(t, http.StatusForbidden, r.StatusCode)
+
+		r, body := doRedirect(t, srv, http.MethodPost, "/"+key, browser, "password=secret")
+		assert.Equal(t, http.StatusTooManyRequests, r.StatusCode)
+		code, _ := problem(t, r, body)
+		assert.Equal(t, "rate_limited", code)
+		assert.NotEmpty(t, r.Header.Get("Retry-After"))
+	})
+
+	t.Run("Параллельные попытки не обходят лимит", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodPost, "/api/v2/links", "", `{"original_url":"`+ourl+`","password":"secret"}`)
+		require.Equal(t, http.StatusCreated, status)
+		key := linkKey(t, body)
+
+		statuses := make(chan int, 10)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(statuses); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r, _ := doRedirect(t, srv, http.MethodGet, "/"+key, http.Header{"X-Link-Password": {"wrong"}}, "")
+				statuses <- r.StatusCode
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+
+		counts := make(map[int]int)
+		for status := range statuses {
+			counts[status]++
+		}
+		assert.Equal(t, map[int]int{http.StatusForbidden: 2, http.StatusTooManyRequests: 8}, counts)
+	})
+
+	t.Run("Слишком длинный пароль", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodPost, "/api/v2/links", "",
+			`{"original_url":"https://password.example.com/long","password":"`+strings.Repeat("я", 40)+`"}`)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Contains(t, string(body), "password is longer than 72 bytes")
+	})
+}
+
+func TestFilePasswordPersists(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "urls.json")
+	db, err := sfile.New(fname)
+	require.NoError(t, err)
+	urls := []model.URL{{Key: "k", OriginalURL: "https://password.example.com/file", PasswordHash: "hash"}}
+	require.NoError(t, db.Set(urls))
+	require.NoError(t, db.CloseFile())
+
+	db, err = sfile.New(fname)
+	require.NoError(t, err)
+	defer db.CloseFile()
+	url, err := db.Get("k")
+	require.NoError(t, err)
+	assert.Equal(t, "hash", url.PasswordHash)
+}
+
+func TestFileRowError(t *testing.T) {
+	db, err := sfile.New(filepath.Join(t.TempDir(), "urls.json"))
+	require.NoError(t, err)
+	// Запись в закрытый файл не удается, и ошибка сохраняется в строке, а не возвращается.
+	require.NoError(t, db.CloseFile())
+
+	urls := []model.URL{{Key: "k", OriginalURL: "https://row-error.example.com"}}
+	require.NoError(t, db.Set(urls))
+	assert.Error(t, urls[0].Err)
+	_, err = db.Get("k")
+	assert.ErrorIs(t, err, model.ErrNotFound)
+}
+
+func testAPIMaxClicks(t *testing.T, srv *httptest.Server, dbName string) {
+	testTable := []struct {
+		name      string
+		path      string
+		body      string
+		ourl      string
+		password  string
+		maxClicks int
+	}{
+		{"Post /api/shorten", "/api/shorten", `{"url":"https://clicks.example.com/v1","max_clicks":2}`, "https://clicks.example.com/v1", "", 2},
+		{"Post /api/v2/links", "/api/v2/links", `{"original_url":"https://clicks.example.com/v2","max_clicks":2}`, "https://clicks.example.com/v2", "", 2},
+		{"одноразовая ссылка с паролем", "/api/shorten", `{"url":"https://clicks.example.com/once","max_clicks":1,"password":"secret"}`, "https://clicks.example.com/once", "secret", 1},
+	}
+	for _, testData := range testTable {
+		t.Run(dbName+" Ограничение переходов: "+testData.name, func(t *testing.T) {
+			status, body := doJSON(t, srv, http.MethodPost, testData.path, "", testData.body)
+			require.Equal(t, http.StatusCreated, status)
+			key := "/" + linkKey(t, body)
+
+			header := http.Header{}
+			if testData.password != "" {
+				// Отказ по паролю не списывает переход.
+				r, _ := doRedirect(t, srv, http.MethodGet, key, http.Header{"X-Link-Password": {"wrong"}}, "")
+				assert.Equal(t, http.StatusForbidden, r.StatusCode)
+				header.Set("X-Link-Password", testData.password)
+			}
+			for i := 0; i < testData.maxClicks; i++ {
+				r, _ := doRedirect(t, srv, http.MethodGet, key, header, "")
+				assert.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+				assert.Equal(t, testData.ourl, r.Header.Get("Location"))
+			}
+			r, body := doRedirect(t, srv, http.MethodGet, key, header, "")
+			assert.Equal(t, http.StatusGone, r.StatusCode)
+			code, _ := problem(t, r, body)
+			assert.Equal(t, "clicks_exhausted", code)
+		})
+	}
+
+	t.Run(dbName+" Ограничение переходов: повторное приглашение на тот же адрес", func(t *testing.T) {
+		body := `{"url":"https://clicks.example.com/invite","max_clicks":1}`
+		status, first := doJSON(t, srv, http.MethodPost, "/api/shorten", "", body)
+		require.Equal(t, http.StatusCreated, status)
+		r, _ := doRedirect(t, srv, http.MethodGet, "/"+linkKey(t, first), nil, "")
+		require.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+
+		// Новое приглашение - новая ссылка со своим счетчиком, а не исчерпанная прежняя.
+		status, second := doJSON(t, srv, http.MethodPost, "/api/shorten", "", body)
+		require.Equal(t, http.StatusCreated, status)
+		assert.NotEqual(t, linkKey(t, first), linkKey(t, second))
+		r, _ = doRedirect(t, srv, http.MethodGet, "/"+linkKey(t, second), nil, "")
+		assert.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+	})
+
+	t.Run(dbName+" Ограничение переходов: отрицательное max_clicks", func(t *testing.T) {
+		status, _ := doJSON(t, srv, http.MethodPost, "/api/shorten", "", `{"url":"https://clicks.example.com/negative","max_clicks":-1}`)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+}
+
+func TestFileClicksPersist(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "urls.json")
+	db, err := sfile.New(fname)
+	require.NoError(t, err)
+	urls := []model.URL{
+		{Key: "limited", OriginalURL: "https://clicks.example.com/file", UserID: "user", MaxClicks: 3},
+		{Key: "plain", OriginalURL: "https://clicks.example.com/plain", UserID: "user"},
+	}
+	require.NoError(t, db.Set(urls))
+
+	lines := func() int {
+		data, err := os.ReadFile(fname)
+		require.NoError(t, err)
+		return strings.Count(string(data), "\n")
+	}
+	// Переход дописывает в файл новую версию записи, а не перезаписывает файл.
+	require.NoError(t, db.ConsumeClick("limited"))
+	require.NoError(t, db.ConsumeClick("limited"))
+	assert.Equal(t, 4, lines())
+	require.NoError(t, db.CloseFile())
+
+	db, err = sfile.New(fname)
+	require.NoError(t, err)
+	assert.Len(t, db.GetByUser("user"), 2)
+	require.NoError(t, db.ConsumeClick("limited"))
+	// Дописанных версий стало больше, чем записей: файл сжат.
+	assert.Equal(t, 2, lines())
+	assert.ErrorIs(t, db.ConsumeClick("limited"), model.ErrClicksExhausted)
+	require.NoError(t, db.CloseFile())
+
+	db, err = sfile.New(fname)
+	require.NoError(t, err)
+	defer db.CloseFile()
+	_, err = db.Get("limited")
+	assert.ErrorIs(t, err, model.ErrClicksExhausted)
+}
+
+func TestFileEditsPersist(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	fname := filepath.Join(dir, "urls.json")
+	db, err := sfile.New(fname)
+	require.NoError(t, err)
+	urls := []model.URL{
+		{Key: "edited", OriginalURL: "https://edits.example.com/1", UserID: "user"},
+		{Key: "deleted", OriginalURL: "https://edits.example.com/2", UserID: "user"},
+	}
+	require.NoError(t, db.Set(urls))
+
+	// Правки дописывают в файл новые версии записей.
+	_, err = db.Update("user", "edited", "https://edits.example.com/3")
+	require.NoError(t, err)
+	require.NoError(t, db.SetRules("user", "edited", []model.RedirectRule{{Device: "mobile", Target: "https://edits.example.com/m"}}))
+	db.UpdateDeleteFlag("user", []string{"deleted"})
+	require.NoError(t, db.CloseFile())
+
+	db, err = sfile.New(fname)
+	require.NoError(t, err)
+	url, err := db.Get("edited")
+	require.NoError(t, err)
+	assert.Equal(t, "https://edits.example.com/3", url.OriginalURL)
+	assert.Len(t, url.Rules, 1)
+	_, err = db.Get("deleted")
+	assert.ErrorIs(t, err, model.ErrIsDeleted)
+
+	// Перезапись не удалась: ссылка остается и в памяти, и в файле.
+	require.NoError(t, os.Rename(dir, dir+".moved"))
+	_, err = db.Purge(time.Now().Add(time.Hour))
+	assert.Error(t, err)
+	_, err = db.Get("deleted")
+	assert.ErrorIs(t, err, model.ErrIsDeleted)
+	require.NoError(t, os.Rename(dir+".moved", dir))
+
+	count, err := db.Purge(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	require.NoError(t, db.SetRules("user", "edited", nil))
+	require.NoError(t, db.CloseFile())
+
+	db, err = sfile.New(fname)
+	require.NoError(t, err)
+	defer db.CloseFile()
+	_, err = db.Get("deleted")
+	assert.ErrorIs(t, err, model.ErrNotFound)
+	url, err = db.Get("edited")
+	require.NoError(t, err)
+	assert.Empty(t, url.Rules)
+}
+
+func TestFileLegacyDeleted(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "urls.json")
+	legacy := `{"uuid":1,"short_key":"legacy","original_url":"https://legacy.example.com/1","user_id":"user","is_deleted":true}` + "\n" +
+		`{"uuid":2,"short_key":"kept","original_url":"https://legacy.example.com/2","user_id":"user","is_deleted":false}` + "\n"
+	require.NoError(t, os.WriteFile(fname, []byte(legacy), 0644))
+
+	// deletedAt возвращает время удаления ссылки legacy после загрузки файла.
+	deletedAt := func(t *testing.T) time.Time {
+		db, err := sfile.New(fname)
+		require.NoError(t, err)
+		defer db.CloseFile()
+		urls := db.Export("user")
+		require.Len(t, urls, 2)
+		require.True(t, urls[0].IsDeleted)
+		return urls[0].DeletedAt
+	}
+	first := deletedAt(t)
+	require.False(t, first.IsZero())
+	assert.True(t, first.Equal(deletedAt(t)), "срок хранения не начинается заново при каждой загрузке")
+
+	// Номера записей не переиспользуются после очистки.
+	db, err := sfile.New(fname)
+	require.NoError(t, err)
+	count, err := db.Purge(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.NoError(t, db.Set([]model.URL{{Key: "new", OriginalURL: "https://legacy.example.com/3", UserID: "user"}}))
+	require.NoError(t, db.CloseFile())
+
+	data, err := os.ReadFile(fname)
+	require.NoError(t, err)
+	uuids := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec struct {
+			UUID     int    `json:"uuid"`
+			ShortKey string `json:"short_key"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		uuids[rec.ShortKey] = rec.UUID
+	}
+	assert.Equal(t, map[string]int{"kept": 2, "new": 3}, uuids)
+}
+
+func TestConsumeClickConcurrent(t *testing.T) {
+	fileDB, err := sfile.New(filepath.Join(t.TempDir(), "urls.json"))
+	require.NoError(t, err)
+	defer fileDB.CloseFile()
+
+	testTable := []struct {
+		name string
+		repo model.URLRepository
+	}{
+		{"memory", memory.NewRepository(smemory.New())},
+		{"file", file.NewRepository(fileDB)},
+	}
+	const maxClicks, clicks = 5, 50
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			ctx := context.Background()
+			urls := []model.URL{{Key: "limited", OriginalURL: "https://clicks.example.com/concurrent", MaxClicks: maxClicks}}
+			require.NoError(t, testData.repo.SaveURL(ctx, urls))
+
+			var wg sync.WaitGroup
+			errs := make(chan error, clicks)
+			for i := 0; i < clicks; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- testData.repo.ConsumeClick(ctx, "limited")
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			consumed := 0
+			for err := range errs {
+				if err == nil {
+					consumed++
+					continue
+				}
+				assert.ErrorIs(t, err, model.ErrClicksExhausted)
+			}
+			assert.Equal(t, maxClicks, consumed)
+			_, err := testData.repo.GetURL(ctx, "limited")
+			assert.ErrorIs(t, err, model.ErrClicksExhausted)
+		})
+	}
+}
+
+func testAPIRules(t *testing.T, srv *httptest.Server, dbName string) {
+	ourl := "https://rules.example.com/default"
+	key, user := shortenAs(t, srv, "", ourl)
+	path := "/api/user/urls/" + key + "/rules"
+
+	t.Run(dbName+" Правила ссылки: без правил", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodGet, path, user, "")
+		require.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `[]`, string(body))
+	})
+
+	t.Run(dbName+" Правила ссылки: сохранение", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodPut, path, user, `[
+			{"query":{"utm_source":"mail"},"target":"https://rules.example.com/mail"},
+			{"device":"mobile","target":"HTTPS://Rules.Example.com/mobile"},
+			{"language":"de","target":"https://rules.example.com/de"}
+		]`)
+		require.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `[
+			{"query":{"utm_source":"mail"},"target":"https://rules.example.com/mail"},
+			{"device":"mobile","target":"https://rules.example.com/mobile"},
+			{"language":"de","target":"https://rules.example.com/de"}
+		]`, string(body))
+
+		status, stored := doJSON(t, srv, http.MethodGet, path, user, "")
+		require.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, string(body), string(stored))
+	})
+
+	testTable := []struct {
+		name   string
+		path   string
+		header http.Header
+		want   string
+	}{
+		{"Без совпадений", "/" + key, http.Header{"User-Agent": {"Mozilla/5.0 (X11; Linux x86_64)"}}, ourl},
+		{"Мобильное устройство", "/" + key, http.Header{"User-Agent": {"Mozilla/5.0 (iPhone) Mobile"}}, "https://rules.example.com/mobile"},
+		{"Язык", "/" + key, http.Header{"Accept-Language": {"de-DE,de;q=0.9"}}, "https://rules.example.com/de"},
+		{"Параметр запроса", "/" + key + "?utm_source=mail", http.Header{"User-Agent": {"Mozilla/5.0 (iPhone) Mobile"}}, "https://rules.example.com/mail"},
+	}
+	for _, testData := range testTable {
+		t.Run(dbName+" Правила ссылки: переход, "+testData.name, func(t *testing.T) {
+			r, _ := doRedirect(t, srv, http.MethodGet, testData.path, testData.header, "")
+			assert.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+			assert.Equal(t, testData.want, r.Header.Get("Location"))
+			assert.Contains(t, r.Header.Values("Vary"), "User-Agent, Accept-Language")
+		})
+	}
+
+	errorTable := []struct {
+		name   string
+		path   string
+		user   string
+		body   string
+		status int
+		code   string
+	}{
+		{"Чужая ссылка", path, uuid.New().String(), `[]`, http.StatusNotFound, "not_found"},
+		{"Неизвестное устройство", path, user, `[{"device":"watch","target":"https://rules.example.com/w"}]`, http.StatusBadRequest, "invalid_body"},
+		{"Неверная цель", path, user, `[{"device":"bot","target":"not a url"}]`, http.StatusBadRequest, "invalid_url"},
+	}
+	for _, testData := range errorTable {
+		t.Run(dbName+" Правила ссылки: ошибка, "+testData.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodPut, srv.URL+testData.path, strings.NewReader(testData.body))
+			require.NoError(t, err)
+			request.Header.Set("Content-Type", "application/json")
+			request.AddCookie(&http.Cookie{Name: "auth_token", Value: testData.user})
+			r, err := srv.Client().Do(request)
+			require.NoError(t, err)
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.NoError(t, r.Body.Close())
+			assert.Equal(t, testData.status, r.StatusCode)
+			code, _ := problem(t, r, body)
+			assert.Equal(t, testData.code, code)
+		})
+	}
+
+	t.Run(dbName+" Правила ссылки: удаление", func(t *testing.T) {
+		status, _ := doJSON(t, srv, http.MethodPut, path, user, `[]`)
+		require.Equal(t, http.StatusOK, status)
+		r, _ := doRedirect(t, srv, http.MethodGet, "/"+key, http.Header{"User-Agent": {"Mozilla/5.0 (iPhone) Mobile"}}, "")
+		assert.Equal(t, ourl, r.Header.Get("Location"))
+		assert.Empty(t, r.Header.Values("Vary"))
+	})
+}
+
+func testAPISplit(t *testing.T, srv *httptest.Server, dbName string) {
+	user := uuid.New().String()
+	ourl := "https://split.example.com/landing"
+	variantA := "https://split.example.com/a"
+	variantB := "https://split.example.com/b"
+	status, body := doJSON(t, srv, http.MethodPost, "/api/shorten", user,
+		`{"url":"`+ourl+`","variants":[{"url":"`+variantA+`","weight":3},{"url":"`+variantB+`","weight":1}]}`)
+	require.Equal(t, http.StatusCreated, status)
+	key := linkKey(t, body)
+	cookieName := "split_" + key
+
+	t.Run(dbName+" Разделение трафика: создание ссылки", func(t *testing.T) {
+	})
+
+	const visitors, returns = 40, 5
+	t.Run(dbName+" Разделение трафика: новые посетители получают вариант и cookie", func(t *testing.T) {
+		for i := 0; i < visitors; i++ {
+			r, _ := doRedirect(t, srv, http.MethodGet, "/"+key, nil, "")
+			require.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+			location := r.Header.Get("Location")
+			assert.Contains(t, []string{variantA, variantB}, location)
+
+			var cookie *http.Cookie
+			for _, c := range r.Cookies() {
+				if c.Name == cookieName {
+					cookie = c
+				}
+			}
+			require.NotNil(t, cookie)
+			assert.Equal(t, "/", cookie.Path)
+			want := map[string]string{"0": variantA, "1": variantB}[cookie.Value]
+			assert.Equal(t, want, location)
+		}
+	})
+
+	t.Run(dbName+" Разделение трафика: вариант закреплен за посетителем", func(t *testing.T) {
+		for i := 0; i < returns; i++ {
+			r, _ := doRedirect(t, srv, http.MethodGet, "/"+key, http.Header{"Cookie": {cookieName + "=1"}}, "")
+			require.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+			assert.Equal(t, variantB, r.Header.Get("Location"))
+			for _, c := range r.Cookies() {
+				assert.NotEqual(t, cookieName, c.Name)
+			}
+		}
+	})
+
+	t.Run(dbName+" Разделение трафика: статистика по вариантам", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodGet, "/api/user/urls/"+key+"/stats", user, "")
+		require.Equal(t, http.StatusOK, status)
+		var stats struct {
+			ShortURL string `json:"short_url"`
+			Variants []struct {
+				URL    string `json:"url"`
+				Weight int    `json:"weight"`
+				Clicks int64  `json:"clicks"`
+			} `json:"variants"`
+		}
+		require.NoError(t, json.Unmarshal(body, &stats))
+		assert.Equal(t, "http://localhost:8080/"+key, stats.ShortURL)
+		require.Len(t, stats.Variants, 2)
+		assert.Equal(t, variantA, stats.Variants[0].URL)
+		assert.Equal(t, 3, stats.Variants[0].Weight)
+		assert.Equal(t, variantB, stats.Variants[1].URL)
+		assert.GreaterOrEqual(t, stats.Variants[1].Clicks, int64(returns))
+		assert.Equal(t, int64(visitors+returns), stats.Variants[0].Clicks+stats.Variants[1].Clicks)
+
+		status, _ = doJSON(t, srv, http.MethodGet, "/api/user/urls/"+key+"/stats", uuid.New().String(), "")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run(dbName+" Разделение трафика: Post /api/v2/links", func(t *testing.T) {
+		v2url := "https://split.example.com/v2"
+		status, body := doJSON(t, srv, http.MethodPost, "/api/v2/links", user,
+			`{"original_url":"`+v2url+`","variants":[{"url":"`+variantA+`","weight":1},{"url":"`+variantB+`","weight":1}]}`)
+		require.Equal(t, http.StatusCreated, status)
+		key := linkKey(t, body)
+		r, _ := doRedirect(t, srv, http.MethodGet, "/"+key, http.Header{"Cookie": {"split_" + key + "=0"}}, "")
+		assert.Equal(t, variantA, r.Header.Get("Location"))
+	})
+
+	t.Run(dbName+" Разделение трафика: предпросмотр и переход ведут на один вариант", func(t *testing.T) {
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err)
+		client := &http.Client{
+			Jar: jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		get := func(path string) (*http.Response, string) {
+			r, err := client.Get(srv.URL + path)
+			require.NoError(t, err)
+			rBody, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.NoError(t, r.Body.Close())
+			return r, string(rBody)
+		}
+
+		r, _ := get("/" + key)
+		require.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+		for i := 0; i < 10; i++ {
+			_, page := get("/" + key + "+")
+			assert.Contains(t, page, "<code>"+r.Header.Get("Location")+"</code>")
+		}
+	})
+
+	errorTable := []struct {
+		name     string
+		variants string
+		code     string
+	}{
+		{"Один вариант", `[{"url":"` + variantA + `","weight":1}]`, "invalid_body"},
+		{"Нулевой вес", `[{"url":"` + variantA + `","weight":0},{"url":"` + variantB + `","weight":1}]`, "invalid_body"},
+		{"Слишком большой вес", `[{"url":"` + variantA + `","weight":10001},{"url":"` + variantB + `","weight":1}]`, "invalid_body"},
+		{"Переполнение суммы весов", `[{"url":"` + variantA + `","weight":9223372036854775807},{"url":"` + variantB + `","weight":1}]`, "invalid_body"},
+		{"Неверная ссылка варианта", `[{"url":"not a url","weight":1},{"url":"` + variantB + `","weight":1}]`, "invalid_url"},
+	}
+	for _, testData := range errorTable {
+		t.Run(dbName+" Разделение трафика: ошибка, "+testData.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodPost, srv.URL+"/api/shorten",
+				strings.NewReader(`{"url":"https://split.example.com/invalid","variants":`+testData.variants+`}`))
+			require.NoError(t, err)
+			request.Header.Set("Content-Type", "application/json")
+			r, err := srv.Client().Do(request)
+			require.NoError(t, err)
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.NoError(t, r.Body.Close())
+			assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+			code, _ := problem(t, r, body)
+			assert.Equal(t, testData.code, code)
+		})
+	}
+}
+
+func TestFileVariantsPersist(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "urls.json")
+	db, err := sfile.New(fname)
+	require.NoError(t, err)
+	variants := []model.URLVariant{{URL: "https://split.example.com/a", Weight: 2}, {URL: "https://split.example.com/b", Weight: 1}}
+	urls := []model.URL{{Key: "k", OriginalURL: "https://split.example.com/file", UserID: "user", Variants: variants}}
+	require.NoError(t, db.Set(urls))
+	require.NoError(t, db.RecordVariantClick("k", 1))
+	require.NoError(t, db.RecordVariantClick("k", 1))
+	require.NoError(t, db.CloseFile())
+
+	db, err = sfile.New(fname)
+	require.NoError(t, err)
+	defer db.CloseFile()
+	url, err := db.Get("k")
+	require.NoError(t, err)
+	assert.Equal(t, variants, url.Variants)
+	stats, err := db.VariantStats("user", "k")
+	require.NoError(t, err)
+	assert.Equal(t, []model.VariantStats{{URLVariant: variants[0]}, {URLVariant: variants[1], Clicks: 2}}, stats)
+}
+
+func testAPIRedirectStatus(t *testing.T, srv *httptest.Server, dbName string) {
+	testTable := []struct {
+		name         string
+		path         string
+		body         string
+		ourl         string
+		status       int
+		cacheControl string
+	}{
+		{"Код по умолчанию", "/api/shorten", `{"url":"https://status.example.com/default"}`, "https://status.example.com/default", http.StatusTemporaryRedirect, "no-store"},
+		{"301", "/api/shorten", `{"url":"https://status.example.com/301","redirect_status":301}`, "https://status.example.com/301", http.StatusMovedPermanently, "no-cache"},
+		{"302", "/api/shorten", `{"url":"https://status.example.com/302","redirect_status":302}`, "https://status.example.com/302", http.StatusFound, "no-store"},
+		{"308 в API v2", "/api/v2/links", `{"original_url":"https://status.example.com/308","redirect_status":308}`, "https://status.example.com/308", http.StatusPermanentRedirect, "no-cache"},
+	}
+	for _, testData := range testTable {
+		t.Run(dbName+" Код перенаправления: "+testData.name, func(t *testing.T) {
+			status, body := doJSON(t, srv, http.MethodPost, testData.path, "", testData.body)
+			require.Equal(t, http.StatusCreated, status)
+
+			r, _ := doRedirect(t, srv, http.MethodGet, "/"+linkKey(t, body), nil, "")
+			assert.Equal(t, testData.status, r.StatusCode)
+			assert.Equal(t, testData.ourl, r.Header.Get("Location"))
+			assert.Equal(t, testData.cacheControl, r.Header.Get("Cache-Control"))
+		})
+	}
+
+	t.Run(dbName+" Код перенаправления: исчерпанная постоянная ссылка не кешируется", func(t *testing.T) {
+		ourl := "https://status.example.com/once"
+		status, body := doJSON(t, srv, http.MethodPost, "/api/shorten", "", `{"url":"`+ourl+`","redirect_status":301,"max_clicks":1}`)
+		require.Equal(t, http.StatusCreated, status)
+		key := linkKey(t, body)
+
+		r, _ := doRedirect(t, srv, http.MethodGet, "/"+key, nil, "")
+		assert.Equal(t, http.StatusMovedPermanently, r.StatusCode)
+		assert.Equal(t, "no-cache", r.Header.Get("Cache-Control"))
+		r, _ = doRedirect(t, srv, http.MethodGet, "/"+key, nil, "")
+		assert.Equal(t, http.StatusGone, r.StatusCode)
+		assert.Equal(t, "no-store", r.Header.Get("Cache-Control"))
+	})
+
+	t.Run(dbName+" Код перенаправления: недопустимый код", func(t *testing.T) {
+		status, _ := doJSON(t, srv, http.MethodPost, "/api/shorten", "", `{"url":"https://status.example.com/304","redirect_status":304}`)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+}
+
+func TestRedirectStatusConfig(t *testing.T) {
+	srv := newMemoryServer(t, func(cfg *config.Config) {
+		cfg.RedirectStatus = http.StatusFound
+	})
+	defer srv.Close()
+
+	status, _ := doJSON(t, srv, http.MethodPost, "/api/shorten", "", `{"url":"https://status.example.com/global"}`)
+	require.Equal(t, http.StatusCreated, status)
+	r, _ := doRedirect(t, srv, http.MethodGet, "/"+model.ShortKey("https://status.example.com/global"), nil, "")
+	assert.Equal(t, http.StatusFound, r.StatusCode)
+	assert.Equal(t, "no-store", r.Header.Get("Cache-Control"))
+
+	status, body := doJSON(t, srv, http.MethodPost, "/api/shorten", "", `{"url":"https://status.example.com/own","redirect_status":308}`)
+	require.Equal(t, http.StatusCreated, status)
+	r, _ = doRedirect(t, srv, http.MethodGet, "/"+linkKey(t, body), nil, "")
+	assert.Equal(t, http.StatusPermanentRedirect, r.StatusCode)
+}
+
+func testAPITemplate(t *testing.T, srv *httptest.Server, dbName string) {
+	ourl := "https://template.example.com/landing?ref=owner"
+	key, user := shortenAs(t, srv, "", ourl)
+	path := "/api/user/urls/" + key + "/template"
+
+	t.Run(dbName+" Шаблон ссылки: без шаблона", func(t *testing.T) {
+		status, body := doJSON(t, srv, http.MethodGet, path, user, "")
+		require.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `{}`, string(body))
+
+		r, _ := doRedirect(t, srv, http.MethodGet, "/"+key+"?gclid=1", nil, "")
+		assert.Equal(t, ourl, r.Header.Get("Location"))
+	})
+
+	t.Run(dbName+" Шаблон ссылки: сохранение", func(t *testing.T) {
+		tpl := `{"params":{"utm_source":"short","utm_campaign":"{key}-{device}"},"pass_query":["gclid","ref"]}`
+		status, body := doJSON(t, srv, http.MethodPut, path, user, tpl)
+		require.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, tpl, string(body))
+
+		status, stored := doJSON(t, srv, http.MethodGet, path, user, "")
+		require.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, tpl, string(stored))
+	})
+
+	testTable := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"Параметры шаблона", "", ourl + "&utm_campaign=" + key + "-desktop&utm_source=short"},
+		{"Разрешенный параметр посетителя", "?gclid=a%20b&other=1", ourl + "&utm_campaign=" + key + "-desktop&utm_source=short&gclid=a+b"},
+		{"Посетитель не переопределяет параметры", "?ref=visitor&utm_source=visitor", ourl + "&utm_campaign=" + key + "-desktop&utm_source=short"},
+		{"Пароль не передается", "?password=secret&gclid=1", ourl + "&utm_campaign=" + key + "-desktop&utm_source=short&gclid=1"},
+	}
+	for _, testData := range testTable {
+		t.Run(dbName+" Шаблон ссылки: переход, "+testData.name, func(t *testing.T) {
+			r, _ := doRedirect(t, srv, http.MethodGet, "/"+key+testData.query, nil, "")
+			assert.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+			assert.Equal(t, testData.want, r.Header.Get("Location"))
+		})
+	}
+
+	t.Run(dbName+" Шаблон ссылки: чужая ссылка", func(t *testing.T) {
+		status, _ := doJSON(t, srv, http.MethodPut, path, uuid.New().String(), `{}`)
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run(dbName+" Шаблон ссылки: удаление", func(t *testing.T) {
+		status, _ := doJSON(t, srv, http.MethodPut, path, user, `{}`)
+		require.Equal(t, http.StatusOK, status)
+		r, _ := doRedirect(t, srv, http.MethodGet, "/"+key+"?gclid=1", nil, "")
+		assert.Equal(t, ourl, r.Header.Get("Location"))
+	})
+}
+
+func testAPIQR(t *testing.T, srv *httptest.Server, dbName string) {
+	key, user := shortenAs(t, srv, "", "https://qr.example.com/flyer")
+
+	getQR := func(path string, user string, etag string) *http.Response {
+		request, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		require.NoError(t, err)
+		if user != "" {
+			request.AddCookie(&http.Cookie{Name: "auth_token", Value: user})
+		}
+		if etag != "" {
+			request.Header.Set("If-None-Match", etag)
+		}
+		r, err := srv.Client().Do(request)
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, r.Body)
+		require.NoError(t, err)
+		require.NoError(t, r.Body.Close())
+		return r
+	}
+
+	testTable := []struct {
+		name        string
+		path        string
+		user        string
+		status      int
+		contentType string
+	}{
+		{"PNG по умолчанию", "/" + key + "/qr", "", http.StatusOK, "image/png"},
+		{"SVG", "/" + key + "/qr?format=svg&size=512&margin=1&ecc=Q", "", http.StatusOK, "image/svg+xml"},
+		{"Код пользователя", "/api/user/urls/" + key + "/qr?format=svg", user, http.StatusOK, "image/svg+xml"},
+		{"Чужая ссылка", "/api/user/urls/" + key + "/qr", uuid.New().String(), http.StatusNotFound, ""},
+		{"Неизвестная ссылка", "/unknown/qr", "", http.StatusNotFound, ""},
+		{"Неверный отступ", "/" + key + "/qr?margin=20", "", http.StatusBadRequest, ""},
+		{"Код не помещается", "/" + key + "/qr?size=64&margin=16&ecc=H", "", http.StatusBadRequest, ""},
+	}
+	for _, testData := range testTable {
+		t.Run(dbName+" QR-код: "+testData.name, func(t *testing.T) {
+			r := getQR(testData.path, testData.user, "")
+			assert.Equal(t, testData.status, r.StatusCode)
+			if testData.contentType != "" {
+				assert.Equal(t, testData.contentType, r.Header.Get("Content-Type"))
+				assert.NotEmpty(t, r.Header.Get("ETag"))
+				assert.Equal(t, "no-cache", r.Header.Get("Cache-Control"))
+			}
+		})
+	}
+
+	t.Run(dbName+" QR-код: ETag", func(t *testing.T) {
+		path := "/" + key + "/qr?size=300"
+		r := getQR(path, "", "")
+		etag := r.Header.Get("ETag")
+		require.True(t, strings.HasPrefix(etag, `W/"`), etag)
+		assert.Equal(t, "Accept-Encoding", r.Header.Get("Vary"))
+
+		r = getQR(path, "", etag)
+		assert.Equal(t, http.StatusNotModified, r.StatusCode)
+		assert.Equal(t, etag, r.Header.Get("ETag"))
+
+		r = getQR(path, "", `"other", `+strings.TrimPrefix(etag, "W/"))
+		assert.Equal(t, http.StatusNotModified, r.StatusCode)
+
+		r = getQR("/"+key+"/qr?size=400", "", etag)
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.NotEqual(t, etag, r.Header.Get("ETag"))
+	})
+
+	t.Run(dbName+" QR-код: удаленная ссылка", func(t *testing.T) {
+		status, _ := doJSON(t, srv, http.MethodDelete, "/api/user/urls", user, `["`+key+`"]`)
+		require.Equal(t, http.StatusAccepted, status)
+
+		assert.Eventually(t, func() bool {
+			return getQR("/"+key+"/qr", "", "").StatusCode == http.StatusGone
+		}, time.Second, time.Millisecond*20)
+		assert.Equal(t, http.StatusOK, getQR("/api/user/urls/"+key+"/qr", user, "").StatusCode)
+	})
+}
+
+// continueLink возвращает адрес кнопки "Перейти" страницы предпросмотра: ссылку или действие формы.
+func continueLink(t *testing.T, body []byte) string {
+	m := regexp.MustCompile(`(?:href|action)="(/[^"]*)"`).FindSubmatch(body)
+	require.NotNil(t, m, string(body))
+	return html.UnescapeString(string(m[1]))
+}
+
+func testAPIPreview(t *testing.T, srv *httptest.Server, dbName string) {
+	createdAt := time.Now().UTC().Format(time.DateOnly)
+
+	t.Run(dbName+" Предпросмотр: страница ссылки", func(t *testing.T) {
+		ourl := "https://preview.example.com/page?a=1&b=2"
+		status, body := doJSON(t, srv, http.MethodPost, "/api/shorten", "", `{"url":"`+ourl+`","max_clicks":1}`)
+		require.Equal(t, http.StatusCreated, status)
+		key := linkKey(t, body)
+
+		for _, path := range []string{"/" + key + "+", "/" + key + "?preview=1"} {
+			r, body := doRedirect(t, srv, http.MethodGet, path, nil, "")
+			require.Equal(t, http.StatusOK, r.StatusCode, path)
+			assert.Equal(t, "text/html; charset=utf-8", r.Header.Get("Content-Type"))
+			assert.Equal(t, "no-store", r.Header.Get("Cache-Control"))
+			assert.Contains(t, string(body), "https://preview.example.com/page?a=1&amp;b=2")
+			assert.Contains(t, string(body), createdAt)
+			next, err := url.Parse(continueLink(t, body))
+			require.NoError(t, err)
+			assert.Equal(t, "/"+key, next.Path)
+			assert.NotEmpty(t, next.Query().Get("confirm"))
+		}
+
+		// Предпросмотр не списывает переходы.
+		r, _ := doRedirect(t, srv, http.MethodGet, "/"+key, nil, "")
+		assert.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+		assert.Equal(t, ourl, r.Header.Get("Location"))
+	})
+
+	t.Run(dbName+" Предпросмотр: обязательный для ссылки", func(t *testing.T) {
+		ourl := "https://preview.example.com/forced"
+		status, body := doJSON(t, srv, http.MethodPost, "/api/v2/links", "", `{"original_url":"`+ourl+`","interstitial":true}`)
+		require.Equal(t, http.StatusCreated, status)
+		key := linkKey(t, body)
+
+		r, body := doRedirect(t, srv, http.MethodGet, "/"+key+"?utm_source=mail", nil, "")
+		require.Equal(t, http.StatusOK, r.StatusCode)
+		next := continueLink(t, body)
+		assert.Contains(t, next, "&utm_source=mail")
+
+		// Подтверждение без подписанного сервером токена страницу не обходит.
+		status, body = doJSON(t, srv, http.MethodPost, "/api/v2/links", "", `{"original_url":"https://preview.example.com/other","interstitial":true}`)
+		require.Equal(t, http.StatusCreated, status)
+		other := linkKey(t, body)
+		_, body = doRedirect(t, srv, http.MethodGet, "/"+other, nil, "")
+		foreign, err := url.Parse(continueLink(t, body))
+		require.NoError(t, err)
+		for _, confirm := range []string{"1", "9999999999.deadbeef", foreign.Query().Get("confirm")} {
+			r, _ = doRedirect(t, srv, http.MethodGet, "/"+key+"?confirm="+url.QueryEscape(confirm), nil, "")
+			assert.Equal(t, http.StatusOK, r.StatusCode, confirm)
+		}
+
+		r, _ = doRedirect(t, srv, http.MethodGet, next, nil, "")
+		assert.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+		assert.Equal(t, ourl, r.Header.Get("Location"))
+	})
+
+	t.Run(dbName+" Предпросмотр: ссылка с паролем", func(t *testing.T) {
+		ourl := "https://preview.example.com/secret"
+		status, body := doJSON(t, srv, http.MethodPost, "/api/shorten", "", `{"url":"`+ourl+`","password":"secret"}`)
+		require.Equal(t, http.StatusCreated, status)
+		key := linkKey(t, body)
+
+		r, body := doRedirect(t, srv, http.MethodGet, "/"+key+"+", nil, "")
+		assert.Equal(t, http.StatusUnauthorized, r.StatusCode)
+		assert.NotContains(t, string(body), ourl)
+
+		r, body = doRedirect(t, srv, http.MethodGet, "/"+key+"+", http.Header{"X-Link-Password": {"secret"}}, "")
+		require.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Contains(t, string(body), ourl)
+		next := continueLink(t, body)
+		assert.True(t, strings.HasPrefix(next, "/"+key+"?confirm="), next)
+		assert.Contains(t, string(body), `name="password" value="secret"`)
+
+		r, _ = doRedirect(t, srv, http.MethodPost, next, nil, "password=secret")
+		assert.Equal(t, http.StatusSeeOther, r.StatusCode)
+		assert.Equal(t, ourl, r.Header.Get("Location"))
+	})
+
+	t.Run(dbName+" Предпросмотр: параметры не передаются шаблоном", func(t *testing.T) {
+		ourl := "https://preview.example.com/template"
+		key, user := shortenAs(t, srv, "", ourl)
+		status, _ := doJSON(t, srv, http.MethodPut, "/api/user/urls/"+key+"/template", user, `{"pass_query":["*"]}`)
+		require.Equal(t, http.StatusOK, status)
+
+		r, body := doRedirect(t, srv, http.MethodGet, "/"+key+"?preview=1&x=1", nil, "")
+		require.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Contains(t, string(body), "https://preview.example.com/template?x=1")
+
+		r, _ = doRedirect(t, srv, http.MethodGet, continueLink(t, body), nil, "")
+		assert.Equal(t, ourl+"?x=1", r.Header.Get("Location"))
+	})
+}
+
+func TestInterstitialConfig(t *testing.T) {
+	srv := newMemoryServer(t, func(cfg *config.Config) {
+		cfg.Interstitial = true
+		cfg.PreviewAllow = []string{"trusted.example.com"}
+	})
+	defer srv.Close()
+
+	testTable := []struct {
+		name   string
+		ourl   string
+		status int
+	}{
+		{"Разрешенный домен", "https://trusted.example.com/a", http.StatusTemporaryRedirect},
+		{"Поддомен разрешенного домена", "https://docs.trusted.example.com/a", http.StatusTemporaryRedirect},
+		{"Другой домен", "https://untrusted.example.com/a", http.StatusOK},
+	}
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			status, _ := doJSON(t, srv, http.MethodPost, "/api/shorten", "", `{"url":"`+testData.ourl+`"}`)
+			require.Equal(t, http.StatusCreated, status)
+
+			r, _ := doRedirect(t, srv, http.MethodGet, "/"+model.ShortKey(testData.ourl), nil, "")
+			assert.Equal(t, testData.status, r.StatusCode)
+		})
+	}
+}
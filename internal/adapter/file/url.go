@@ -2,41 +2,110 @@ package file
 
 import (
 	"context"
-	"errors"
+	"time"
 
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
 )
 
 // GetURL возвращает ссылку по ключу
-func (r *Repository) GetURL(key string) (*model.URL, error) {
-	ourl, err := r.Get(key)
-	if err != nil {
-		return nil, err
-	}
-
-	out := new(model.URL)
-	out.OriginalURL = ourl
-	out.Key = key
-
-	return out, nil
+func (r *Repository) GetURL(ctx context.Context, key string) (*model.URL, error) {
+	return r.Get(key)
 }
 
 // SaveURL созраняет ссылку в бд
-func (r *Repository) SaveURL(urls []model.URL) error {
+func (r *Repository) SaveURL(ctx context.Context, urls []model.URL) error {
 	return r.Set(urls)
 }
 
 // PingDB проверяет соединение с бд
 func (r *Repository) PingDB(ctx context.Context) error {
-	return errors.New("connection could't be established")
+	return r.Ping()
 }
 
 // GetUsersURL возвращает все ссылки пользователя
-func (r *Repository) GetUsersURL(user string) ([]model.KeyAndOURL, error) {
+func (r *Repository) GetUsersURL(ctx context.Context, user string) ([]model.KeyAndOURL, error) {
 	return r.GetByUser(user), nil
 }
 
+// GetUsersURLPage возвращает страницу ссылок пользователя
+func (r *Repository) GetUsersURLPage(ctx context.Context, user string, filter model.UserURLsFilter) (*model.UserURLsPage, error) {
+	return r.GetPageByUser(user, filter), nil
+}
+
+// ExportURLs возвращает все ссылки пользователя с настройками
+func (r *Repository) ExportURLs(ctx context.Context, user string) ([]model.URL, error) {
+	return r.Export(user), nil
+}
+
 // DeleteURL удаляет ссылку из бд
-func (r *Repository) DeleteURL(user string, keys []string) {
+func (r *Repository) DeleteURL(ctx context.Context, user string, keys []string) {
 	r.UpdateDeleteFlag(user, keys)
 }
+
+// UpdateURL меняет исходную ссылку пользователя
+func (r *Repository) UpdateURL(ctx context.Context, user string, key string, ourl string) (*model.URLRevision, error) {
+	return r.Update(user, key, ourl)
+}
+
+// GetURLRevisions возвращает историю редакций ссылки пользователя
+func (r *Repository) GetURLRevisions(ctx context.Context, user string, key string) ([]model.URLRevision, error) {
+	return r.Revisions(user, key)
+}
+
+// CheckURLOwner проверяет, что ссылка принадлежит пользователю
+func (r *Repository) CheckURLOwner(ctx context.Context, user string, key string) error {
+	return r.CheckOwner(user, key)
+}
+
+// RestoreURL восстанавливает удаленные ссылки пользователя
+func (r *Repository) RestoreURL(ctx context.Context, user string, keys []string, since time.Time) ([]string, error) {
+	return r.Restore(user, keys, since)
+}
+
+// PurgeDeleted окончательно удаляет ссылки, удаленные раньше before
+func (r *Repository) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	return r.Purge(before)
+}
+
+// CheckHealth проверяет готовность хранилища
+func (r *Repository) CheckHealth(ctx context.Context) []model.HealthCheck {
+	return []model.HealthCheck{
+		{Name: model.CheckStorage, Err: r.DB.CheckOpen()},
+		{Name: model.CheckFileWritable, Err: r.DB.CheckWritable()},
+	}
+}
+
+// ConsumeClick списывает переход по ссылке с ограничением числа переходов
+func (r *Repository) ConsumeClick(ctx context.Context, key string) error {
+	return r.DB.ConsumeClick(key)
+}
+
+// GetURLRules возвращает правила перенаправления ссылки пользователя
+func (r *Repository) GetURLRules(ctx context.Context, user string, key string) ([]model.RedirectRule, error) {
+	return r.Rules(user, key)
+}
+
+// SetURLRules заменяет правила перенаправления ссылки пользователя
+func (r *Repository) SetURLRules(ctx context.Context, user string, key string, rules []model.RedirectRule) error {
+	return r.SetRules(user, key, rules)
+}
+
+// RecordVariantClick учитывает переход на вариант ссылки
+func (r *Repository) RecordVariantClick(ctx context.Context, key string, variant int) error {
+	return r.DB.RecordVariantClick(key, variant)
+}
+
+// GetURLVariantStats возвращает переходы на варианты ссылки пользователя
+func (r *Repository) GetURLVariantStats(ctx context.Context, user string, key string) ([]model.VariantStats, error) {
+	return r.VariantStats(user, key)
+}
+
+// GetURLTemplate возвращает шаблон параметров запроса ссылки пользователя
+func (r *Repository) GetURLTemplate(ctx context.Context, user string, key string) (*model.RedirectTemplate, error) {
+	return r.Template(user, key)
+}
+
+// SetURLTemplate заменяет шаблон параметров запроса ссылки пользователя
+func (r *Repository) SetURLTemplate(ctx context.Context, user string, key string, tpl *model.RedirectTemplate) error {
+	return r.SetTemplate(user, key, tpl)
+}
@@ -2,17 +2,48 @@
 package log
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Форматы вывода логов.
+const (
+	FormatConsole = "console" // FormatConsole - читаемый вывод для разработки.
+	FormatJSON    = "json"    // FormatJSON - структурированный вывод для production.
 )
 
+// Config хранит параметры логгера.
+type Config struct {
+	Level  zapcore.Level // Level - минимальный уровень записей.
+	Format string        // Format - формат вывода, по умолчанию FormatConsole.
+}
+
 // Logger описывает структуру логера
 type Logger struct {
 	*zap.SugaredLogger
 }
 
+type ctxKey struct{}
+
 // New возвращает новый логер
-func New() (*Logger, error) {
-	zapLogger, err := zap.NewDevelopment()
+func New(c Config) (*Logger, error) {
+	var zc zap.Config
+	switch c.Format {
+	case FormatConsole, "":
+		zc = zap.NewDevelopmentConfig()
+	case FormatJSON:
+		zc = zap.NewProductionConfig()
+	default:
+		return nil, fmt.Errorf("unknown log format %q", c.Format)
+	}
+	zc.Level = zap.NewAtomicLevelAt(c.Level)
+
+	zapLogger, err := zc.Build()
 	if err != nil {
 		return nil, err
 	}
@@ -23,7 +54,28 @@ func New() (*Logger, error) {
 	return &Logger{SugaredLogger: zapLogger.Sugar()}, nil
 }
 
+// With возвращает логер, добавляющий к каждой записи поля args.
+func (l *Logger) With(args ...interface{}) *Logger {
+	return &Logger{SugaredLogger: l.SugaredLogger.With(args...)}
+}
+
+// NewContext возвращает контекст с логером запроса.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext возвращает логер запроса из контекста.
+func FromContext(ctx context.Context) (*Logger, bool) {
+	l, ok := ctx.Value(ctxKey{}).(*Logger)
+	return l, ok
+}
+
 // Close закрывает логер
 func (l *Logger) Close() error {
-	return l.Sync()
+	err := l.Sync()
+	// stderr, подключенный к терминалу или каналу, не поддерживает fsync - это не ошибка записи логов.
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTTY) {
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,143 @@
+// Модуль metrics собирает метрики сервиса в формате Prometheus.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "shortener"
+
+// Результаты операций с хранилищем.
+const (
+	resultOK    = "ok"
+	resultError = "error"
+)
+
+// Metrics хранит метрики сервиса в собственном реестре,
+// поэтому в одном процессе можно создать несколько независимых экземпляров.
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	redirects       *prometheus.CounterVec
+	storageDuration *prometheus.HistogramVec
+	deleteQueue     prometheus.Gauge
+	pings           *prometheus.CounterVec
+	storageUp       prometheus.Gauge
+}
+
+// New создает и регистрирует метрики сервиса.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		redirects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "redirects_total",
+			Help:      "Number of short link openings by result.",
+		}, []string{"result"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Storage operation latency by backend, method and result.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"backend", "method", "result"}),
+		deleteQueue: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "delete_queue_depth",
+			Help:      "Number of deletion requests waiting for the worker.",
+		}),
+		pings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_pings_total",
+			Help:      "Number of storage pings by backend and result.",
+		}, []string{"backend", "result"}),
+		storageUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "storage_up",
+			Help:      "Result of the last storage ping: 1 if it succeeded, 0 otherwise.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.redirects,
+		m.storageDuration,
+		m.deleteQueue,
+		m.pings,
+		m.storageUp,
+	)
+	return m
+}
+
+// Handler возвращает обработчик, отдающий метрики.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
+		Registry: m.registry,
+		// Ответ сжимает сам сервер.
+		DisableCompression: true,
+	})
+}
+
+// ObserveRequest учитывает обработанный HTTP запрос.
+func (m *Metrics) ObserveRequest(route string, method string, status int, d time.Duration) {
+	code := strconv.Itoa(status)
+	m.requests.WithLabelValues(route, method, code).Inc()
+	m.requestDuration.WithLabelValues(route, method, code).Observe(d.Seconds())
+}
+
+// ObserveRedirect учитывает переход по короткой ссылке.
+func (m *Metrics) ObserveRedirect(result string) {
+	m.redirects.WithLabelValues(result).Inc()
+}
+
+// ObserveStorage учитывает операцию с хранилищем.
+func (m *Metrics) ObserveStorage(backend string, method string, err error, d time.Duration) {
+	m.storageDuration.WithLabelValues(backend, method, result(err)).Observe(d.Seconds())
+}
+
+// ObservePing учитывает проверку соединения с хранилищем.
+func (m *Metrics) ObservePing(backend string, err error) {
+	m.pings.WithLabelValues(backend, result(err)).Inc()
+	if err != nil {
+		m.storageUp.Set(0)
+		return
+	}
+	m.storageUp.Set(1)
+}
+
+// DeleteQueued учитывает запрос на удаление, поставленный в очередь.
+func (m *Metrics) DeleteQueued() {
+	m.deleteQueue.Inc()
+}
+
+// DeleteDequeued учитывает запрос на удаление, взятый из очереди.
+func (m *Metrics) DeleteDequeued() {
+	m.deleteQueue.Dec()
+}
+
+func result(err error) string {
+	if err != nil {
+		return resultError
+	}
+	return resultOK
+}
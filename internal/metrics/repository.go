@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
+// Repository оборачивает model.URLRepository и замеряет время каждой операции.
+type Repository struct {
+	repo    model.URLRepository
+	backend string
+	m       *Metrics
+}
+
+// NewRepository возвращает хранилище, которое учитывает операции repo в метриках m.
+// backend - имя хранилища в метках: memory, file или psql.
+func NewRepository(repo model.URLRepository, backend string, m *Metrics) *Repository {
+	return &Repository{
+		repo:    repo,
+		backend: backend,
+		m:       m,
+	}
+}
+
+func (r *Repository) observe(method string, start time.Time, err error) {
+	// Отсутствие ссылки - штатный ответ хранилища, а не сбой.
+	if errors.Is(err, model.ErrNotFound) || errors.Is(err, model.ErrIsDeleted) || errors.Is(err, model.ErrClicksExhausted) {
+		err = nil
+	}
+	r.m.ObserveStorage(r.backend, method, err, time.Since(start))
+}
+
+// GetURL возвращает ссылку по ключу
+func (r *Repository) GetURL(ctx context.Context, key string) (*model.URL, error) {
+	start := time.Now()
+	url, err := r.repo.GetURL(ctx, key)
+	r.observe("GetURL", start, err)
+	return url, err
+}
+
+// SaveURL созраняет ссылку в бд
+func (r *Repository) SaveURL(ctx context.Context, urls []model.URL) error {
+	start := time.Now()
+	err := r.repo.SaveURL(ctx, urls)
+	r.observe("SaveURL", start, err)
+	return err
+}
+
+// PingDB проверяет соединение с бд
+func (r *Repository) PingDB(ctx context.Context) error {
+	start := time.Now()
+	err := r.repo.PingDB(ctx)
+	r.m.ObserveStorage(r.backend, "PingDB", err, time.Since(start))
+	r.m.ObservePing(r.backend, err)
+	return err
+}
+
+// GetUsersURL возвращает все ссылки пользователя
+func (r *Repository) GetUsersURL(ctx context.Context, user string) ([]model.KeyAndOURL, error) {
+	start := time.Now()
+	urls, err := r.repo.GetUsersURL(ctx, user)
+	r.observe("GetUsersURL", start, err)
+	return urls, err
+}
+
+// ExportURLs возвращает все ссылки пользователя с настройками
+func (r *Repository) ExportURLs(ctx context.Context, user string) ([]model.URL, error) {
+	start := time.Now()
+	urls, err := r.repo.ExportURLs(ctx, user)
+	r.observe("ExportURLs", start, err)
+	return urls, err
+}
+
+// GetUsersURLPage возвращает страницу ссылок пользователя
+func (r *Repository) GetUsersURLPage(ctx context.Context, user string, filter model.UserURLsFilter) (*model.UserURLsPage, error) {
+	start := time.Now()
+	page, err := r.repo.GetUsersURLPage(ctx, user, filter)
+	r.observe("GetUsersURLPage", start, err)
+	return page, err
+}
+
+// DeleteURL помечает ссылки пользователя удаленными
+func (r *Repository) DeleteURL(ctx context.Context, user string, keys []string) {
+	start := time.Now()
+	r.repo.DeleteURL(ctx, user, keys)
+	r.observe("DeleteURL", start, nil)
+}
+
+// UpdateURL меняет исходный адрес ссылки пользователя
+func (r *Repository) UpdateURL(ctx context.Context, user string, key string, ourl string) (*model.URLRevision, error) {
+	start := time.Now()
+	rev, err := r.repo.UpdateURL(ctx, user, key, ourl)
+	r.observe("UpdateURL", start, err)
+	return rev, err
+}
+
+// GetURLRevisions возвращает историю изменений ссылки пользователя
+func (r *Repository) GetURLRevisions(ctx context.Context, user string, key string) ([]model.URLRevision, error) {
+	start := time.Now()
+	revisions, err := r.repo.GetURLRevisions(ctx, user, key)
+	r.observe("GetURLRevisions", start, err)
+	return revisions, err
+}
+
+// CheckURLOwner проверяет, что ссылка принадлежит пользователю
+func (r *Repository) CheckURLOwner(ctx context.Context, user string, key string) error {
+	start := time.Now()
+	err := r.repo.CheckURLOwner(ctx, user, key)
+	r.observe("CheckURLOwner", start, err)
+	return err
+}
+
+// RestoreURL восстанавливает удаленные ссылки пользователя
+func (r *Repository) RestoreURL(ctx context.Context, user string, keys []string, since time.Time) ([]string, error) {
+	start := time.Now()
+	restored, err := r.repo.RestoreURL(ctx, user, keys, since)
+	r.observe("RestoreURL", start, err)
+	return restored, err
+}
+
+// PurgeDeleted окончательно удаляет ссылки, удаленные раньше before
+func (r *Repository) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	start := time.Now()
+	n, err := r.repo.PurgeDeleted(ctx, before)
+	r.observe("PurgeDeleted", start, err)
+	return n, err
+}
+
+// CheckHealth проверяет готовность хранилища
+func (r *Repository) CheckHealth(ctx context.Context) []model.HealthCheck {
+	start := time.Now()
+	checks := r.repo.CheckHealth(ctx)
+	r.observe("CheckHealth", start, nil)
+	return checks
+}
+
+// ConsumeClick списывает переход по ссылке с ограничением числа переходов
+func (r *Repository) ConsumeClick(ctx context.Context, key string) error {
+	start := time.Now()
+	err := r.repo.ConsumeClick(ctx, key)
+	r.observe("ConsumeClick", start, err)
+	return err
+}
+
+// GetURLRules возвращает правила перенаправления ссылки пользователя
+func (r *Repository) GetURLRules(ctx context.Context, user string, key string) ([]model.RedirectRule, error) {
+	start := time.Now()
+	rules, err := r.repo.GetURLRules(ctx, user, key)
+	r.observe("GetURLRules", start, err)
+	return rules, err
+}
+
+// SetURLRules заменяет правила перенаправления ссылки пользователя
+func (r *Repository) SetURLRules(ctx context.Context, user string, key string, rules []model.RedirectRule) error {
+	start := time.Now()
+	err := r.repo.SetURLRules(ctx, user, key, rules)
+	r.observe("SetURLRules", start, err)
+	return err
+}
+
+// RecordVariantClick учитывает переход на вариант ссылки
+func (r *Repository) RecordVariantClick(ctx context.Context, key string, variant int) error {
+	start := time.Now()
+	err := r.repo.RecordVariantClick(ctx, key, variant)
+	r.observe("RecordVariantClick", start, err)
+	return err
+}
+
+// GetURLVariantStats возвращает переходы на варианты ссылки пользователя
+func (r *Repository) GetURLVariantStats(ctx context.Context, user string, key string) ([]model.VariantStats, error) {
+	start := time.Now()
+	stats, err := r.repo.GetURLVariantStats(ctx, user, key)
+	r.observe("GetURLVariantStats", start, err)
+	return stats, err
+}
+
+// GetURLTemplate возвращает шаблон параметров запроса ссылки пользователя
+func (r *Repository) GetURLTemplate(ctx context.Context, user string, key string) (*model.RedirectTemplate, error) {
+	start := time.Now()
+	tpl, err := r.repo.GetURLTemplate(ctx, user, key)
+	r.observe("GetURLTemplate", start, err)
+	return tpl, err
+}
+
+// SetURLTemplate заменяет шаблон параметров запроса ссылки пользователя
+func (r *Repository) SetURLTemplate(ctx context.Context, user string, key string, tpl *model.RedirectTemplate) error {
+	start := time.Now()
+	err := r.repo.SetURLTemplate(ctx, user, key, tpl)
+	r.observe("SetURLTemplate", start, err)
+	return err
+}
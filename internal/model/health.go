@@ -0,0 +1,14 @@
+package model
+
+// Имена проверок готовности хранилища.
+const (
+	CheckStorage      = "storage"       // CheckStorage - хранилище отвечает, для файла - открыт файл по пути хранилища.
+	CheckFileWritable = "file_writable" // CheckFileWritable - в файл и каталог хранилища можно писать.
+	CheckMigrations   = "migrations"    // CheckMigrations - версия схемы БД совпадает с версией сервиса.
+)
+
+// HealthCheck - результат одной проверки готовности компонента.
+type HealthCheck struct {
+	Name string
+	Err  error
+}
@@ -0,0 +1,132 @@
+package model
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor - ошибка "некорректный курсор".
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor - позиция в выборке ссылок пользователя.
+type Cursor struct {
+	CreatedAt time.Time
+	Key       string
+}
+
+// UserURLsFilter - параметры выборки ссылок пользователя.
+type UserURLsFilter struct {
+	Limit  int     // Limit - максимальное количество ссылок на странице.
+	After  *Cursor // After - ссылки строго после курсора.
+	Desc   bool    // Desc - сортировка по убыванию времени создания.
+	Query  string  // Query - подстрока исходной ссылки.
+	Domain string  // Domain - домен исходной ссылки (включая поддомены).
+}
+
+// UserURLsPage - страница ссылок пользователя.
+type UserURLsPage struct {
+	URLs  []KeyAndOURL
+	Total int
+	Next  *Cursor
+}
+
+// EncodeCursor кодирует курсор в строку для ответа клиенту.
+func EncodeCursor(c *Cursor) string {
+	if c == nil {
+		return ""
+	}
+	raw := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + c.Key
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor разбирает курсор, полученный от клиента.
+func DecodeCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	ts, key, ok := strings.Cut(string(raw), ":")
+	if !ok || key == "" {
+		return nil, ErrInvalidCursor
+	}
+	nsec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{CreatedAt: time.Unix(0, nsec).UTC(), Key: key}, nil
+}
+
+// URLHost возвращает домен ссылки в нижнем регистре.
+func URLHost(ourl string) string {
+	u, err := url.Parse(ourl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// MatchDomain проверяет, что домен ссылки совпадает с domain или является его поддоменом.
+func MatchDomain(ourl string, domain string) bool {
+	host := URLHost(ourl)
+	domain = strings.ToLower(domain)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// PageURLs фильтрует, сортирует и разбивает на страницы ссылки, хранящиеся в памяти.
+func PageURLs(urls []KeyAndOURL, f UserURLsFilter) *UserURLsPage {
+	filtered := make([]KeyAndOURL, 0, len(urls))
+	query := strings.ToLower(f.Query)
+	for _, u := range urls {
+		if query != "" && !strings.Contains(strings.ToLower(u.OriginalURL), query) {
+			continue
+		}
+		if f.Domain != "" && !MatchDomain(u.OriginalURL, f.Domain) {
+			continue
+		}
+		filtered = append(filtered, u)
+	}
+
+	slices.SortFunc(filtered, func(a, b KeyAndOURL) int {
+		c := compareCursor(a.CreatedAt, a.Key, b.CreatedAt, b.Key)
+		if f.Desc {
+			return -c
+		}
+		return c
+	})
+
+	page := &UserURLsPage{Total: len(filtered)}
+
+	start := 0
+	if f.After != nil {
+		start = len(filtered)
+		for i, u := range filtered {
+			c := compareCursor(u.CreatedAt, u.Key, f.After.CreatedAt, f.After.Key)
+			if (!f.Desc && c > 0) || (f.Desc && c < 0) {
+				start = i
+				break
+			}
+		}
+	}
+
+	end := len(filtered)
+	if f.Limit > 0 && start+f.Limit < end {
+		end = start + f.Limit
+		last := filtered[end-1]
+		page.Next = &Cursor{CreatedAt: last.CreatedAt, Key: last.Key}
+	}
+	page.URLs = filtered[start:end]
+
+	return page
+}
+
+func compareCursor(at time.Time, akey string, bt time.Time, bkey string) int {
+	if c := at.Compare(bt); c != 0 {
+		return c
+	}
+	return strings.Compare(akey, bkey)
+}
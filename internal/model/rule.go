@@ -0,0 +1,20 @@
+package model
+
+// RedirectRule - правило перенаправления по короткой ссылке.
+// Все заданные условия правила должны выполниться одновременно, незаданное условие
+// выполняется всегда. Правила ссылки проверяются по порядку, переход идет на Target
+// первого подошедшего правила, если не подошло ни одно - на исходную ссылку.
+type RedirectRule struct {
+	// Device - класс устройства по User-Agent: mobile, tablet, desktop или bot.
+	Device string `json:"device,omitempty"`
+	// Language - языковой тег из Accept-Language. Тег "en" подходит и для "en-US".
+	Language string `json:"language,omitempty"`
+	// From и To - окно времени суток по UTC в формате "15:04". From входит в окно, To - нет.
+	// Если From больше To, окно переходит через полночь.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Query - параметры запроса и их значения. Значение "*" означает любое значение параметра.
+	Query map[string]string `json:"query,omitempty"`
+	// Target - ссылка для перехода по правилу.
+	Target string `json:"target"`
+}
@@ -0,0 +1,16 @@
+package model
+
+// RedirectTemplate - шаблон параметров запроса, которые добавляются к ссылке при переходе.
+// Шаблон применяется к любой выбранной ссылке: исходной, цели правила или варианту.
+type RedirectTemplate struct {
+	// Params - параметры, которые добавляются к ссылке, например utm_source.
+	// В значениях подставляются {key}, {device} и {lang}.
+	Params map[string]string `json:"params,omitempty"`
+	// PassQuery - параметры запроса посетителя, которые передаются в ссылку. "*" - все параметры.
+	PassQuery []string `json:"pass_query,omitempty"`
+}
+
+// Empty сообщает, что шаблон ничего не меняет.
+func (t *RedirectTemplate) Empty() bool {
+	return t == nil || len(t.Params) == 0 && len(t.PassQuery) == 0
+}
@@ -5,20 +5,53 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"time"
 )
 
 // ErrIsDeleted - ошибка "URL удален".
 var ErrIsDeleted = errors.New("url is deleted")
 
+// ErrNotFound - ошибка "URL не найден у пользователя".
+var ErrNotFound = errors.New("url not found")
+
+// ErrConflict - ошибка "URL уже сокращен".
+var ErrConflict = errors.New("url already exists")
+
+// ErrClicksExhausted - ошибка "переходы по ссылке закончились".
+var ErrClicksExhausted = errors.New("url clicks are exhausted")
+
 // URLRepository интерфейс для хранения данных.
 type URLRepository interface {
-	GetURL(key string) (*URL, error)
-	SaveURL(urls []URL) error
+	GetURL(ctx context.Context, key string) (*URL, error)
+	SaveURL(ctx context.Context, urls []URL) error
 	PingDB(ctx context.Context) error
-	GetUsersURL(user string) ([]KeyAndOURL, error)
-	DeleteURL(user string, keys []string)
+	GetUsersURL(ctx context.Context, user string) ([]KeyAndOURL, error)
+	GetUsersURLPage(ctx context.Context, user string, filter UserURLsFilter) (*UserURLsPage, error)
+	// ExportURLs возвращает все ссылки пользователя, в том числе удаленные, с их настройками
+	// в порядке создания.
+	ExportURLs(ctx context.Context, user string) ([]URL, error)
+	DeleteURL(ctx context.Context, user string, keys []string)
+	UpdateURL(ctx context.Context, user string, key string, ourl string) (*URLRevision, error)
+	GetURLRevisions(ctx context.Context, user string, key string) ([]URLRevision, error)
+	// CheckURLOwner возвращает ErrNotFound, если ссылки key нет у пользователя.
+	// Удаленные ссылки пользователя проверку проходят.
+	CheckURLOwner(ctx context.Context, user string, key string) error
+	RestoreURL(ctx context.Context, user string, keys []string, since time.Time) ([]string, error)
+	PurgeDeleted(ctx context.Context, before time.Time) (int, error)
+	CheckHealth(ctx context.Context) []HealthCheck
+	// ConsumeClick атомарно списывает переход по ссылке с ограничением числа переходов.
+	// Возвращает ErrClicksExhausted, если переходы закончились.
+	ConsumeClick(ctx context.Context, key string) error
+	GetURLRules(ctx context.Context, user string, key string) ([]RedirectRule, error)
+	SetURLRules(ctx context.Context, user string, key string, rules []RedirectRule) error
+	// RecordVariantClick учитывает переход на вариант ссылки с разделением трафика.
+	RecordVariantClick(ctx context.Context, key string, variant int) error
+	GetURLVariantStats(ctx context.Context, user string, key string) ([]VariantStats, error)
+	GetURLTemplate(ctx context.Context, user string, key string) (*RedirectTemplate, error)
+	SetURLTemplate(ctx context.Context, user string, key string, tpl *RedirectTemplate) error
 }
 
 // URL - описание входящих ссылок.
@@ -28,12 +61,49 @@ type URL struct {
 	CorrelationID string `json:"correlation_id"`
 	Conflict      bool
 	UserID        string
+	// CreatedAt - время создания ссылки, заполняется хранилищем при сохранении.
+	// Для уже существующей ссылки - время ее первого сохранения.
+	CreatedAt time.Time `json:"-"`
+	// Err - ошибка сохранения этой ссылки. Остальные ссылки пачки при этом сохраняются.
+	Err error `json:"-"`
+	// PasswordHash - bcrypt хеш пароля ссылки, пустой для ссылок без пароля.
+	// Задается только при создании ссылки.
+	PasswordHash string `json:"-"`
+	// MaxClicks - сколько раз можно перейти по ссылке, 0 - без ограничения.
+	// Задается только при создании ссылки.
+	MaxClicks int `json:"-"`
+	// Rules - правила перенаправления ссылки, заполняются хранилищем при чтении ссылки.
+	Rules []RedirectRule `json:"-"`
+	// Variants - варианты перехода для разделения трафика, пустые для обычной ссылки.
+	// Задаются только при создании ссылки.
+	Variants []URLVariant `json:"-"`
+	// RedirectStatus - код перенаправления ссылки, 0 - код из настроек сервера.
+	// Задается только при создании ссылки.
+	RedirectStatus int `json:"-"`
+	// Interstitial - показывать страницу предпросмотра перед переходом на домены
+	// вне списка разрешенных. Задается только при создании ссылки.
+	Interstitial bool `json:"-"`
+	// Template - шаблон параметров запроса, заполняется хранилищем при чтении ссылки.
+	Template *RedirectTemplate `json:"-"`
+	// IsDeleted и DeletedAt - признак и время удаления ссылки.
+	// Заполняются хранилищем при выгрузке ссылок пользователя.
+	IsDeleted bool      `json:"-"`
+	DeletedAt time.Time `json:"-"`
 }
 
 // KeyAndOURL - описание хранения ссылок на сервере.
 type KeyAndOURL struct {
-	Key         string `json:"short_url"`
-	OriginalURL string `json:"original_url"`
+	Key         string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+	CreatedAt   time.Time `json:"-"`
+}
+
+// URLRevision - редакция исходной ссылки.
+// Первая редакция соответствует созданию короткой ссылки.
+type URLRevision struct {
+	Revision    int       `json:"revision"`
+	OriginalURL string    `json:"original_url"`
+	CreatedAt   time.Time `json:"created_at"`
 }
 
 // ShortKey сокращает ссылку и возвращает ключ.
@@ -46,3 +116,29 @@ func ShortKey(ourl string) string {
 	// hash := md5.Sum([]byte(ourl))
 	return hex.EncodeToString(hash[:])
 }
+
+// Shared сообщает, что у ссылки нет собственных настроек: пароля, ограничения переходов,
+// вариантов, кода перенаправления и страницы предпросмотра. Такие ссылки на один адрес
+// взаимозаменяемы, поэтому адрес сокращается один раз. Ссылка с настройками
+// всегда получает собственный ключ.
+func (u *URL) Shared() bool {
+	return u.PasswordHash == "" && u.MaxClicks == 0 && len(u.Variants) == 0 &&
+		u.RedirectStatus == 0 && !u.Interstitial
+}
+
+// NewKey возвращает ключ новой ссылки: ShortKey для ссылки без настроек и RandomKey для остальных.
+func NewKey(u *URL) string {
+	if u.Shared() {
+		return ShortKey(u.OriginalURL)
+	}
+	return RandomKey()
+}
+
+// RandomKey возвращает случайный ключ той же длины, что и ShortKey.
+// Используется, когда ключ исходной ссылки уже занят другой ссылкой,
+// например ссылкой, исходный адрес которой изменили.
+func RandomKey() string {
+	var b [md5.Size]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,14 @@
+package model
+
+// URLVariant - вариант перехода по ссылке с разделением трафика.
+// Вариант выбирается случайно с вероятностью, пропорциональной весу.
+type URLVariant struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// VariantStats - количество переходов на вариант ссылки.
+type VariantStats struct {
+	URLVariant
+	Clicks int64 `json:"clicks"`
+}
@@ -0,0 +1,122 @@
+// Модуль normalizer проверяет и приводит к каноничному виду ссылки перед сокращением.
+package normalizer
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Ошибки проверки ссылки.
+var (
+	ErrEmptyURL         = errors.New("URL parameter is missing")
+	ErrInvalidURL       = errors.New("invalid URL")
+	ErrSchemeNotAllowed = errors.New("URL scheme is not allowed")
+	ErrMissingHost      = errors.New("URL host is missing")
+)
+
+// defaultPorts - порты, которые не указываются в каноничной ссылке.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Config хранит параметры нормализации.
+type Config struct {
+	AllowedSchemes  []string // AllowedSchemes - разрешенные схемы ссылок.
+	SortQueryParams bool     // SortQueryParams - сортировать параметры запроса по имени.
+}
+
+// Normalizer проверяет и нормализует ссылки.
+type Normalizer struct {
+	schemes   []string
+	sortQuery bool
+}
+
+// New возвращает новый Normalizer.
+func New(c Config) *Normalizer {
+	schemes := make([]string, 0, len(c.AllowedSchemes))
+	for _, scheme := range c.AllowedSchemes {
+		scheme = strings.ToLower(strings.TrimSpace(scheme))
+		if scheme != "" {
+			schemes = append(schemes, scheme)
+		}
+	}
+	return &Normalizer{
+		schemes:   schemes,
+		sortQuery: c.SortQueryParams,
+	}
+}
+
+// Normalize проверяет ссылку и возвращает ее каноничный вид:
+// схема и домен в нижнем регистре, IDN в punycode, без порта по умолчанию и без пустого пути "/".
+func (n *Normalizer) Normalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", ErrEmptyURL
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return "", ErrInvalidURL
+	}
+	if !slices.Contains(n.schemes, u.Scheme) {
+		return "", ErrSchemeNotAllowed
+	}
+	if u.Opaque != "" || u.Hostname() == "" {
+		return "", ErrMissingHost
+	}
+
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u.Host = host
+
+	if u.Path == "/" {
+		u.Path = ""
+		u.RawPath = ""
+	}
+	if n.sortQuery && u.RawQuery != "" {
+		u.RawQuery = sortQuery(u.RawQuery)
+	}
+
+	return u.String(), nil
+}
+
+// normalizeHost приводит домен к нижнему регистру и переводит IDN в punycode.
+func normalizeHost(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(host, "."))
+	if err != nil {
+		return "", ErrInvalidURL
+	}
+	return strings.ToLower(ascii), nil
+}
+
+// sortQuery сортирует параметры запроса по имени, сохраняя их исходное кодирование
+// и порядок одноименных параметров.
+func sortQuery(rawQuery string) string {
+	params := strings.Split(rawQuery, "&")
+	slices.SortStableFunc(params, func(a, b string) int {
+		ka, _, _ := strings.Cut(a, "=")
+		kb, _, _ := strings.Cut(b, "=")
+		return strings.Compare(ka, kb)
+	})
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,92 @@
+package normalizer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	type testData struct {
+		name      string
+		sortQuery bool
+		raw       string
+		want      string
+		wantErr   error
+	}
+
+	testTable := []testData{
+		{
+			name: "Ссылка без изменений",
+			raw:  "https://www.youtube.com/watch?v=etAIpkdhU9Q&list=RD09839DpTctU&index=30",
+			want: "https://www.youtube.com/watch?v=etAIpkdhU9Q&list=RD09839DpTctU&index=30",
+		},
+		{
+			name: "Домен и схема в нижнем регистре, без пустого пути",
+			raw:  "HTTP://Example.COM/",
+			want: "http://example.com",
+		},
+		{
+			name: "Порт по умолчанию удаляется",
+			raw:  "https://example.com:443/a",
+			want: "https://example.com/a",
+		},
+		{
+			name: "Нестандартный порт сохраняется",
+			raw:  "http://example.com:8080/a",
+			want: "http://example.com:8080/a",
+		},
+		{
+			name: "IDN переводится в punycode",
+			raw:  "https://пример.рф/путь",
+			want: "https://xn--e1afmkfd.xn--p1ai/%D0%BF%D1%83%D1%82%D1%8C",
+		},
+		{
+			name: "IPv6 адрес",
+			raw:  "http://[::1]:80/",
+			want: "http://[::1]",
+		},
+		{
+			name:      "Параметры запроса сортируются",
+			sortQuery: true,
+			raw:       "https://example.com/?b=2&a=1&b=1",
+			want:      "https://example.com?a=1&b=2&b=1",
+		},
+		{
+			name:    "Пустая ссылка",
+			raw:     "  ",
+			wantErr: ErrEmptyURL,
+		},
+		{
+			name:    "Не ссылка",
+			raw:     "hello",
+			wantErr: ErrInvalidURL,
+		},
+		{
+			name:    "Запрещенная схема",
+			raw:     "javascript:alert(1)",
+			wantErr: ErrSchemeNotAllowed,
+		},
+		{
+			name:    "Ссылка без домена",
+			raw:     "http:///path",
+			wantErr: ErrMissingHost,
+		},
+	}
+
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			n := New(Config{
+				AllowedSchemes:  []string{"http", "https"},
+				SortQueryParams: testData.sortQuery,
+			})
+			got, err := n.Normalize(testData.raw)
+			if testData.wantErr != nil {
+				assert.ErrorIs(t, err, testData.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testData.want, got)
+		})
+	}
+}
@@ -2,45 +2,75 @@
 package app
 
 import (
+	"context"
+	"errors"
+
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/adapter/file"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/adapter/memory"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/adapter/psql"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/log"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/metrics"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/pkg/config"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/policy"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/server"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/storage"
 	sfile "github.com/winkor4/taktaev-yandex-dev-uri.git/internal/storage/file"
 	smemory "github.com/winkor4/taktaev-yandex-dev-uri.git/internal/storage/memory"
 	spsql "github.com/winkor4/taktaev-yandex-dev-uri.git/internal/storage/psql"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/tracing"
+	"go.opentelemetry.io/otel"
 )
 
 // Run читает конфигурацию сервера и запускает его.
-func Run() error {
+// Ошибки закрытия хранилища, логгера и трассировки добавляются к ошибке работы сервера.
+func Run() (err error) {
 	cfg, err := config.Parse()
 	if err != nil {
 		return err
 	}
 
-	repo, close, err := newRepo(cfg)
+	repo, backend, close, err := newRepo(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, close())
+	}()
+
+	logger, err := log.New(log.Config{Level: cfg.LogLevel, Format: cfg.LogFormat})
 	if err != nil {
 		return err
 	}
 	defer func() {
-		err = close()
+		err = errors.Join(err, logger.Close())
 	}()
 
-	logger, err := log.New()
+	pol, err := policy.New(cfg.PolicyFile)
+	if err != nil {
+		return err
+	}
+
+	shutdownTracing, err := tracing.Setup(tracing.Config{
+		Exporter:    cfg.TraceExporter,
+		File:        cfg.TraceFile,
+		Endpoint:    cfg.TraceEndpoint,
+		ServiceName: "shortener",
+	})
 	if err != nil {
 		return err
 	}
 	defer func() {
-		err = logger.Close()
+		err = errors.Join(err, shutdownTracing(context.Background()))
 	}()
 
+	m := metrics.New()
+	traced := tracing.NewRepository(repo, backend, otel.GetTracerProvider())
 	srv := server.New(server.Config{
-		URLRepo: repo,
+		URLRepo: metrics.NewRepository(traced, backend, m),
 		Cfg:     cfg,
 		Logger:  logger,
+		Policy:  pol,
+		Metrics: m,
 	})
 
 	return srv.Run()
@@ -48,32 +78,37 @@ func Run() error {
 
 type dbCloser func() error
 
-func newRepo(cfg *config.Config) (storage.Repository, dbCloser, error) {
+// newRepo создает хранилище по конфигурации и возвращает его имя для метрик.
+func newRepo(cfg *config.Config) (storage.Repository, string, dbCloser, error) {
 	var (
-		repo  storage.Repository
-		close dbCloser
+		repo    storage.Repository
+		backend string
+		close   dbCloser
 	)
 
 	switch {
 	case cfg.DSN != "":
 		db, err := spsql.New(cfg.DSN)
 		if err != nil {
-			return nil, nil, err
+			return nil, "", nil, err
 		}
 		close = db.CloseDB
 		repo = psql.NewRepository(db)
+		backend = "psql"
 	case cfg.FileStoragePath != "":
 		db, err := sfile.New(cfg.FileStoragePath)
 		if err != nil {
-			return nil, nil, err
+			return nil, "", nil, err
 		}
 		close = db.CloseFile
 		repo = file.NewRepository(db)
+		backend = "file"
 	default:
 		db := smemory.New()
 		close = db.Close
 		repo = memory.NewRepository(db)
+		backend = "memory"
 	}
 
-	return repo, close, nil
+	return repo, backend, close, nil
 }
@@ -2,35 +2,141 @@
 package config
 
 import (
+	"encoding"
 	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v6"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/ratelimit"
 	"go.uber.org/zap/zapcore"
 )
 
 // Config параметры конфигурации
 type Config struct {
-	SrvAdr          string `env:"SERVER_ADDRESS"`
-	ResSrvAdr       string `env:"BASE_URL"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	DSN             string `env:"DATABASE_DSN"`
-	LogLevel        zapcore.Level
+	SrvAdr          string          `env:"SERVER_ADDRESS"`
+	ResSrvAdr       string          `env:"BASE_URL"`
+	AdminAdr        string          `env:"ADMIN_ADDRESS"`  // AdminAdr - адрес служебного сервера. Пустой ADMIN_ADDRESS или -admin-a выключает его.
+	AdminToken      string          `env:"ADMIN_TOKEN"`    // AdminToken - токен доступа к служебному серверу.
+	TrustedSubnet   string          `env:"TRUSTED_SUBNET"` // TrustedSubnet - подсеть в формате CIDR, из которой служебный сервер доступен без токена.
+	FileStoragePath string          `env:"FILE_STORAGE_PATH"`
+	DSN             string          `env:"DATABASE_DSN"`
+	DeleteRetention time.Duration   `env:"DELETE_RETENTION"`                 // DeleteRetention - срок, в течение которого удаленную ссылку можно восстановить.
+	PurgeInterval   time.Duration   `env:"PURGE_INTERVAL"`                   // PurgeInterval - период запуска очистки удаленных ссылок.
+	AllowedSchemes  []string        `env:"ALLOWED_SCHEMES" envSeparator:","` // AllowedSchemes - схемы ссылок, которые можно сокращать.
+	TrustedProxies  []string        `env:"TRUSTED_PROXIES" envSeparator:","` // TrustedProxies - подсети прокси в формате CIDR, для запросов от которых лимиты учитываются по X-Forwarded-For.
+	SortQueryParams bool            `env:"SORT_QUERY_PARAMS"`                // SortQueryParams - сортировать параметры запроса при нормализации.
+	PolicyFile      string          `env:"POLICY_FILE"`                      // PolicyFile - файл со списками запрещенных и разрешенных доменов.
+	PolicyReload    time.Duration   `env:"POLICY_RELOAD_INTERVAL"`           // PolicyReload - период проверки изменений файла политики.
+	RateShorten     ratelimit.Limit `env:"RATE_LIMIT_SHORTEN"`               // RateShorten - лимит запросов на сокращение одной ссылки.
+	RateBatch       ratelimit.Limit `env:"RATE_LIMIT_BATCH"`                 // RateBatch - лимит запросов на пакетное сокращение.
+	RateRedirect    ratelimit.Limit `env:"RATE_LIMIT_REDIRECT"`              // RateRedirect - лимит переходов по коротким ссылкам.
+	RateUser        ratelimit.Limit `env:"RATE_LIMIT_USER"`                  // RateUser - лимит запросов к API пользователя.
+	RatePassword    ratelimit.Limit `env:"RATE_LIMIT_PASSWORD"`              // RatePassword - лимит попыток ввода пароля одной ссылки.
+	BatchMaxBytes   int64           `env:"BATCH_MAX_BYTES"`                  // BatchMaxBytes - максимальный размер тела запроса на пакетное сокращение.
+	BatchMaxItems   int             `env:"BATCH_MAX_ITEMS"`                  // BatchMaxItems - максимальное количество ссылок в пачке.
+	RedirectStatus  int             `env:"REDIRECT_STATUS"`                  // RedirectStatus - код перенаправления для ссылок без своего кода: 301, 302, 307 или 308.
+	Interstitial    bool            `env:"INTERSTITIAL"`                     // Interstitial - показывать страницу предпросмотра для всех ссылок на домены вне PreviewAllow.
+	PreviewAllow    []string        `env:"PREVIEW_ALLOW" envSeparator:","`   // PreviewAllow - домены, на которые переход открывается без страницы предпросмотра.
+	LinkSecret      string          `env:"LINK_SECRET"`                      // LinkSecret - ключ подписи токенов ссылок, пустой - случайный при запуске.
+	LogFormat       string          `env:"LOG_FORMAT"`                       // LogFormat - формат логов: console или json.
+	TraceExporter   string          `env:"TRACE_EXPORTER"`                   // TraceExporter - экспорт спанов: none, stdout, file или otlp.
+	TraceFile       string          `env:"TRACE_FILE"`                       // TraceFile - файл для экспорта спанов.
+	TraceEndpoint   string          `env:"TRACE_ENDPOINT"`                   // TraceEndpoint - адрес OTLP коллектора.
+	LogLevel        zapcore.Level   `env:"LOG_LEVEL"`                        // LogLevel - уровень логов: debug, info, warn, error.
 }
 
 var (
 	flagSrvAdr          string
 	flagResSrvAdr       string
+	flagAdminAdr        string
+	flagAdminToken      string
+	flagTrustedSubnet   string
+	flagTrustedProxies  string
 	flagFileStoragePath string
 	flagDSN             string
 	flagLogLevel        string
+	flagLogFormat       string
+	flagTraceExporter   string
+	flagTraceFile       string
+	flagTraceEndpoint   string
+	flagDeleteRetention time.Duration
+	flagPurgeInterval   time.Duration
+	flagAllowedSchemes  string
+	flagSortQueryParams bool
+	flagPolicyFile      string
+	flagPolicyReload    time.Duration
+	flagRateShorten     = ratelimit.Limit{Rate: 10, Burst: 600}
+	flagRateBatch       = ratelimit.Limit{Rate: 1, Burst: 60}
+	flagRateRedirect    = ratelimit.Limit{Rate: 100, Burst: 6000}
+	flagRateUser        = ratelimit.Limit{Rate: 10, Burst: 600}
+	flagRatePassword    = ratelimit.Limit{Rate: 5.0 / 60, Burst: 5}
+	flagBatchMaxBytes   int64
+	flagBatchMaxItems   int
+	flagRedirectStatus  int
+	flagInterstitial    bool
+	flagPreviewAllow    string
+	flagLinkSecret      string
 )
 
+// ValidRedirectStatus сообщает, что код можно использовать для перенаправления по короткой ссылке.
+func ValidRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
 func stringVar(p *string, name string, value string, usage string) {
 	if flag.Lookup(name) == nil {
 		flag.StringVar(p, name, value, usage)
 	}
 }
 
+func durationVar(p *time.Duration, name string, value time.Duration, usage string) {
+	if flag.Lookup(name) == nil {
+		flag.DurationVar(p, name, value, usage)
+	}
+}
+
+func intVar(p *int, name string, value int, usage string) {
+	if flag.Lookup(name) == nil {
+		flag.IntVar(p, name, value, usage)
+	}
+}
+
+func int64Var(p *int64, name string, value int64, usage string) {
+	if flag.Lookup(name) == nil {
+		flag.Int64Var(p, name, value, usage)
+	}
+}
+
+func boolVar(p *bool, name string, value bool, usage string) {
+	if flag.Lookup(name) == nil {
+		flag.BoolVar(p, name, value, usage)
+	}
+}
+
+func textVar(p encoding.TextUnmarshaler, name string, value encoding.TextMarshaler, usage string) {
+	if flag.Lookup(name) == nil {
+		flag.TextVar(p, name, value, usage)
+	}
+}
+
+// envSet сообщает, что переменная окружения задана. Нужна для параметров,
+// у которых нулевое значение из окружения отличается от значения флага, например лимитов: 0 отключает лимит,
+// и адреса служебного сервера: пустой адрес выключает его.
+func envSet(name string) bool {
+	_, ok := os.LookupEnv(name)
+	return ok
+}
+
 // Parse парсит флаги и параметры ОС.
 func Parse() (*Config, error) {
 
@@ -41,9 +147,34 @@ func Parse() (*Config, error) {
 
 	stringVar(&flagSrvAdr, "a", "localhost:8080", "address and port to run server")
 	stringVar(&flagResSrvAdr, "b", "http://localhost:8080", "address and port to run server")
+	stringVar(&flagAdminAdr, "admin-a", "localhost:8081", "address and port of the admin server with pprof and metrics, empty to disable it")
+	stringVar(&flagAdminToken, "admin-token", "", "bearer token for the admin server")
+	stringVar(&flagTrustedSubnet, "t", "", "trusted subnet in CIDR notation for the admin server")
+	stringVar(&flagTrustedProxies, "trusted-proxies", "", "comma separated proxy subnets in CIDR notation whose X-Forwarded-For is used for rate limits")
 	stringVar(&flagFileStoragePath, "f", "", "file storage path")
 	stringVar(&flagDSN, "d", "", "PostgresSQL path")
 	stringVar(&flagLogLevel, "l", "info", "log level")
+	stringVar(&flagLogFormat, "log-format", "console", "log format: console or json")
+	stringVar(&flagTraceExporter, "trace-exporter", "none", "trace exporter: none, stdout, file or otlp")
+	stringVar(&flagTraceFile, "trace-file", "", "file for the file trace exporter")
+	stringVar(&flagTraceEndpoint, "trace-endpoint", "", "OTLP/HTTP collector url, e.g. http://localhost:4318")
+	durationVar(&flagDeleteRetention, "delete-retention", 7*24*time.Hour, "how long deleted urls can be restored")
+	durationVar(&flagPurgeInterval, "purge-interval", time.Hour, "how often deleted urls are purged")
+	stringVar(&flagAllowedSchemes, "allowed-schemes", "http,https", "comma separated url schemes allowed for shortening")
+	boolVar(&flagSortQueryParams, "sort-query", false, "sort query parameters when normalizing urls")
+	stringVar(&flagPolicyFile, "policy-file", "", "domain blocklist and allowlist file")
+	durationVar(&flagPolicyReload, "policy-reload", 5*time.Second, "how often the policy file is checked for changes")
+	textVar(&flagRateShorten, "rate-shorten", flagRateShorten, "rate limit for shortening, e.g. 600/m, 0 to disable")
+	textVar(&flagRateBatch, "rate-batch", flagRateBatch, "rate limit for batch shortening, e.g. 60/m, 0 to disable")
+	textVar(&flagRateRedirect, "rate-redirect", flagRateRedirect, "rate limit for redirects, e.g. 6000/m, 0 to disable")
+	textVar(&flagRateUser, "rate-user", flagRateUser, "rate limit for user API, e.g. 600/m, 0 to disable")
+	textVar(&flagRatePassword, "rate-password", flagRatePassword, "rate limit for failed password attempts per link, e.g. 5/m, 0 to disable")
+	int64Var(&flagBatchMaxBytes, "batch-max-bytes", 1<<20, "max body size of a batch shortening request in bytes")
+	intVar(&flagBatchMaxItems, "batch-max-items", 1000, "max number of urls in a batch shortening request")
+	intVar(&flagRedirectStatus, "redirect-status", http.StatusTemporaryRedirect, "default redirect status: 301, 302, 307 or 308")
+	boolVar(&flagInterstitial, "interstitial", false, "show a preview page before redirecting to domains outside the preview allowlist")
+	stringVar(&flagPreviewAllow, "preview-allow", "", "comma separated domains redirected to without a preview page")
+	stringVar(&flagLinkSecret, "link-secret", "", "key signing preview confirmations and password link access tokens, random at startup if empty; set the same value on every instance")
 	flag.Parse()
 
 	cfg := new(Config)
@@ -58,16 +189,109 @@ func Parse() (*Config, error) {
 	if cfg.ResSrvAdr == "" {
 		cfg.ResSrvAdr = flagResSrvAdr
 	}
+	if !envSet("ADMIN_ADDRESS") {
+		cfg.AdminAdr = flagAdminAdr
+	}
+	if cfg.AdminToken == "" {
+		cfg.AdminToken = flagAdminToken
+	}
+	if cfg.TrustedSubnet == "" {
+		cfg.TrustedSubnet = flagTrustedSubnet
+	}
+	if cfg.TrustedSubnet != "" {
+		if _, _, err := net.ParseCIDR(cfg.TrustedSubnet); err != nil {
+			return nil, fmt.Errorf("trusted subnet: %w", err)
+		}
+	}
+	if len(cfg.TrustedProxies) == 0 && flagTrustedProxies != "" {
+		cfg.TrustedProxies = strings.Split(flagTrustedProxies, ",")
+	}
+	for i, proxy := range cfg.TrustedProxies {
+		cfg.TrustedProxies[i] = strings.TrimSpace(proxy)
+		if _, _, err := net.ParseCIDR(cfg.TrustedProxies[i]); err != nil {
+			return nil, fmt.Errorf("trusted proxies: %w", err)
+		}
+	}
 	if cfg.FileStoragePath == "" {
 		cfg.FileStoragePath = flagFileStoragePath
 	}
 	if cfg.DSN == "" {
 		cfg.DSN = flagDSN
 	}
+	if cfg.DeleteRetention == 0 {
+		cfg.DeleteRetention = flagDeleteRetention
+	}
+	if cfg.PurgeInterval == 0 {
+		cfg.PurgeInterval = flagPurgeInterval
+	}
+	if len(cfg.AllowedSchemes) == 0 {
+		cfg.AllowedSchemes = strings.Split(flagAllowedSchemes, ",")
+	}
+	if !cfg.SortQueryParams {
+		cfg.SortQueryParams = flagSortQueryParams
+	}
+	if cfg.PolicyFile == "" {
+		cfg.PolicyFile = flagPolicyFile
+	}
+	if cfg.PolicyReload == 0 {
+		cfg.PolicyReload = flagPolicyReload
+	}
+	if !envSet("RATE_LIMIT_SHORTEN") {
+		cfg.RateShorten = flagRateShorten
+	}
+	if !envSet("RATE_LIMIT_BATCH") {
+		cfg.RateBatch = flagRateBatch
+	}
+	if !envSet("RATE_LIMIT_REDIRECT") {
+		cfg.RateRedirect = flagRateRedirect
+	}
+	if !envSet("RATE_LIMIT_USER") {
+		cfg.RateUser = flagRateUser
+	}
+	if !envSet("RATE_LIMIT_PASSWORD") {
+		cfg.RatePassword = flagRatePassword
+	}
+	if cfg.BatchMaxBytes == 0 {
+		cfg.BatchMaxBytes = flagBatchMaxBytes
+	}
+	if cfg.BatchMaxItems == 0 {
+		cfg.BatchMaxItems = flagBatchMaxItems
+	}
+	if cfg.RedirectStatus == 0 {
+		cfg.RedirectStatus = flagRedirectStatus
+	}
+	if !ValidRedirectStatus(cfg.RedirectStatus) {
+		return nil, fmt.Errorf("redirect status %d is not one of 301, 302, 307, 308", cfg.RedirectStatus)
+	}
+	if !cfg.Interstitial {
+		cfg.Interstitial = flagInterstitial
+	}
+	if cfg.LinkSecret == "" {
+		cfg.LinkSecret = flagLinkSecret
+	}
+	if len(cfg.PreviewAllow) == 0 && flagPreviewAllow != "" {
+		cfg.PreviewAllow = strings.Split(flagPreviewAllow, ",")
+	}
 
-	cfg.LogLevel, err = zapcore.ParseLevel(flagLogLevel)
-	if err != nil {
-		return nil, err
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = flagLogFormat
+	}
+	if cfg.TraceExporter == "" {
+		cfg.TraceExporter = flagTraceExporter
+	}
+	if cfg.TraceFile == "" {
+		cfg.TraceFile = flagTraceFile
+	}
+	if cfg.TraceEndpoint == "" {
+		cfg.TraceEndpoint = flagTraceEndpoint
+	}
+
+	// Уровень info нулевой, поэтому значение флага берется по отсутствию переменной, а не по нулевому уровню.
+	if os.Getenv("LOG_LEVEL") == "" {
+		cfg.LogLevel, err = zapcore.ParseLevel(flagLogLevel)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return cfg, nil
@@ -0,0 +1,179 @@
+// Модуль policy проверяет ссылки по спискам запрещенных и разрешенных доменов.
+//
+// Правила читаются из JSON файла:
+//
+//	{
+//		"block_domains": ["phishing.example"],
+//		"block_patterns": ["^https?://[^/]*paypal[^/]*\\.xyz/"],
+//		"allow_domains": [],
+//		"allow_patterns": []
+//	}
+//
+// Домен совпадает с правилом, если равен ему или является его поддоменом.
+// Шаблоны - регулярные выражения, которые проверяются по всей нормализованной ссылке.
+// Запрет имеет приоритет: ссылка, подходящая под запрет, отклоняется всегда.
+// Если список разрешений не пуст, отклоняются все ссылки, которые под него не подходят.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
+// RejectedError - ошибка "ссылка запрещена политикой".
+type RejectedError struct {
+	Reason string
+}
+
+// Error возвращает причину отказа.
+func (e *RejectedError) Error() string {
+	return e.Reason
+}
+
+// fileSchema описывает файл с правилами.
+type fileSchema struct {
+	BlockDomains  []string `json:"block_domains"`
+	BlockPatterns []string `json:"block_patterns"`
+	AllowDomains  []string `json:"allow_domains"`
+	AllowPatterns []string `json:"allow_patterns"`
+}
+
+type rules struct {
+	blockDomains  []string
+	blockPatterns []*regexp.Regexp
+	allowDomains  []string
+	allowPatterns []*regexp.Regexp
+}
+
+// Policy хранит текущие правила и следит за изменением файла.
+// Нулевое значение Policy разрешает все ссылки.
+type Policy struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	size    int64
+	rules   *rules
+}
+
+// New читает правила из файла. Если путь пустой, политика разрешает все ссылки.
+func New(path string) (*Policy, error) {
+	p := &Policy{path: path}
+	if path == "" {
+		return p, nil
+	}
+	if _, err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload перечитывает файл правил, если он изменился с прошлой загрузки.
+// При ошибке продолжают действовать предыдущие правила.
+func (p *Policy) Reload() (bool, error) {
+	if p.path == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return false, err
+	}
+
+	p.mu.RLock()
+	unchanged := p.rules != nil && info.ModTime().Equal(p.modTime) && info.Size() == p.size
+	p.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return false, err
+	}
+	var schema fileSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return false, fmt.Errorf("policy %s: %w", p.path, err)
+	}
+	r, err := compile(schema)
+	if err != nil {
+		return false, fmt.Errorf("policy %s: %w", p.path, err)
+	}
+
+	p.mu.Lock()
+	p.rules = r
+	p.modTime = info.ModTime()
+	p.size = info.Size()
+	p.mu.Unlock()
+
+	return true, nil
+}
+
+// Check проверяет нормализованную ссылку и возвращает *RejectedError, если она запрещена.
+func (p *Policy) Check(ourl string) error {
+	p.mu.RLock()
+	r := p.rules
+	p.mu.RUnlock()
+	if r == nil {
+		return nil
+	}
+
+	host := model.URLHost(ourl)
+	for _, domain := range r.blockDomains {
+		if model.MatchDomain(ourl, domain) {
+			return &RejectedError{Reason: fmt.Sprintf("domain %q is blocked", host)}
+		}
+	}
+	for _, re := range r.blockPatterns {
+		if re.MatchString(ourl) {
+			return &RejectedError{Reason: fmt.Sprintf("URL matches blocked pattern %q", re.String())}
+		}
+	}
+
+	if len(r.allowDomains) == 0 && len(r.allowPatterns) == 0 {
+		return nil
+	}
+	for _, domain := range r.allowDomains {
+		if model.MatchDomain(ourl, domain) {
+			return nil
+		}
+	}
+	for _, re := range r.allowPatterns {
+		if re.MatchString(ourl) {
+			return nil
+		}
+	}
+	return &RejectedError{Reason: fmt.Sprintf("domain %q is not in allowlist", host)}
+}
+
+func compile(schema fileSchema) (*rules, error) {
+	var err error
+	r := &rules{
+		blockDomains: schema.BlockDomains,
+		allowDomains: schema.AllowDomains,
+	}
+	if r.blockPatterns, err = compilePatterns(schema.BlockPatterns); err != nil {
+		return nil, err
+	}
+	if r.allowPatterns, err = compilePatterns(schema.AllowPatterns); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	out := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, re)
+	}
+	return out, nil
+}
@@ -0,0 +1,179 @@
+// Модуль qr рисует QR-код ссылки в PNG или SVG.
+//
+// Код строится без рамки библиотеки, отступ (тихая зона) добавляется здесь,
+// чтобы его можно было задать в модулях. Модули рисуются целым числом пикселей,
+// остаток размера изображения распределяется по краям белым полем.
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/url"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Форматы изображения.
+const (
+	FormatPNG = "png"
+	FormatSVG = "svg"
+)
+
+// Значения параметров по умолчанию и их границы.
+const (
+	DefaultSize   = 256
+	MinSize       = 64
+	MaxSize       = 2048
+	DefaultMargin = 4 // DefaultMargin - тихая зона, которую требует стандарт.
+	MaxMargin     = 16
+	DefaultLevel  = "M"
+)
+
+// levels - уровни коррекции ошибок: L - 7%, M - 15%, Q - 25%, H - 30% площади кода.
+var levels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// Ошибки параметров кода.
+var (
+	ErrInvalidFormat = errors.New("invalid format, expected png or svg")
+	ErrInvalidSize   = fmt.Errorf("invalid size, expected %d..%d", MinSize, MaxSize)
+	ErrInvalidMargin = fmt.Errorf("invalid margin, expected 0..%d", MaxMargin)
+	ErrInvalidLevel  = errors.New("invalid error correction level, expected L, M, Q or H")
+	ErrTooSmall      = errors.New("size is too small for the code")
+)
+
+// Options - параметры изображения кода.
+type Options struct {
+	Format string // Format - png или svg.
+	Size   int    // Size - ширина и высота изображения в пикселях.
+	Margin int    // Margin - тихая зона вокруг кода в модулях.
+	Level  string // Level - уровень коррекции ошибок: L, M, Q или H.
+}
+
+// ParseOptions читает параметры кода из запроса: format, size, margin и ecc.
+// Пропущенные параметры получают значения по умолчанию.
+func ParseOptions(query url.Values) (Options, error) {
+	opt := Options{Format: FormatPNG, Size: DefaultSize, Margin: DefaultMargin, Level: DefaultLevel}
+	if v := query.Get("format"); v != "" {
+		opt.Format = v
+		if opt.Format != FormatPNG && opt.Format != FormatSVG {
+			return opt, ErrInvalidFormat
+		}
+	}
+	if v := query.Get("size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < MinSize || size > MaxSize {
+			return opt, ErrInvalidSize
+		}
+		opt.Size = size
+	}
+	if v := query.Get("margin"); v != "" {
+		margin, err := strconv.Atoi(v)
+		if err != nil || margin < 0 || margin > MaxMargin {
+			return opt, ErrInvalidMargin
+		}
+		opt.Margin = margin
+	}
+	if v := query.Get("ecc"); v != "" {
+		opt.Level = v
+		if _, ok := levels[opt.Level]; !ok {
+			return opt, ErrInvalidLevel
+		}
+	}
+	return opt, nil
+}
+
+// ContentType возвращает тип содержимого изображения.
+func (opt Options) ContentType() string {
+	if opt.Format == FormatSVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+// Render рисует код содержимого content.
+func Render(content string, opt Options) ([]byte, error) {
+	level, ok := levels[opt.Level]
+	if !ok {
+		return nil, ErrInvalidLevel
+	}
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, err
+	}
+	code.DisableBorder = true
+	bitmap := code.Bitmap()
+
+	modules := len(bitmap) + 2*opt.Margin
+	scale := opt.Size / modules
+	if scale < 1 {
+		return nil, ErrTooSmall
+	}
+	// Смещение первого модуля с учетом тихой зоны и остатка размера.
+	offset := (opt.Size-modules*scale)/2 + opt.Margin*scale
+
+	if opt.Format == FormatSVG {
+		return renderSVG(bitmap, opt.Size, scale, offset), nil
+	}
+	return renderPNG(bitmap, opt.Size, scale, offset)
+}
+
+// renderPNG рисует код в двухцветное PNG изображение.
+func renderPNG(bitmap [][]bool, size, scale, offset int) ([]byte, error) {
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				start := img.PixOffset(offset+x*scale, offset+y*scale+py)
+				for px := 0; px < scale; px++ {
+					img.Pix[start+px] = 1
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderSVG рисует код одним контуром: соседние темные модули строки объединяются.
+func renderSVG(bitmap [][]bool, size, scale, offset int) []byte {
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x := 0; x < len(row); {
+			if !row[x] {
+				x++
+				continue
+			}
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv%dh-%dz",
+				offset+start*scale, offset+y*scale, (x-start)*scale, scale, (x-start)*scale)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, size, size)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/>`, size, size)
+	fmt.Fprintf(&buf, `<path fill="#000" d="%s"/>`, path.String())
+	buf.WriteString("</svg>\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,76 @@
+package qr
+
+import (
+	"bytes"
+	"image/png"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOptions(t *testing.T) {
+	testTable := []struct {
+		name    string
+		query   string
+		want    Options
+		wantErr error
+	}{
+		{"По умолчанию", "", Options{FormatPNG, DefaultSize, DefaultMargin, DefaultLevel}, nil},
+		{"Все параметры", "format=svg&size=512&margin=0&ecc=H", Options{FormatSVG, 512, 0, "H"}, nil},
+		{"Неизвестный формат", "format=gif", Options{}, ErrInvalidFormat},
+		{"Слишком маленький размер", "size=10", Options{}, ErrInvalidSize},
+		{"Размер не число", "size=big", Options{}, ErrInvalidSize},
+		{"Отрицательный отступ", "margin=-1", Options{}, ErrInvalidMargin},
+		{"Неизвестный уровень", "ecc=X", Options{}, ErrInvalidLevel},
+	}
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			query, err := url.ParseQuery(testData.query)
+			require.NoError(t, err)
+			got, err := ParseOptions(query)
+			if testData.wantErr != nil {
+				assert.ErrorIs(t, err, testData.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testData.want, got)
+		})
+	}
+}
+
+func TestRenderPNG(t *testing.T) {
+	opt := Options{Format: FormatPNG, Size: 300, Margin: 4, Level: "M"}
+	data, err := Render("http://localhost:8080/abc", opt)
+	require.NoError(t, err)
+
+	img, err := png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, 300, img.Bounds().Dx())
+	assert.Equal(t, 300, img.Bounds().Dy())
+
+	// Код версии 2 - 25 модулей, с отступом 33 модуля по 9 пикселей и 1 пиксель остатка.
+	offset := 1 + 4*9
+	r, _, _, _ := img.At(offset-1, offset-1).RGBA()
+	assert.NotZero(t, r, "тихая зона должна быть белой")
+	r, _, _, _ = img.At(offset, offset).RGBA()
+	assert.Zero(t, r, "угол поискового узора должен быть черным")
+}
+
+func TestRenderSVG(t *testing.T) {
+	opt := Options{Format: FormatSVG, Size: 256, Margin: 0, Level: "L"}
+	data, err := Render("http://localhost:8080/abc", opt)
+	require.NoError(t, err)
+	svg := string(data)
+	assert.True(t, strings.HasPrefix(svg, `<svg xmlns="http://www.w3.org/2000/svg" width="256" height="256"`))
+	assert.Contains(t, svg, `<path fill="#000" d="M`)
+	assert.Equal(t, "image/svg+xml", opt.ContentType())
+}
+
+func TestRenderTooSmall(t *testing.T) {
+	opt := Options{Format: FormatPNG, Size: MinSize, Margin: MaxMargin, Level: "H"}
+	_, err := Render("http://localhost:8080/"+strings.Repeat("a", 100), opt)
+	assert.ErrorIs(t, err, ErrTooSmall)
+}
@@ -0,0 +1,205 @@
+// Модуль ratelimit реализует ограничение частоты запросов по алгоритму token bucket.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidLimit - ошибка "неверный формат лимита".
+var ErrInvalidLimit = errors.New("invalid rate limit, expected N/s, N/m or N/h")
+
+// Limit - параметры корзины токенов.
+// Корзина вмещает Burst токенов и пополняется со скоростью Rate токенов в секунду.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Unlimited сообщает, что ограничение не задано.
+func (l Limit) Unlimited() bool {
+	return l.Burst <= 0 || l.Rate <= 0
+}
+
+// ParseLimit разбирает лимит вида "100/m": 100 запросов в минуту с запасом в 100 запросов.
+// Пустая строка и "0" означают отсутствие ограничения.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Limit{}, nil
+	}
+
+	count, unit, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, ErrInvalidLimit
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return Limit{}, ErrInvalidLimit
+	}
+
+	for _, p := range periods {
+		if p.unit == unit {
+			return Limit{Rate: float64(n) / p.period.Seconds(), Burst: n}, nil
+		}
+	}
+	return Limit{}, ErrInvalidLimit
+}
+
+// periods - единицы измерения лимита.
+var periods = []struct {
+	unit   string
+	period time.Duration
+}{
+	{"s", time.Second},
+	{"m", time.Minute},
+	{"h", time.Hour},
+}
+
+// String возвращает лимит в виде "N/m".
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "0"
+	}
+	for _, p := range periods {
+		if math.Abs(l.Rate*p.period.Seconds()-float64(l.Burst)) < 1e-6 {
+			return fmt.Sprintf("%d/%s", l.Burst, p.unit)
+		}
+	}
+	return fmt.Sprintf("%d/s", int(math.Round(l.Rate)))
+}
+
+// MarshalText команда соответствия интерфейсу encoding.TextMarshaler.
+func (l Limit) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText команда соответствия интерфейсу encoding.TextUnmarshaler.
+func (l *Limit) UnmarshalText(text []byte) error {
+	limit, err := ParseLimit(string(text))
+	if err != nil {
+		return err
+	}
+	*l = limit
+	return nil
+}
+
+// Result - результат списания токена.
+type Result struct {
+	Allowed    bool          // Allowed - запрос разрешен.
+	Limit      int           // Limit - емкость корзины.
+	Remaining  int           // Remaining - оставшиеся токены.
+	Reset      time.Duration // Reset - время до полного восстановления корзины.
+	RetryAfter time.Duration // RetryAfter - время до появления следующего токена, если запрос отклонен.
+}
+
+// Store хранит состояние корзин. Реализация по умолчанию хранит их в памяти процесса,
+// общее хранилище позволяет делить лимиты между несколькими экземплярами сервиса.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+	// Refund возвращает в корзину key токен, списанный Take.
+	Refund(ctx context.Context, key string, limit Limit) error
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// sweepEvery - через сколько списаний удалять из памяти полные корзины.
+const sweepEvery = 1024
+
+// MemoryStore хранит корзины в памяти процесса.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+	now     func() time.Time
+}
+
+// NewMemoryStore возвращает новое хранилище корзин в памяти.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take списывает токен из корзины key.
+func (ms *MemoryStore) Take(_ context.Context, key string, limit Limit) (Result, error) {
+	if limit.Unlimited() {
+		return Result{Allowed: true}, nil
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.now()
+	b := ms.refill(key, limit, now)
+
+	res := Result{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - b.tokens) / limit.Rate)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = seconds((float64(limit.Burst) - b.tokens) / limit.Rate)
+
+	ms.calls++
+	if ms.calls%sweepEvery == 0 {
+		ms.sweep(now)
+	}
+
+	return res, nil
+}
+
+// Refund возвращает в корзину key токен, списанный Take.
+// Используется, когда списывать токен нужно только за неудачную попытку,
+// а проверить попытку можно лишь после списания.
+func (ms *MemoryStore) Refund(_ context.Context, key string, limit Limit) error {
+	if limit.Unlimited() {
+		return nil
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	b := ms.refill(key, limit, ms.now())
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+1)
+	return nil
+}
+
+// refill заводит корзину key, если ее нет, и пополняет ее на момент now.
+func (ms *MemoryStore) refill(key string, limit Limit, now time.Time) *bucket {
+	b, ok := ms.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		ms.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+	b.limit = limit
+	return b
+}
+
+// sweep удаляет корзины, которые уже успели наполниться.
+func (ms *MemoryStore) sweep(now time.Time) {
+	for key, b := range ms.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*b.limit.Rate >= float64(b.limit.Burst) {
+			delete(ms.buckets, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s)) * time.Second
+}
@@ -0,0 +1,245 @@
+// Модуль rules выбирает ссылку для перехода по правилам перенаправления.
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
+// MaxRules - наибольшее количество правил у одной ссылки.
+const MaxRules = 20
+
+// Классы устройств.
+const (
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceDesktop = "desktop"
+	DeviceBot     = "bot"
+)
+
+// clockLayout - формат границ окна времени.
+const clockLayout = "15:04"
+
+// Ошибки проверки правил.
+var (
+	ErrTooManyRules  = fmt.Errorf("link has more than %d rules", MaxRules)
+	ErrEmptyTarget   = errors.New("rule target is missing")
+	ErrUnknownDevice = errors.New("unknown device, expected mobile, tablet, desktop or bot")
+	ErrInvalidTime   = errors.New("invalid time, expected HH:MM")
+	ErrInvalidLang   = errors.New("invalid language tag")
+)
+
+// Validate проверяет условия правил. Целевые ссылки проверяет вызывающий.
+func Validate(rules []model.RedirectRule) error {
+	if len(rules) > MaxRules {
+		return ErrTooManyRules
+	}
+	for i, rule := range rules {
+		if err := validate(rule); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func validate(rule model.RedirectRule) error {
+	if strings.TrimSpace(rule.Target) == "" {
+		return ErrEmptyTarget
+	}
+	switch rule.Device {
+	case "", DeviceMobile, DeviceTablet, DeviceDesktop, DeviceBot:
+	default:
+		return ErrUnknownDevice
+	}
+	if rule.Language != "" && !validLanguage(rule.Language) {
+		return ErrInvalidLang
+	}
+	for _, clock := range []string{rule.From, rule.To} {
+		if clock == "" {
+			continue
+		}
+		if _, err := time.Parse(clockLayout, clock); err != nil {
+			return ErrInvalidTime
+		}
+	}
+	return nil
+}
+
+// validLanguage проверяет языковой тег: части из латинских букв и цифр через дефис.
+func validLanguage(tag string) bool {
+	for _, part := range strings.Split(tag, "-") {
+		if part == "" || len(part) > 8 {
+			return false
+		}
+		for _, c := range part {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Match возвращает цель первого правила, которому соответствует запрос в момент now.
+// Если ни одно правило не подошло, возвращает false.
+func Match(rules []model.RedirectRule, r *http.Request, now time.Time) (string, bool) {
+	if len(rules) == 0 {
+		return "", false
+	}
+	var (
+		device    string
+		languages []string
+	)
+	for _, rule := range rules {
+		if rule.Device != "" {
+			if device == "" {
+				device = Device(r.UserAgent())
+			}
+			if rule.Device != device {
+				continue
+			}
+		}
+		if rule.Language != "" {
+			if languages == nil {
+				languages = AcceptLanguages(r.Header.Get("Accept-Language"))
+			}
+			if !matchLanguage(rule.Language, languages) {
+				continue
+			}
+		}
+		if !inWindow(rule.From, rule.To, now) {
+			continue
+		}
+		if !matchQuery(rule.Query, r) {
+			continue
+		}
+		return rule.Target, true
+	}
+	return "", false
+}
+
+// Device определяет класс устройства по User-Agent.
+// Пустой или неизвестный User-Agent считается настольным браузером.
+func Device(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "bot") || strings.Contains(ua, "crawler") || strings.Contains(ua, "spider"):
+		return DeviceBot
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") ||
+		strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		return DeviceTablet
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone") || strings.Contains(ua, "android"):
+		return DeviceMobile
+	default:
+		return DeviceDesktop
+	}
+}
+
+// AcceptLanguages возвращает языки из заголовка Accept-Language в порядке предпочтения.
+// Языки с q=0 и "*" пропускаются.
+func AcceptLanguages(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	list := make([]weighted, 0)
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q <= 0 {
+			continue
+		}
+		list = append(list, weighted{tag: tag, q: q})
+	}
+	slices.SortStableFunc(list, func(a, b weighted) int {
+		switch {
+		case a.q > b.q:
+			return -1
+		case a.q < b.q:
+			return 1
+		default:
+			return 0
+		}
+	})
+	tags := make([]string, len(list))
+	for i, l := range list {
+		tags[i] = l.tag
+	}
+	return tags
+}
+
+// matchLanguage сообщает, что клиент принимает язык tag или его уточнение.
+func matchLanguage(tag string, languages []string) bool {
+	tag = strings.ToLower(tag)
+	for _, lang := range languages {
+		if lang == tag || strings.HasPrefix(lang, tag+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// inWindow сообщает, что время суток now по UTC попадает в окно [from, to).
+// Незаданная граница окна - начало или конец суток.
+func inWindow(from string, to string, now time.Time) bool {
+	if from == "" && to == "" {
+		return true
+	}
+	now = now.UTC()
+	minute := now.Hour()*60 + now.Minute()
+	start, end := 0, 24*60
+	if from != "" {
+		start = clockMinute(from)
+	}
+	if to != "" {
+		end = clockMinute(to)
+	}
+	if start <= end {
+		return start <= minute && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// clockMinute возвращает минуту суток для времени в формате "15:04".
+func clockMinute(clock string) int {
+	t, err := time.Parse(clockLayout, clock)
+	if err != nil {
+		return 0
+	}
+	return t.Hour()*60 + t.Minute()
+}
+
+// matchQuery сообщает, что в запросе есть все параметры правила с нужными значениями.
+func matchQuery(params map[string]string, r *http.Request) bool {
+	if len(params) == 0 {
+		return true
+	}
+	query := r.URL.Query()
+	for name, want := range params {
+		if !query.Has(name) {
+			return false
+		}
+		if want != "*" && !slices.Contains(query[name], want) {
+			return false
+		}
+	}
+	return true
+}
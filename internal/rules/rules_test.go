@@ -0,0 +1,215 @@
+package rules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
+const (
+	uaIPhone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148"
+	uaAndroid = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/120.0 Mobile Safari/537.36"
+	uaTablet  = "Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 Chrome/120.0 Safari/537.36"
+	uaIPad    = "Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X) AppleWebKit/605.1.15"
+	uaDesktop = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36"
+	uaBot     = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+)
+
+func TestMatch(t *testing.T) {
+	noon := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	night := time.Date(2024, 3, 1, 23, 30, 0, 0, time.UTC)
+
+	linkRules := []model.RedirectRule{
+		{Query: map[string]string{"utm_source": "newsletter"}, Target: "https://example.com/newsletter"},
+		{Device: DeviceMobile, Language: "ru", Target: "https://example.com/m/ru"},
+		{Device: DeviceMobile, Target: "https://example.com/m"},
+		{Language: "de", Target: "https://example.com/de"},
+		{From: "22:00", To: "06:00", Target: "https://example.com/night"},
+		{Query: map[string]string{"ref": "*"}, Target: "https://example.com/ref"},
+	}
+
+	type testData struct {
+		name     string
+		path     string
+		ua       string
+		language string
+		now      time.Time
+		want     string
+		wantOK   bool
+	}
+
+	testTable := []testData{
+		{
+			name: "Ни одно правило не подошло",
+			path: "/key",
+			ua:   uaDesktop,
+			now:  noon,
+		},
+		{
+			name:   "Мобильное устройство",
+			path:   "/key",
+			ua:     uaIPhone,
+			now:    noon,
+			want:   "https://example.com/m",
+			wantOK: true,
+		},
+		{
+			name:     "Мобильное устройство и язык: подходит более раннее правило",
+			path:     "/key",
+			ua:       uaAndroid,
+			language: "ru-RU,ru;q=0.9,en;q=0.8",
+			now:      noon,
+			want:     "https://example.com/m/ru",
+			wantOK:   true,
+		},
+		{
+			name:   "Параметр запроса важнее устройства, потому что правило раньше",
+			path:   "/key?utm_source=newsletter",
+			ua:     uaIPhone,
+			now:    noon,
+			want:   "https://example.com/newsletter",
+			wantOK: true,
+		},
+		{
+			name: "Значение параметра не совпало",
+			path: "/key?utm_source=ads",
+			ua:   uaDesktop,
+			now:  noon,
+		},
+		{
+			name:   "Параметр с любым значением",
+			path:   "/key?ref=partner",
+			ua:     uaDesktop,
+			now:    noon,
+			want:   "https://example.com/ref",
+			wantOK: true,
+		},
+		{
+			name:     "Язык с уточнением региона",
+			path:     "/key",
+			ua:       uaDesktop,
+			language: "en;q=0.5, de-AT",
+			now:      noon,
+			want:     "https://example.com/de",
+			wantOK:   true,
+		},
+		{
+			name:     "Язык с q=0 не принимается",
+			path:     "/key",
+			ua:       uaDesktop,
+			language: "de;q=0, en",
+			now:      noon,
+		},
+		{
+			name:     "Префикс тега без дефиса не считается языком",
+			path:     "/key",
+			ua:       uaDesktop,
+			language: "dev",
+			now:      noon,
+		},
+		{
+			name:   "Окно времени через полночь",
+			path:   "/key",
+			ua:     uaDesktop,
+			now:    night,
+			want:   "https://example.com/night",
+			wantOK: true,
+		},
+		{
+			name: "Планшет не считается мобильным устройством",
+			path: "/key",
+			ua:   uaTablet,
+			now:  noon,
+		},
+	}
+
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, testData.path, nil)
+			r.Header.Set("User-Agent", testData.ua)
+			if testData.language != "" {
+				r.Header.Set("Accept-Language", testData.language)
+			}
+			got, ok := Match(linkRules, r, testData.now)
+			assert.Equal(t, testData.wantOK, ok)
+			assert.Equal(t, testData.want, got)
+		})
+	}
+}
+
+func TestDevice(t *testing.T) {
+	testTable := []struct {
+		ua   string
+		want string
+	}{
+		{uaIPhone, DeviceMobile},
+		{uaAndroid, DeviceMobile},
+		{uaTablet, DeviceTablet},
+		{uaIPad, DeviceTablet},
+		{uaDesktop, DeviceDesktop},
+		{uaBot, DeviceBot},
+		{"", DeviceDesktop},
+	}
+	for _, testData := range testTable {
+		assert.Equal(t, testData.want, Device(testData.ua), testData.ua)
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 1, hour, minute, 0, 0, time.UTC)
+	}
+	testTable := []struct {
+		name string
+		from string
+		to   string
+		now  time.Time
+		want bool
+	}{
+		{"Без окна", "", "", at(3, 0), true},
+		{"Начало окна входит", "09:00", "18:00", at(9, 0), true},
+		{"Конец окна не входит", "09:00", "18:00", at(18, 0), false},
+		{"До окна", "09:00", "18:00", at(8, 59), false},
+		{"Через полночь, до полуночи", "22:00", "06:00", at(23, 0), true},
+		{"Через полночь, после полуночи", "22:00", "06:00", at(5, 59), true},
+		{"Через полночь, днем", "22:00", "06:00", at(12, 0), false},
+		{"Только начало", "20:00", "", at(23, 59), true},
+		{"Только конец", "", "08:00", at(8, 0), false},
+		{"Время переводится в UTC", "09:00", "10:00", time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("MSK", 3*60*60)), true},
+	}
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			assert.Equal(t, testData.want, inWindow(testData.from, testData.to, testData.now))
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testTable := []struct {
+		name    string
+		rules   []model.RedirectRule
+		wantErr error
+	}{
+		{"Пустой список", nil, nil},
+		{"Корректное правило", []model.RedirectRule{{Device: DeviceBot, Language: "pt-BR", From: "08:00", To: "20:00", Target: "https://example.com"}}, nil},
+		{"Нет цели", []model.RedirectRule{{Device: DeviceMobile}}, ErrEmptyTarget},
+		{"Неизвестное устройство", []model.RedirectRule{{Device: "watch", Target: "https://example.com"}}, ErrUnknownDevice},
+		{"Неверное время", []model.RedirectRule{{From: "25:00", Target: "https://example.com"}}, ErrInvalidTime},
+		{"Неверный язык", []model.RedirectRule{{Language: "en_US", Target: "https://example.com"}}, ErrInvalidLang},
+		{"Слишком много правил", make([]model.RedirectRule, MaxRules+1), ErrTooManyRules},
+	}
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			err := Validate(testData.rules)
+			if testData.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, testData.wantErr)
+		})
+	}
+}
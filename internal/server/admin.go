@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// AdminRouter возвращает описание (handler) служебного сервера: профилирование, метрики
+// и подробные проверки готовности.
+// Служебный сервер слушает отдельный адрес и не должен быть доступен из интернета.
+func AdminRouter(s *Server) *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(adminAuthMiddleware(s))
+
+	r.Handle("/metrics", s.metrics.Handler())
+	r.Get("/readyz", readyz(s, true))
+
+	r.HandleFunc("/debug/pprof/*", pprof.Index)
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return r
+}
+
+// adminAuthMiddleware пропускает запросы с токеном в заголовке Authorization: Bearer
+// или с адресов доверенной подсети. Если не задано ни то ни другое, доступ есть только с loopback.
+func adminAuthMiddleware(s *Server) func(h http.Handler) http.Handler {
+	// Подсеть проверяется при разборе конфигурации.
+	_, subnet, _ := net.ParseCIDR(s.cfg.TrustedSubnet)
+	token := s.cfg.AdminToken
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			ip := net.ParseIP(remoteHost(r))
+			allowed := false
+			switch {
+			case token == "" && subnet == nil:
+				allowed = ip != nil && ip.IsLoopback()
+			case token != "" && validBearer(r, token):
+				allowed = true
+			case subnet != nil && ip != nil && subnet.Contains(ip):
+				allowed = true
+			}
+
+			if !allowed {
+				if token != "" {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+					writeError(s, w, r, newAPIError(http.StatusUnauthorized, codeUnauthorized, "unauthorized"))
+					return
+				}
+				writeError(s, w, r, newAPIError(http.StatusForbidden, codeForbidden, "forbidden"))
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func validBearer(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// remoteHost возвращает адрес клиента без порта.
+// Заголовки прокси не учитываются, чтобы клиент не мог подменить адрес.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
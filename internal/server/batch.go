@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
+// Статусы ссылок в ответе на сокращение пачки.
+const (
+	batchStatusCreated = "created"
+	batchStatusExists  = "exists"
+	batchStatusInvalid = "invalid"
+	batchStatusFailed  = "failed"
+)
+
+// batchOperations - операции пакетного сокращения и загрузки ссылок из спецификации.
+// Их тело ограничено BatchMaxBytes еще до проверки по спецификации.
+var batchOperations = map[string]bool{
+	"shortenBatch":   true,
+	"createLinks":    true,
+	"importUserURLs": true,
+}
+
+// batchItem - ссылка пачки и результат ее сокращения.
+type batchItem struct {
+	CorrelationID string
+	URL           model.URL
+	Status        string
+	Error         string
+}
+
+// readBatch читает пачку ссылок из тела запроса.
+// Пустая пачка отклоняется с 400, тело больше BatchMaxBytes и пачка больше BatchMaxItems ссылок - с 413.
+func readBatch[T any](s *Server, w http.ResponseWriter, r *http.Request) ([]T, error) {
+	limitBatchBody(s, w, r)
+	items := make([]T, 0)
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		if tooLarge := batchTooLarge(s, err); tooLarge != nil {
+			return nil, tooLarge
+		}
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidBody, "Can't unmarshal body")
+	}
+	if len(items) == 0 {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidBody, "batch is empty")
+	}
+	if s.cfg.BatchMaxItems > 0 && len(items) > s.cfg.BatchMaxItems {
+		return nil, newAPIError(http.StatusRequestEntityTooLarge, codePayloadTooLarge,
+			fmt.Sprintf("batch has %d urls, limit is %d", len(items), s.cfg.BatchMaxItems))
+	}
+	return items, nil
+}
+
+// limitBatchBody ограничивает тело запроса размером BatchMaxBytes.
+func limitBatchBody(s *Server, w http.ResponseWriter, r *http.Request) {
+	if s.cfg.BatchMaxBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.cfg.BatchMaxBytes)
+	}
+}
+
+// batchTooLarge возвращает ошибку 413, если err - превышение размера тела пачки.
+func batchTooLarge(s *Server, err error) *apiError {
+	var maxErr *http.MaxBytesError
+	if !errors.As(err, &maxErr) {
+		return nil
+	}
+	return newAPIError(http.StatusRequestEntityTooLarge, codePayloadTooLarge,
+		fmt.Sprintf("batch exceeds %d bytes", s.cfg.BatchMaxBytes))
+}
+
+// shortenBatch проверяет и сохраняет ссылки пачки, проставляя статус каждой.
+// Настройки ссылок из items сохраняются вместе с ними.
+// Невалидные и несохраненные ссылки не мешают сохранению остальных.
+// Ссылки, которые уже признаны невалидными при разборе запроса, не проверяются.
+func shortenBatch(s *Server, r *http.Request, user string, items []batchItem) batchSummarySchema {
+	var sum batchSummarySchema
+	valid := make([]model.URL, 0, len(items))
+	pos := make([]int, 0, len(items))
+	for i := range items {
+		if items[i].Status == batchStatusInvalid {
+			sum.Invalid++
+			continue
+		}
+		ourl, err := checkURL(s, items[i].URL.OriginalURL)
+		if err != nil {
+			items[i].Status = batchStatusInvalid
+			items[i].Error = err.Error()
+			sum.Invalid++
+			continue
+		}
+		url := items[i].URL
+		url.OriginalURL = ourl
+		url.CorrelationID = items[i].CorrelationID
+		valid = append(valid, url)
+		pos = append(pos, i)
+	}
+
+	saveErr := saveURLs(r.Context(), s, user, valid)
+	if saveErr != nil {
+		// Хранилище не сохранило пачку целиком, поэтому ни одна ссылка не считается сохраненной.
+		requestLogger(s, r).Errorw("Can't save batch", "error", saveErr)
+		for i := range valid {
+			valid[i].Err = saveErr
+		}
+	}
+
+	for i, url := range valid {
+		item := &items[pos[i]]
+		item.URL = url
+		switch {
+		case url.Err != nil:
+			item.Status = batchStatusFailed
+			item.Error = "can't save url"
+			sum.Failed++
+			if saveErr == nil {
+				requestLogger(s, r).Errorw("Can't save url", "correlation_id", url.CorrelationID, "error", url.Err)
+			}
+		case url.Conflict:
+			item.Status = batchStatusExists
+			sum.Exists++
+		default:
+			item.Status = batchStatusCreated
+			sum.Created++
+		}
+	}
+	return sum
+}
+
+// batchStatus возвращает код ответа на пачку: 422, если все ссылки невалидны,
+// 207, если часть ссылок невалидна или не сохранилась, иначе done.
+func batchStatus(sum batchSummarySchema, done int) int {
+	switch {
+	case sum.Created+sum.Exists+sum.Failed == 0:
+		return http.StatusUnprocessableEntity
+	case sum.Invalid > 0 || sum.Failed > 0:
+		return http.StatusMultiStatus
+	}
+	return done
+}
+
+// newBatchResponse возвращает строку ответа v1 для ссылки пачки.
+func newBatchResponse(s *Server, item batchItem) batchResponseSchema {
+	res := batchResponseSchema{
+		CorrelationID: item.CorrelationID,
+		Status:        item.Status,
+		Error:         item.Error,
+	}
+	if item.Status == batchStatusCreated || item.Status == batchStatusExists {
+		res.ShortURL = fmt.Sprintf(s.cfg.ResSrvAdr+"/%s", item.URL.Key)
+	}
+	return res
+}
@@ -8,9 +8,12 @@ import (
 )
 
 // gzipResponseWriter описывает ResponseWriter с использованием gzip
+// Сжимаются только ответы, для которых выставлен заголовок Content-Encoding.
 type gzipResponseWriter struct {
 	http.ResponseWriter
-	gzipW *gzip.Writer
+	gzipW       *gzip.Writer
+	wroteHeader bool
+	compress    bool
 }
 
 // newGzipResponseWriter возвращает новый gzipResponseWriter
@@ -28,19 +31,47 @@ func (gw *gzipResponseWriter) Header() http.Header {
 
 // Write команда соответствия интерфейсу
 func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if !gw.compress {
+		return gw.ResponseWriter.Write(p)
+	}
 	return gw.gzipW.Write(p)
 }
 
 // WriteHeader команда соответствия интерфейсу
 func (gw *gzipResponseWriter) WriteHeader(statusCode int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
 	if statusCode < 300 || statusCode == http.StatusConflict {
+		gw.compress = true
 		gw.ResponseWriter.Header().Set("Content-Encoding", "gzip")
+		gw.ResponseWriter.Header().Del("Content-Length")
 	}
 	gw.ResponseWriter.WriteHeader(statusCode)
 }
 
+// Flush отправляет клиенту уже сжатые данные, чтобы потоковый ответ доходил по частям.
+func (gw *gzipResponseWriter) Flush() {
+	if gw.compress {
+		_ = gw.gzipW.Flush()
+	}
+	_ = http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+// Unwrap дает http.ResponseController доступ к исходному http.ResponseWriter.
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
 // Close команда соответствия интерфейсу
 func (gw *gzipResponseWriter) Close() error {
+	if !gw.compress {
+		return nil
+	}
 	return gw.gzipW.Close()
 }
 
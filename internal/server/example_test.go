@@ -48,7 +48,7 @@ func newTestServer() (*httptest.Server, error) {
 	}
 	repo = sqlRepo
 
-	logger, err := log.New()
+	logger, err := log.New(log.Config{Level: cfg.LogLevel, Format: cfg.LogFormat})
 	if err != nil {
 		return nil, err
 	}
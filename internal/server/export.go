@@ -0,0 +1,586 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/rules"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/urltemplate"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Форматы выгрузки и загрузки ссылок пользователя.
+const (
+	formatCSV    = "csv"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
+// Статусы строк при загрузке ссылок.
+const (
+	importStatusCreated  = "created"
+	importStatusConflict = "conflict"
+	importStatusInvalid  = "invalid"
+	importStatusFailed   = "failed"
+)
+
+var formatContentTypes = map[string]string{
+	formatCSV:    "text/csv",
+	formatJSON:   "application/json",
+	formatNDJSON: "application/x-ndjson",
+}
+
+var csvHeader = []string{
+	"short_url", "original_url", "created_at", "deleted", "deleted_at", "password_hash",
+	"max_clicks", "variants", "redirect_status", "interstitial", "rules", "template",
+}
+
+var errUnknownFormat = errors.New("unknown format")
+
+// recordWriter записывает ссылки в ответ по одной.
+type recordWriter interface {
+	Write(rec exportSchema) error
+	Close() error
+}
+
+func exportUsersURL(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = formatJSON
+		}
+		contentType, ok := formatContentTypes[format]
+		if !ok {
+			return newAPIError(http.StatusBadRequest, codeUnknownFormat, "unknown format")
+		}
+
+		urls, err := s.urlRepo.ExportURLs(r.Context(), user)
+		if err != nil {
+			return internalError("can't get user's urls", err)
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=urls.%s", format))
+		w.WriteHeader(http.StatusOK)
+
+		rw := newRecordWriter(w, format)
+		for _, url := range urls {
+			if err := rw.Write(newExportRecord(s, url)); err != nil {
+				return fmt.Errorf("write export: %w", err)
+			}
+		}
+		if err := rw.Close(); err != nil {
+			return fmt.Errorf("write export: %w", err)
+		}
+		return nil
+	})
+}
+
+// importUsersURL загружает ссылки пользователя вместе с настройками.
+// Загрузка ограничена так же, как пачка: BatchMaxBytes на тело и BatchMaxItems на число строк.
+// Ссылки сохраняются через shortenBatch, правила и шаблон задаются созданным ссылкам после сохранения.
+func importUsersURL(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = formatFromContentType(r.Header.Get("Content-Type"))
+		}
+
+		limitBatchBody(s, w, r)
+		rows, recs, err := readImportRows(r.Body, format)
+		if err != nil {
+			if errors.Is(err, errUnknownFormat) {
+				return newAPIError(http.StatusBadRequest, codeUnknownFormat, "unknown format")
+			}
+			if tooLarge := batchTooLarge(s, err); tooLarge != nil {
+				return tooLarge
+			}
+			return newAPIError(http.StatusBadRequest, codeInvalidBody, "Can't read body")
+		}
+		if s.cfg.BatchMaxItems > 0 && len(rows) > s.cfg.BatchMaxItems {
+			return newAPIError(http.StatusRequestEntityTooLarge, codePayloadTooLarge,
+				fmt.Sprintf("import has %d rows, limit is %d", len(rows), s.cfg.BatchMaxItems))
+		}
+
+		items := make([]batchItem, len(rows))
+		for i := range rows {
+			if rows[i].Status == importStatusInvalid {
+				items[i].Status = batchStatusInvalid
+				continue
+			}
+			url, err := importURL(s, recs[i])
+			if err != nil {
+				rows[i].Status = importStatusInvalid
+				rows[i].Error = err.Error()
+				items[i].Status = batchStatusInvalid
+				continue
+			}
+			items[i].URL = url
+		}
+		shortenBatch(s, r, user, items)
+
+		var res importResponseSchema
+		for i, item := range items {
+			switch item.Status {
+			case batchStatusInvalid:
+				if rows[i].Status == "" {
+					rows[i].Status = importStatusInvalid
+					rows[i].Error = item.Error
+				}
+			case batchStatusFailed:
+				rows[i].Status = importStatusFailed
+				rows[i].Error = item.Error
+			case batchStatusExists:
+				rows[i].OriginalURL = item.URL.OriginalURL
+				rows[i].ShortURL = fmt.Sprintf(s.cfg.ResSrvAdr+"/%s", item.URL.Key)
+				rows[i].Status = importStatusConflict
+			default:
+				rows[i].OriginalURL = item.URL.OriginalURL
+				rows[i].ShortURL = fmt.Sprintf(s.cfg.ResSrvAdr+"/%s", item.URL.Key)
+				rows[i].Status = importStatusCreated
+				if err := setImportedSettings(r.Context(), s, user, item.URL); err != nil {
+					requestLogger(s, r).Errorw("Can't save url settings", "row", rows[i].Row, "error", err)
+					rows[i].Status = importStatusFailed
+					rows[i].Error = "can't save url settings"
+				}
+			}
+			switch rows[i].Status {
+			case importStatusCreated:
+				res.Created++
+			case importStatusConflict:
+				res.Conflict++
+			case importStatusInvalid:
+				res.Invalid++
+			case importStatusFailed:
+				res.Failed++
+			}
+		}
+		res.Rows = rows
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return json.NewEncoder(w).Encode(res)
+	})
+}
+
+// newExportRecord возвращает запись выгрузки для ссылки пользователя.
+func newExportRecord(s *Server, url model.URL) exportSchema {
+	rec := exportSchema{
+		ShortURL:       fmt.Sprintf(s.cfg.ResSrvAdr+"/%s", url.Key),
+		OriginalURL:    url.OriginalURL,
+		CreatedAt:      url.CreatedAt,
+		Deleted:        url.IsDeleted,
+		PasswordHash:   url.PasswordHash,
+		MaxClicks:      url.MaxClicks,
+		Variants:       url.Variants,
+		RedirectStatus: url.RedirectStatus,
+		Interstitial:   url.Interstitial,
+		Rules:          url.Rules,
+		Template:       url.Template,
+	}
+	if url.IsDeleted && !url.DeletedAt.IsZero() {
+		deletedAt := url.DeletedAt
+		rec.DeletedAt = &deletedAt
+	}
+	return rec
+}
+
+// importURL проверяет настройки загружаемой ссылки так же, как при создании ссылки.
+// Исходный адрес проверяет shortenBatch.
+func importURL(s *Server, rec exportSchema) (model.URL, error) {
+	if rec.Deleted {
+		return model.URL{}, errors.New("deleted url is not imported")
+	}
+	if rec.PasswordHash != "" {
+		if _, err := bcrypt.Cost([]byte(rec.PasswordHash)); err != nil {
+			return model.URL{}, errors.New("password_hash is not a bcrypt hash")
+		}
+	}
+	if err := checkMaxClicks(rec.MaxClicks); err != nil {
+		return model.URL{}, err
+	}
+	variants, err := checkVariants(s, rec.Variants)
+	if err != nil {
+		return model.URL{}, err
+	}
+	if err := checkRedirectStatus(rec.RedirectStatus); err != nil {
+		return model.URL{}, err
+	}
+	if err := rules.Validate(rec.Rules); err != nil {
+		return model.URL{}, err
+	}
+	for i := range rec.Rules {
+		target, err := checkURL(s, rec.Rules[i].Target)
+		if err != nil {
+			return model.URL{}, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		rec.Rules[i].Target = target
+	}
+	tpl := rec.Template
+	if tpl != nil {
+		if err := urltemplate.Validate(tpl); err != nil {
+			return model.URL{}, err
+		}
+		if tpl.Empty() {
+			tpl = nil
+		}
+	}
+	return model.URL{
+		OriginalURL:    rec.OriginalURL,
+		PasswordHash:   rec.PasswordHash,
+		MaxClicks:      rec.MaxClicks,
+		Variants:       variants,
+		RedirectStatus: rec.RedirectStatus,
+		Interstitial:   rec.Interstitial,
+		Rules:          rec.Rules,
+		Template:       tpl,
+	}, nil
+}
+
+// setImportedSettings задает созданной при загрузке ссылке правила и шаблон.
+// Хранилище сохраняет их отдельно от самой ссылки.
+func setImportedSettings(ctx context.Context, s *Server, user string, url model.URL) error {
+	if len(url.Rules) > 0 {
+		if err := s.urlRepo.SetURLRules(ctx, user, url.Key, url.Rules); err != nil {
+			return err
+		}
+	}
+	if url.Template != nil {
+		if err := s.urlRepo.SetURLTemplate(ctx, user, url.Key, url.Template); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatFromContentType(contentType string) string {
+	for format, ct := range formatContentTypes {
+		if strings.Contains(contentType, ct) {
+			return format
+		}
+	}
+	return ""
+}
+
+func newRecordWriter(w io.Writer, format string) recordWriter {
+	switch format {
+	case formatCSV:
+		return &csvRecordWriter{w: csv.NewWriter(w)}
+	case formatNDJSON:
+		return &ndjsonRecordWriter{enc: json.NewEncoder(w)}
+	default:
+		return &jsonRecordWriter{w: w}
+	}
+}
+
+// csvRecordWriter записывает ссылки в формате CSV с заголовком.
+type csvRecordWriter struct {
+	w          *csv.Writer
+	headerDone bool
+}
+
+// Write записывает одну ссылку.
+func (cw *csvRecordWriter) Write(rec exportSchema) error {
+	if !cw.headerDone {
+		if err := cw.w.Write(csvHeader); err != nil {
+			return err
+		}
+		cw.headerDone = true
+	}
+	record, err := csvRecord(rec)
+	if err != nil {
+		return err
+	}
+	return cw.w.Write(record)
+}
+
+// Close дописывает буфер в ответ.
+func (cw *csvRecordWriter) Close() error {
+	if !cw.headerDone {
+		if err := cw.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// ndjsonRecordWriter записывает по одному JSON объекту на строку.
+type ndjsonRecordWriter struct {
+	enc *json.Encoder
+}
+
+// Write записывает одну ссылку.
+func (nw *ndjsonRecordWriter) Write(rec exportSchema) error {
+	return nw.enc.Encode(rec)
+}
+
+// Close команда соответствия интерфейсу.
+func (nw *ndjsonRecordWriter) Close() error {
+	return nil
+}
+
+// jsonRecordWriter записывает JSON массив, не собирая его в памяти.
+type jsonRecordWriter struct {
+	w     io.Writer
+	count int
+}
+
+// Write записывает одну ссылку.
+func (jw *jsonRecordWriter) Write(rec exportSchema) error {
+	sep := ","
+	if jw.count == 0 {
+		sep = "["
+	}
+	if _, err := io.WriteString(jw.w, sep); err != nil {
+		return err
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	jw.count++
+	_, err = jw.w.Write(data)
+	return err
+}
+
+// Close закрывает JSON массив.
+func (jw *jsonRecordWriter) Close() error {
+	end := "]\n"
+	if jw.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(jw.w, end)
+	return err
+}
+
+// readImportRows разбирает тело запроса на строки загрузки и их записи.
+// Ошибки разбора отдельных строк не прерывают разбор, а попадают в статус строки.
+// Ошибка чтения тела, например превышение его размера, возвращается как есть.
+func readImportRows(body io.Reader, format string) ([]importRowSchema, []exportSchema, error) {
+	switch format {
+	case formatCSV:
+		return readCSVRows(body)
+	case formatNDJSON:
+		return readNDJSONRows(body)
+	case formatJSON:
+		return readJSONRows(body)
+	default:
+		return nil, nil, errUnknownFormat
+	}
+}
+
+func readCSVRows(body io.Reader) ([]importRowSchema, []exportSchema, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []importRowSchema{}, []exportSchema{}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	col := -1
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if header[i] == "original_url" {
+			col = i
+		}
+	}
+	if col < 0 {
+		return nil, nil, errors.New("original_url column is missing")
+	}
+
+	rows := make([]importRowSchema, 0)
+	recs := make([]exportSchema, 0)
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if err != nil && !errors.As(err, &parseErr) {
+			return nil, nil, err
+		}
+		row := importRowSchema{Row: n}
+		var rec exportSchema
+		switch {
+		case err != nil:
+			row.Status = importStatusInvalid
+			row.Error = err.Error()
+		case col >= len(record):
+			row.Status = importStatusInvalid
+			row.Error = "original_url column is missing"
+		default:
+			rec, err = parseCSVRecord(header, record)
+			row.OriginalURL = rec.OriginalURL
+			if err != nil {
+				row.Status = importStatusInvalid
+				row.Error = err.Error()
+			}
+		}
+		rows = append(rows, row)
+		recs = append(recs, rec)
+	}
+	return rows, recs, nil
+}
+
+func readNDJSONRows(body io.Reader) ([]importRowSchema, []exportSchema, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	rows := make([]importRowSchema, 0)
+	recs := make([]exportSchema, 0)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		row, rec := unmarshalImportRow(n, []byte(line))
+		rows = append(rows, row)
+		recs = append(recs, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return rows, recs, nil
+}
+
+func readJSONRows(body io.Reader) ([]importRowSchema, []exportSchema, error) {
+	raws := make([]json.RawMessage, 0)
+	if err := json.NewDecoder(body).Decode(&raws); err != nil {
+		return nil, nil, err
+	}
+
+	rows := make([]importRowSchema, 0, len(raws))
+	recs := make([]exportSchema, 0, len(raws))
+	for i, raw := range raws {
+		row, rec := unmarshalImportRow(i+1, raw)
+		rows = append(rows, row)
+		recs = append(recs, rec)
+	}
+	return rows, recs, nil
+}
+
+// unmarshalImportRow разбирает строку загрузки в формате JSON.
+func unmarshalImportRow(n int, data []byte) (importRowSchema, exportSchema) {
+	row := importRowSchema{Row: n}
+	var rec exportSchema
+	if err := json.Unmarshal(data, &rec); err != nil {
+		row.Status = importStatusInvalid
+		row.Error = "can't unmarshal row"
+		return row, exportSchema{}
+	}
+	row.OriginalURL = rec.OriginalURL
+	return row, rec
+}
+
+// csvRecord возвращает строку CSV для записи выгрузки.
+// Нулевые значения записываются пустыми ячейками, варианты, правила и шаблон - в формате JSON.
+func csvRecord(rec exportSchema) ([]string, error) {
+	record := []string{rec.ShortURL, rec.OriginalURL, rec.CreatedAt.Format(time.RFC3339Nano), "", "",
+		rec.PasswordHash, "", "", "", "", "", ""}
+	if rec.Deleted {
+		record[3] = "true"
+	}
+	if rec.DeletedAt != nil {
+		record[4] = rec.DeletedAt.Format(time.RFC3339Nano)
+	}
+	if rec.MaxClicks != 0 {
+		record[6] = strconv.Itoa(rec.MaxClicks)
+	}
+	if rec.RedirectStatus != 0 {
+		record[8] = strconv.Itoa(rec.RedirectStatus)
+	}
+	if rec.Interstitial {
+		record[9] = "true"
+	}
+	cells := []struct {
+		col   int
+		value any
+		empty bool
+	}{
+		{7, rec.Variants, len(rec.Variants) == 0},
+		{10, rec.Rules, len(rec.Rules) == 0},
+		{11, rec.Template, rec.Template == nil},
+	}
+	for _, cell := range cells {
+		if cell.empty {
+			continue
+		}
+		data, err := json.Marshal(cell.value)
+		if err != nil {
+			return nil, err
+		}
+		record[cell.col] = string(data)
+	}
+	return record, nil
+}
+
+// parseCSVRecord разбирает строку CSV по заголовку header.
+// Пустые ячейки и неизвестные столбцы пропускаются.
+func parseCSVRecord(header []string, record []string) (exportSchema, error) {
+	var rec exportSchema
+	for i, name := range header {
+		if i >= len(record) || record[i] == "" {
+			continue
+		}
+		value := record[i]
+		var err error
+		switch name {
+		case "short_url":
+			rec.ShortURL = value
+		case "original_url":
+			rec.OriginalURL = value
+		case "created_at":
+			rec.CreatedAt, err = time.Parse(time.RFC3339Nano, value)
+		case "deleted":
+			rec.Deleted, err = strconv.ParseBool(value)
+		case "deleted_at":
+			var deletedAt time.Time
+			deletedAt, err = time.Parse(time.RFC3339Nano, value)
+			rec.DeletedAt = &deletedAt
+		case "password_hash":
+			rec.PasswordHash = value
+		case "max_clicks":
+			rec.MaxClicks, err = strconv.Atoi(value)
+		case "variants":
+			err = json.Unmarshal([]byte(value), &rec.Variants)
+		case "redirect_status":
+			rec.RedirectStatus, err = strconv.Atoi(value)
+		case "interstitial":
+			rec.Interstitial, err = strconv.ParseBool(value)
+		case "rules":
+			err = json.Unmarshal([]byte(value), &rec.Rules)
+		case "template":
+			err = json.Unmarshal([]byte(value), &rec.Template)
+		}
+		if err != nil {
+			return rec, fmt.Errorf("can't parse %s column", name)
+		}
+	}
+	return rec, nil
+}
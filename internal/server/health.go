@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
+// Статусы проверок готовности.
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+)
+
+// checkDeleteWorker - имя проверки фонового удаления ссылок.
+const checkDeleteWorker = "delete_worker"
+
+// readyTimeout - время, за которое должны завершиться все проверки готовности.
+const readyTimeout = 2 * time.Second
+
+// deleteStallTimeout - дольше этого одна пачка удаления обрабатываться не должна.
+// Очередь удаления не буферизована, поэтому зависшее удаление блокирует запросы DELETE.
+const deleteStallTimeout = 30 * time.Second
+
+var (
+	errDeleteWorkerStopped = errors.New("delete worker is not running")
+	errDeleteWorkerStalled = errors.New("delete worker is stalled")
+)
+
+// healthz отвечает, что процесс жив. Зависимости не проверяются.
+func healthz(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(s, w, r, healthResponseSchema{Status: healthOK}, http.StatusOK)
+	}
+}
+
+// readyz проверяет все компоненты сервиса и отвечает 503, если хотя бы один не готов.
+// Текст ошибок проверок отдается только на служебном сервере (detailed),
+// публичный ответ содержит лишь статусы.
+func readyz(s *Server, detailed bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		checks := s.urlRepo.CheckHealth(ctx)
+		checks = append(checks, model.HealthCheck{Name: checkDeleteWorker, Err: checkDelWorker(s)})
+
+		res := healthResponseSchema{
+			Status: healthOK,
+			Checks: make(map[string]healthCheckSchema, len(checks)),
+		}
+		status := http.StatusOK
+		for _, check := range checks {
+			if check.Err != nil {
+				requestLogger(s, r).Warnw("Readiness check failed", "check", check.Name, "error", check.Err)
+				res.Checks[check.Name] = healthCheckSchema{Status: healthFail}
+				if detailed {
+					res.Checks[check.Name] = healthCheckSchema{Status: healthFail, Error: check.Err.Error()}
+				}
+				res.Status = healthFail
+				status = http.StatusServiceUnavailable
+				continue
+			}
+			res.Checks[check.Name] = healthCheckSchema{Status: healthOK}
+		}
+
+		writeHealth(s, w, r, res, status)
+	}
+}
+
+// checkDelWorker проверяет, что фоновое удаление запущено и не зависло на одной пачке.
+func checkDelWorker(s *Server) error {
+	if !s.delWorkerStarted.Load() {
+		return errDeleteWorkerStopped
+	}
+	if since := s.delWorkerBusySince.Load(); since != 0 && time.Since(time.Unix(0, since)) > deleteStallTimeout {
+		return errDeleteWorkerStalled
+	}
+	return nil
+}
+
+func writeHealth(s *Server, w http.ResponseWriter, r *http.Request, res healthResponseSchema, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		requestLogger(s, r).Errorw("Can't encode response", "error", err)
+	}
+}
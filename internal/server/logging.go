@@ -30,6 +30,11 @@ func (lw *loggingResponseWriter) WriteHeader(statusCode int) {
 	lw.responseData.status = statusCode
 }
 
+// Unwrap дает http.ResponseController доступ к исходному http.ResponseWriter.
+func (lw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
 // newLoggingResponseWriter возвращает новый loggingResponseWriter
 func newLoggingResponseWriter(w http.ResponseWriter) *loggingResponseWriter {
 	responseData := new(responseData)
@@ -39,6 +44,22 @@ func newLoggingResponseWriter(w http.ResponseWriter) *loggingResponseWriter {
 	return lw
 }
 
+// logURI возвращает URI запроса для лога. Пароль и токен доступа защищенной ссылки в лог не попадают.
+func logURI(r *http.Request) string {
+	query := r.URL.Query()
+	if !query.Has(linkPasswordParam) && !query.Has(linkTokenParam) {
+		return r.RequestURI
+	}
+	for _, param := range []string{linkPasswordParam, linkTokenParam} {
+		if query.Has(param) {
+			query.Set(param, "REDACTED")
+		}
+	}
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
+
 // logMiddleware обработчик логирования при запросе
 func logMiddleware(s *Server) func(h http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
@@ -50,8 +71,8 @@ func logMiddleware(s *Server) func(h http.Handler) http.Handler {
 
 			duration := time.Since(start)
 
-			s.logger.Infoln(
-				"uri", r.RequestURI,
+			requestLogger(s, r).Infow("Request handled",
+				"uri", logURI(r),
 				"method", r.Method,
 				"status", logW.responseData.status,
 				"duration", duration,
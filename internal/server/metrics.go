@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Результаты перехода по короткой ссылке.
+const (
+	redirectFound     = "found"
+	redirectNotFound  = "not_found"
+	redirectDeleted   = "deleted"
+	redirectBlocked   = "blocked"
+	redirectLocked    = "locked"
+	redirectExhausted = "exhausted"
+	redirectPreview   = "preview"
+)
+
+// metricsMiddleware учитывает запрос в метриках по шаблону маршрута,
+// чтобы ключи ссылок не порождали отдельные серии.
+func metricsMiddleware(s *Server) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			mw := newLoggingResponseWriter(w)
+			h.ServeHTTP(mw, r)
+
+			route := "unmatched"
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+			status := mw.responseData.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			s.metrics.ObserveRequest(route, r.Method, status, time.Since(start))
+		})
+	}
+}
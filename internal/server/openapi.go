@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+// openAPISpec - спецификация OpenAPI всех обработчиков сервера.
+// Соответствие спецификации и обработчиков проверяет контрактный тест.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// specRouter находит операцию спецификации по запросу.
+var specRouter = mustSpecRouter(openAPISpec)
+
+func mustSpecRouter(data []byte) routers.Router {
+	doc, err := openapi3.NewLoader().LoadFromData(data)
+	if err != nil {
+		panic(fmt.Sprintf("openapi: can't load spec: %v", err))
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		panic(fmt.Sprintf("openapi: invalid spec: %v", err))
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		panic(fmt.Sprintf("openapi: can't build router: %v", err))
+	}
+	return router
+}
+
+// openAPI отдает спецификацию сервера.
+func openAPI(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(openAPISpec); err != nil {
+			requestLogger(s, r).Errorw("Can't write openapi spec", "error", err)
+		}
+	}
+}
+
+// validateMiddleware проверяет параметры и JSON тело запроса по спецификации.
+// Тела в других форматах проверяют сами обработчики.
+// Запросы, которых нет в спецификации, передаются дальше без проверки.
+func validateMiddleware(s *Server) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route, pathParams, err := specRouter.FindRoute(r)
+			if err != nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			input := &openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: pathParams,
+				Route:      route,
+				Options: &openapi3filter.Options{
+					// Пользователь определяется по cookie в обработчиках.
+					AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+				},
+			}
+
+			var body []byte
+			contentType, isJSON := jsonContentType(r, route)
+			if isJSON {
+				if batchOperations[route.Operation.OperationID] {
+					limitBatchBody(s, w, r)
+				}
+				body, err = io.ReadAll(r.Body)
+				if tooLarge := batchTooLarge(s, err); tooLarge != nil {
+					writeError(s, w, r, tooLarge)
+					return
+				}
+				if err != nil {
+					writeError(s, w, r, newAPIError(http.StatusBadRequest, codeBadRequest, "Can't read body"))
+					return
+				}
+				vr := r.Clone(r.Context())
+				vr.Header.Set("Content-Type", contentType)
+				vr.Body = io.NopCloser(bytes.NewReader(body))
+				input.Request = vr
+			} else {
+				input.Options.ExcludeRequestBody = true
+			}
+
+			if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+				writeError(s, w, r, validationError(err))
+				return
+			}
+
+			if isJSON {
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// jsonContentType определяет, передано ли в запросе JSON тело.
+// Сжатое тело считается JSON, если операция принимает только его.
+func jsonContentType(r *http.Request, route *routers.Route) (string, bool) {
+	reqBody := route.Operation.RequestBody
+	if reqBody == nil || reqBody.Value == nil {
+		return "", false
+	}
+	content := reqBody.Value.Content
+
+	contentType := r.Header.Get("Content-Type")
+	if strings.Contains(contentType, "application/x-gzip") {
+		if len(content) != 1 || content.Get("application/json") == nil {
+			return "", false
+		}
+		return "application/json", true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/json" || content.Get(mediaType) == nil {
+		return "", false
+	}
+	return contentType, true
+}
+
+// validationError описывает ошибку проверки запроса без схемы целиком.
+func validationError(err error) *apiError {
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return newAPIError(http.StatusBadRequest, codeBadRequest, err.Error())
+	}
+
+	reason := reqErr.Reason
+	if reqErr.Err != nil {
+		reason = reqErr.Err.Error()
+	}
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		reason = schemaErr.Reason
+	}
+
+	if reqErr.Parameter != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidParameter,
+			fmt.Sprintf("invalid %s parameter %q: %s", reqErr.Parameter.In, reqErr.Parameter.Name, reason))
+	}
+	if schemaErr != nil {
+		field := "/" + strings.Join(schemaErr.JSONPointer(), "/")
+		return newAPIError(http.StatusBadRequest, codeInvalidBody,
+			fmt.Sprintf("invalid request body at %s: %s", field, reason))
+	}
+	return newAPIError(http.StatusBadRequest, codeInvalidBody, "malformed request body: "+reason)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// linkPasswordHeader - заголовок с паролем защищенной ссылки.
+const linkPasswordHeader = "X-Link-Password"
+
+// linkPasswordParam - поле формы с паролем защищенной ссылки. В параметре запроса пароль
+// не принимается: он остался бы в истории браузера, заголовке Referer и журналах прокси.
+const linkPasswordParam = "password"
+
+// linkTokenParam - параметр запроса с токеном доступа к защищенной ссылке вместо пароля.
+const linkTokenParam = "token"
+
+// accessTokenTTL - сколько действует токен доступа к защищенной ссылке.
+const accessTokenTTL = 24 * time.Hour
+
+// accessPurpose возвращает назначение токена доступа к ссылке. В него входит хеш пароля,
+// поэтому токен действует только для ссылки с тем паролем, для которого выдан.
+func accessPurpose(url *model.URL) string {
+	return tokenAccess + "|" + url.PasswordHash
+}
+
+// hashPassword возвращает bcrypt хеш пароля ссылки. Для пустого пароля хеш пустой.
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return "", newAPIError(http.StatusBadRequest, codeInvalidBody, "password is longer than 72 bytes")
+	}
+	if err != nil {
+		return "", internalError("Can't hash password", err)
+	}
+	return string(hash), nil
+}
+
+// unlockURL проверяет пароль защищенной ссылки из заголовка или формы либо токен доступа
+// из параметра запроса. Возвращает true, если ссылку можно открыть. Если пароля нет или он неверный,
+// браузеру отдается форма ввода пароля, остальным клиентам - ошибка.
+// Неудачные попытки ввода пароля списывают токены из лимита ключа, поэтому перебор паролей ограничен.
+func unlockURL(s *Server, w http.ResponseWriter, r *http.Request, url *model.URL) (bool, error) {
+	if url.PasswordHash == "" {
+		return true, nil
+	}
+	if validLinkToken(s, accessPurpose(url), url.Key, r.URL.Query().Get(linkTokenParam)) {
+		return true, nil
+	}
+
+	password := linkPassword(r)
+	if password == "" {
+		s.metrics.ObserveRedirect(redirectLocked)
+		if acceptsHTML(r) {
+			return false, writePasswordPrompt(w, http.StatusUnauthorized, "")
+		}
+		return false, newAPIError(http.StatusUnauthorized, codePasswordRequired, "password required")
+	}
+
+	// Токен списывается до сравнения пароля: иначе параллельные попытки успевают пройти
+	// проверку лимита, пока идет медленное сравнение. Лимит считает только неудачные попытки,
+	// поэтому за подошедший пароль токен возвращается.
+	limit := s.cfg.RatePassword
+	rateKey := "password:" + url.Key
+	taken := false
+	if !limit.Unlimited() {
+		res, err := s.rateStore.Take(r.Context(), rateKey, limit)
+		switch {
+		case err != nil:
+			requestLogger(s, r).Errorw("Can't check password rate limit", "error", err)
+		case !res.Allowed:
+			s.metrics.ObserveRedirect(redirectLocked)
+			w.Header().Set("Retry-After", strconv.Itoa(int(res.RetryAfter.Seconds())))
+			return false, newAPIError(http.StatusTooManyRequests, codeRateLimited, "too many password attempts")
+		default:
+			taken = true
+		}
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(url.PasswordHash), []byte(password)); err != nil {
+		s.metrics.ObserveRedirect(redirectLocked)
+		if acceptsHTML(r) {
+			return false, writePasswordPrompt(w, http.StatusForbidden, "Неверный пароль")
+		}
+		return false, newAPIError(http.StatusForbidden, codeWrongPassword, "wrong password")
+	}
+	if taken {
+		if err := s.rateStore.Refund(r.Context(), rateKey, limit); err != nil {
+			requestLogger(s, r).Errorw("Can't refund password rate limit", "error", err)
+		}
+	}
+	return true, nil
+}
+
+// linkPassword возвращает пароль ссылки, переданный в заголовке или в форме.
+func linkPassword(r *http.Request) string {
+	if password := r.Header.Get(linkPasswordHeader); password != "" {
+		return password
+	}
+	if r.Method == http.MethodPost {
+		return r.PostFormValue(linkPasswordParam)
+	}
+	return ""
+}
+
+// createAccessToken выдает владельцу ссылки с паролем токен доступа на accessTokenTTL.
+// Короткую ссылку с токеном можно передать, не раскрывая пароль.
+func createAccessToken(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		key := chi.URLParam(r, "key")
+		if err := s.urlRepo.CheckURLOwner(r.Context(), user, key); err != nil {
+			return updateError(err)
+		}
+		link, err := s.urlRepo.GetURL(r.Context(), key)
+		if errors.Is(err, model.ErrClicksExhausted) {
+			return newAPIError(http.StatusGone, codeClicksExhausted, "url clicks are exhausted")
+		}
+		if err != nil {
+			return updateError(err)
+		}
+		if link.PasswordHash == "" {
+			return newAPIError(http.StatusBadRequest, codeBadRequest, "url has no password")
+		}
+
+		expires := time.Now().Add(accessTokenTTL).UTC().Truncate(time.Second)
+		token := linkToken(s, accessPurpose(link), key, expires)
+		query := url.Values{linkTokenParam: {token}}
+		return writeJSON(w, http.StatusCreated, accessTokenSchema{
+			Token:     token,
+			ShortURL:  fmt.Sprintf(s.cfg.ResSrvAdr+"/%s?%s", key, query.Encode()),
+			ExpiresAt: expires,
+		})
+	})
+}
+
+// acceptsHTML сообщает, что запрос пришел из браузера.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+var passwordPrompt = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head><meta charset="utf-8"><title>Ссылка защищена паролем</title></head>
+<body>
+<form method="post">
+<p>Ссылка защищена паролем.</p>
+{{if .}}<p role="alert">{{.}}</p>{{end}}
+<input type="password" name="password" autofocus required>
+<button type="submit">Открыть</button>
+</form>
+</body>
+</html>
+`))
+
+// writePasswordPrompt отдает форму ввода пароля. Форма отправляется POST запросом на адрес ссылки.
+func writePasswordPrompt(w http.ResponseWriter, status int, message string) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	return passwordPrompt.Execute(w, message)
+}
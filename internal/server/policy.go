@@ -0,0 +1,49 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/policy"
+)
+
+// checkURL нормализует ссылку и проверяет ее по политике доменов.
+func checkURL(s *Server, raw string) (string, error) {
+	ourl, err := s.normalizer.Normalize(raw)
+	if err != nil {
+		return "", err
+	}
+	if err := s.policy.Check(ourl); err != nil {
+		return "", err
+	}
+	return ourl, nil
+}
+
+// checkError возвращает ошибку 422 для ссылок, запрещенных политикой, и 400 для невалидных.
+func checkError(err error) *apiError {
+	var rejected *policy.RejectedError
+	if errors.As(err, &rejected) {
+		return newAPIError(http.StatusUnprocessableEntity, codeURLRejected, err.Error())
+	}
+	return newAPIError(http.StatusBadRequest, codeInvalidURL, err.Error())
+}
+
+// policyWorker перечитывает файл политики при его изменении.
+func policyWorker(s *Server) {
+	if s.cfg.PolicyReload <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.cfg.PolicyReload)
+	defer ticker.Stop()
+	for range ticker.C {
+		reloaded, err := s.policy.Reload()
+		if err != nil {
+			s.logger.Errorw("Can't reload policy", "error", err)
+			continue
+		}
+		if reloaded {
+			s.logger.Infow("Policy reloaded", "file", s.cfg.PolicyFile)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
+// previewSuffix - суффикс ключа, по которому вместо перехода открывается страница предпросмотра.
+const previewSuffix = "+"
+
+// previewParam - параметр запроса, по которому открывается страница предпросмотра.
+const previewParam = "preview"
+
+// confirmParam - параметр запроса кнопки "Перейти": подписанный сервером токен подтверждения,
+// с которым страница предпросмотра больше не показывается.
+const confirmParam = "confirm"
+
+// confirmTTL - сколько действует токен подтверждения перехода.
+const confirmTTL = 10 * time.Minute
+
+// previewKey возвращает ключ ссылки и признак запроса страницы предпросмотра:
+// ключ с суффиксом "+" или параметр preview=1.
+func previewKey(r *http.Request, key string) (string, bool) {
+	if trimmed, ok := strings.CutSuffix(key, previewSuffix); ok {
+		return trimmed, true
+	}
+	return key, r.URL.Query().Get(previewParam) == "1"
+}
+
+// needsInterstitial сообщает, что перед переходом нужно показать страницу предпросмотра:
+// она включена для ссылки или для всех ссылок, переход не подтвержден токеном
+// со страницы предпросмотра и домен ссылки не входит в список разрешенных.
+func needsInterstitial(s *Server, r *http.Request, url *model.URL, target string) bool {
+	if !s.cfg.Interstitial && !url.Interstitial {
+		return false
+	}
+	if validLinkToken(s, tokenConfirm, url.Key, r.URL.Query().Get(confirmParam)) {
+		return false
+	}
+	for _, domain := range s.cfg.PreviewAllow {
+		if model.MatchDomain(target, strings.TrimSpace(domain)) {
+			return false
+		}
+	}
+	return true
+}
+
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Переход по короткой ссылке</title></head>
+<body>
+<p>Короткая ссылка ведет на:</p>
+<p><code>{{.Target}}</code></p>
+<p>Ссылка создана {{.CreatedAt}}.</p>
+{{if .Password}}<form method="post" action="{{.Continue}}">
+<input type="hidden" name="password" value="{{.Password}}">
+<button type="submit">Перейти</button>
+</form>{{else}}<p><a href="{{.Continue}}" rel="noreferrer">Перейти</a></p>{{end}}
+</body>
+</html>
+`))
+
+// previewData - данные страницы предпросмотра.
+type previewData struct {
+	Target    string
+	CreatedAt string
+	Continue  string
+	Password  string
+}
+
+// writePreview отдает страницу предпросмотра с исходной ссылкой, датой создания и кнопкой перехода.
+// Кнопка ведет на короткую ссылку с токеном подтверждения, поэтому переход проходит все проверки
+// и учитывается как обычный. Параметры посетителя сохраняются для шаблона ссылки.
+// Пароль уже проверен, он передается кнопкой в скрытом поле формы, чтобы не вводить его повторно.
+func writePreview(s *Server, w http.ResponseWriter, r *http.Request, link *model.URL, target string) error {
+	query := r.URL.Query()
+	query.Del(previewParam)
+	query.Del(linkPasswordParam)
+	query.Set(confirmParam, linkToken(s, tokenConfirm, link.Key, time.Now().Add(confirmTTL)))
+	next := url.URL{Path: "/" + link.Key, RawQuery: query.Encode()}
+
+	data := previewData{
+		Target:    target,
+		CreatedAt: link.CreatedAt.UTC().Format(time.DateOnly),
+		Continue:  next.String(),
+	}
+	if link.PasswordHash != "" {
+		data.Password = linkPassword(r)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	return previewPage.Execute(w, data)
+}
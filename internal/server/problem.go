@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// problemContentType - тип ответа с ошибкой по RFC 7807.
+const problemContentType = "application/problem+json"
+
+// problemTypePrefix - префикс URI типа ошибки, к нему добавляется код ошибки.
+const problemTypePrefix = "urn:shortener:problem:"
+
+// Коды ошибок. Коды входят в ответ и не меняются, на них могут опираться клиенты.
+const (
+	codeBadRequest         = "bad_request"
+	codeInvalidBody        = "invalid_body"
+	codeInvalidParameter   = "invalid_parameter"
+	codeUnsupportedContent = "unsupported_content_type"
+	codeUnknownFormat      = "unknown_format"
+	codeInvalidURL         = "invalid_url"
+	codeURLRejected        = "url_rejected"
+	codeUnauthorized       = "unauthorized"
+	codeForbidden          = "forbidden"
+	codeNotFound           = "not_found"
+	codeURLDeleted         = "url_deleted"
+	codeClicksExhausted    = "clicks_exhausted"
+	codeURLConflict        = "url_conflict"
+	codePasswordRequired   = "password_required"
+	codeWrongPassword      = "wrong_password"
+	codeRateLimited        = "rate_limited"
+	codePayloadTooLarge    = "payload_too_large"
+	codeInternal           = "internal_error"
+)
+
+// apiError - ошибка обработчика, которая отдается клиенту как application/problem+json.
+type apiError struct {
+	Status int    // Status - HTTP статус ответа.
+	Code   string // Code - код ошибки.
+	Detail string // Detail - описание ошибки для клиента.
+	Err    error  // Err - внутренняя причина, пишется только в лог.
+}
+
+func (e *apiError) Error() string {
+	if e.Err != nil {
+		return e.Detail + ": " + e.Err.Error()
+	}
+	return e.Detail
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+// newAPIError возвращает ошибку обработчика с заданным статусом и кодом.
+func newAPIError(status int, code string, detail string) *apiError {
+	return &apiError{Status: status, Code: code, Detail: detail}
+}
+
+// internalError возвращает ошибку 500. Причина пишется в лог, клиент видит только detail.
+func internalError(detail string, err error) *apiError {
+	return &apiError{Status: http.StatusInternalServerError, Code: codeInternal, Detail: detail, Err: err}
+}
+
+// problemSchema - тело ответа с ошибкой по RFC 7807.
+type problemSchema struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// apiHandler - обработчик, который не отвечает ошибкой сам, а возвращает ее.
+type apiHandler func(w http.ResponseWriter, r *http.Request) error
+
+// handle преобразует apiHandler в http.HandlerFunc.
+// Ошибка обработчика отдается через writeError, поэтому на запрос всегда уходит один ответ.
+func handle(s *Server, h apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &startedResponseWriter{ResponseWriter: w}
+		if err := h(sw, r); err != nil {
+			writeError(s, sw, r, err)
+		}
+	}
+}
+
+// writeError отвечает ошибкой в формате application/problem+json.
+// Ошибки, отличные от apiError, отдаются как 500 и пишутся в лог.
+// Если ответ уже начат, ошибка только пишется в лог.
+func writeError(s *Server, w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		apiErr = internalError("internal server error", err)
+	}
+
+	if sw, ok := w.(*startedResponseWriter); ok && sw.started {
+		requestLogger(s, r).Errorw("Can't complete response", "error", err)
+		return
+	}
+	if apiErr.Status >= http.StatusInternalServerError {
+		requestLogger(s, r).Errorw(apiErr.Detail, "error", apiErr.Err)
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	if err := json.NewEncoder(w).Encode(problemSchema{
+		Type:      problemTypePrefix + apiErr.Code,
+		Title:     http.StatusText(apiErr.Status),
+		Status:    apiErr.Status,
+		Detail:    apiErr.Detail,
+		Instance:  r.URL.Path,
+		Code:      apiErr.Code,
+		RequestID: w.Header().Get(requestIDHeader),
+	}); err != nil {
+		requestLogger(s, r).Errorw("Can't encode error response", "error", err)
+	}
+}
+
+// startedResponseWriter запоминает, что обработчик уже начал ответ.
+type startedResponseWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (sw *startedResponseWriter) WriteHeader(statusCode int) {
+	sw.started = true
+	sw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (sw *startedResponseWriter) Write(b []byte) (int, error) {
+	sw.started = true
+	return sw.ResponseWriter.Write(b)
+}
+
+// Unwrap дает http.ResponseController доступ к исходному http.ResponseWriter.
+func (sw *startedResponseWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
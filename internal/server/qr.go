@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/qr"
+)
+
+// getURLQR отдает QR-код короткой ссылки. Код доступен, пока по ссылке можно перейти.
+func getURLQR(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		key := chi.URLParam(r, "id")
+		_, err := s.urlRepo.GetURL(r.Context(), key)
+		if errors.Is(err, model.ErrIsDeleted) {
+			return newAPIError(http.StatusGone, codeURLDeleted, "url is deleted")
+		}
+		if errors.Is(err, model.ErrClicksExhausted) {
+			return newAPIError(http.StatusGone, codeClicksExhausted, "url clicks are exhausted")
+		}
+		if errors.Is(err, model.ErrNotFound) {
+			return newAPIError(http.StatusNotFound, codeNotFound, "Not found")
+		}
+		if err != nil {
+			return internalError("Can't get url", err)
+		}
+		return writeQR(s, w, r, key)
+	})
+}
+
+// getUserURLQR отдает QR-код ссылки пользователя, в том числе удаленной:
+// владелец может напечатать код заранее и восстановить ссылку позже.
+func getUserURLQR(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		key := chi.URLParam(r, "key")
+		if err := s.urlRepo.CheckURLOwner(r.Context(), user, key); err != nil {
+			return updateError(err)
+		}
+		return writeQR(s, w, r, key)
+	})
+}
+
+// writeQR рисует QR-код короткой ссылки по параметрам запроса.
+// Изображение зависит только от короткой ссылки и параметров, поэтому ETag
+// считается по ним, и повторный запрос с If-None-Match получает 304 без отрисовки.
+// ETag слабый: тело может быть сжато gzip, а тег у сжатого и исходного тела один.
+// Кеш обязан проверять код каждый раз, чтобы удаленная ссылка перестала отдаваться.
+func writeQR(s *Server, w http.ResponseWriter, r *http.Request, key string) error {
+	opt, err := qr.ParseOptions(r.URL.Query())
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidParameter, err.Error())
+	}
+
+	content := fmt.Sprintf(s.cfg.ResSrvAdr+"/%s", key)
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%d|%s", content, opt.Format, opt.Size, opt.Margin, opt.Level)))
+	etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	image, err := qr.Render(content, opt)
+	if errors.Is(err, qr.ErrTooSmall) {
+		return newAPIError(http.StatusBadRequest, codeInvalidParameter, err.Error())
+	}
+	if err != nil {
+		return internalError("Can't render qr code", err)
+	}
+
+	w.Header().Set("Content-Type", opt.ContentType())
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(image); err != nil {
+		requestLogger(s, r).Errorw("Can't write qr code", "error", err)
+	}
+	return nil
+}
+
+// etagMatch проверяет, есть ли etag в заголовке If-None-Match.
+// If-None-Match сравнивает теги слабо: признак W/ не учитывается.
+func etagMatch(header string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/ratelimit"
+)
+
+// Группы маршрутов с отдельными лимитами запросов.
+const (
+	rateGroupShorten  = "shorten"
+	rateGroupBatch    = "batch"
+	rateGroupRedirect = "redirect"
+	rateGroupUser     = "user"
+)
+
+func rateLimits(s *Server) map[string]ratelimit.Limit {
+	return map[string]ratelimit.Limit{
+		rateGroupShorten:  s.cfg.RateShorten,
+		rateGroupBatch:    s.cfg.RateBatch,
+		rateGroupRedirect: s.cfg.RateRedirect,
+		rateGroupUser:     s.cfg.RateUser,
+	}
+}
+
+// rateLimitMiddleware ограничивает частоту запросов группы маршрутов.
+// Запросы учитываются по IP адресу клиента, см. rateKey.
+// Если хранилище лимитов недоступно, запрос пропускается.
+func rateLimitMiddleware(s *Server, group string) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			limit := s.rateLimits[group]
+			if limit.Unlimited() {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			res, err := s.rateStore.Take(r.Context(), group+":"+rateKey(s, r), limit)
+			if err != nil {
+				requestLogger(s, r).Errorw("Can't check rate limit", "group", group, "error", err)
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(res.Reset.Seconds())))
+			if !res.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(res.RetryAfter.Seconds())))
+				writeError(s, w, r, newAPIError(http.StatusTooManyRequests, codeRateLimited, "too many requests"))
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateKey возвращает ключ, по которому учитываются запросы клиента.
+// Cookie пользователя не подписана и клиент может менять ее в каждом запросе,
+// поэтому ключом служит только IP адрес, см. clientIP.
+func rateKey(s *Server, r *http.Request) string {
+	return "ip:" + clientIP(s, r)
+}
+
+// clientIP возвращает адрес клиента. Для запроса не от доверенного прокси это адрес соединения.
+// За доверенными прокси адрес берется из X-Forwarded-For: адреса просматриваются справа налево,
+// доверенные прокси пропускаются, первый остальной адрес считается адресом клиента.
+// Левее него значения мог подставить сам клиент, поэтому они не используются.
+func clientIP(s *Server, r *http.Request) string {
+	host := remoteHost(r)
+	if !s.trustedProxy(host) {
+		return host
+	}
+	hops := make([]string, 0)
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		host = hops[i]
+		if !s.trustedProxy(host) {
+			return host
+		}
+	}
+	return host
+}
+
+// trustedProxy сообщает, что адрес входит в одну из подсетей TrustedProxies.
+func (s *Server) trustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, subnet := range s.trustedProxies {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
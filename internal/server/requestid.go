@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestIDHeader - заголовок с идентификатором запроса.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen - максимальная длина идентификатора, принятого от клиента.
+const maxRequestIDLen = 128
+
+// requestIDMiddleware берет идентификатор запроса из заголовка X-Request-ID или создает новый,
+// возвращает его в ответе и кладет в контекст логер запроса с этим идентификатором.
+func requestIDMiddleware(s *Server) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			id := r.Header.Get(requestIDHeader)
+			if !validRequestID(id) {
+				id = uuid.New().String()
+			}
+			w.Header().Set(requestIDHeader, id)
+
+			logger := s.logger.With("request_id", id)
+			if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+				logger = logger.With("trace_id", sc.TraceID().String())
+			}
+			ctx := log.NewContext(r.Context(), logger)
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// validRequestID проверяет, что идентификатор клиента можно безопасно писать в логи и заголовки.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestLogger возвращает логер запроса или логер сервера, если запрос прошел мимо middleware.
+func requestLogger(s *Server, r *http.Request) *log.Logger {
+	if l, ok := log.FromContext(r.Context()); ok {
+		return l
+	}
+	return s.logger
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
+func updateURL(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, codeBadRequest, "Can't read body")
+		}
+
+		var schema updateURLSchema
+		if err = json.Unmarshal(body, &schema); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidBody, "Can't unmarshal body")
+		}
+		ourl, err := checkURL(s, schema.OriginalURL)
+		if err != nil {
+			return checkError(err)
+		}
+
+		key := chi.URLParam(r, "key")
+		rev, err := s.urlRepo.UpdateURL(r.Context(), user, key, ourl)
+		if err != nil {
+			return updateError(err)
+		}
+
+		return writeRevision(s, w, key, rev)
+	})
+}
+
+func getURLRevisions(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		revisions, err := s.urlRepo.GetURLRevisions(r.Context(), user, chi.URLParam(r, "key"))
+		if err != nil {
+			return updateError(err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return json.NewEncoder(w).Encode(revisions)
+	})
+}
+
+// rollbackURL возвращает ссылке исходный адрес из выбранной редакции.
+// Откат не удаляет историю, а добавляет в нее новую редакцию.
+func rollbackURL(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		revision, err := strconv.Atoi(chi.URLParam(r, "revision"))
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidParameter, "invalid revision")
+		}
+
+		key := chi.URLParam(r, "key")
+		revisions, err := s.urlRepo.GetURLRevisions(r.Context(), user, key)
+		if err != nil {
+			return updateError(err)
+		}
+
+		var target *model.URLRevision
+		for i := range revisions {
+			if revisions[i].Revision == revision {
+				target = &revisions[i]
+			}
+		}
+		if target == nil {
+			return newAPIError(http.StatusNotFound, codeNotFound, "revision not found")
+		}
+
+		rev, err := s.urlRepo.UpdateURL(r.Context(), user, key, target.OriginalURL)
+		if err != nil {
+			return updateError(err)
+		}
+
+		return writeRevision(s, w, key, rev)
+	})
+}
+
+func writeRevision(s *Server, w http.ResponseWriter, key string, rev *model.URLRevision) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(revisionResponseSchema{
+		ShortURL:    fmt.Sprintf(s.cfg.ResSrvAdr+"/%s", key),
+		OriginalURL: rev.OriginalURL,
+		Revision:    rev.Revision,
+		CreatedAt:   rev.CreatedAt,
+	})
+}
+
+// updateError сопоставляет ошибку хранилища при изменении ссылки с ответом.
+func updateError(err error) *apiError {
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		return newAPIError(http.StatusNotFound, codeNotFound, "Not found")
+	case errors.Is(err, model.ErrIsDeleted):
+		return newAPIError(http.StatusGone, codeURLDeleted, "url is deleted")
+	case errors.Is(err, model.ErrConflict):
+		return newAPIError(http.StatusConflict, codeURLConflict, "url already exists")
+	default:
+		return internalError("Can't save data", err)
+	}
+}
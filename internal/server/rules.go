@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/rules"
+)
+
+// getURLRules возвращает правила перенаправления ссылки пользователя.
+func getURLRules(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		linkRules, err := s.urlRepo.GetURLRules(r.Context(), user, chi.URLParam(r, "key"))
+		if err != nil {
+			return updateError(err)
+		}
+		if linkRules == nil {
+			linkRules = []model.RedirectRule{}
+		}
+		return writeJSON(w, http.StatusOK, linkRules)
+	})
+}
+
+// setURLRules заменяет правила перенаправления ссылки пользователя целиком.
+// Пустой список удаляет правила. Целевые ссылки правил проходят ту же проверку,
+// что и сокращаемые ссылки.
+func setURLRules(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		var linkRules []model.RedirectRule
+		if err := json.NewDecoder(r.Body).Decode(&linkRules); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidBody, "Can't unmarshal body")
+		}
+		if err := rules.Validate(linkRules); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+		for i := range linkRules {
+			target, err := checkURL(s, linkRules[i].Target)
+			if err != nil {
+				apiErr := checkError(err)
+				apiErr.Detail = fmt.Sprintf("rule %d: %s", i+1, apiErr.Detail)
+				return apiErr
+			}
+			linkRules[i].Target = target
+		}
+		if linkRules == nil {
+			linkRules = []model.RedirectRule{}
+		}
+
+		if err := s.urlRepo.SetURLRules(r.Context(), user, chi.URLParam(r, "key"), linkRules); err != nil {
+			return updateError(err)
+		}
+		return writeJSON(w, http.StatusOK, linkRules)
+	})
+}
+
+// visitorVary - заголовки запроса, от которых зависит выбор ссылки по правилам и шаблону.
+const visitorVary = "User-Agent, Accept-Language"
+
+// varyOnVisitor отмечает, что ответ зависит от заголовков посетителя, чтобы кеши это учитывали.
+func varyOnVisitor(w http.ResponseWriter) {
+	if !slices.Contains(w.Header().Values("Vary"), visitorVary) {
+		w.Header().Add("Vary", visitorVary)
+	}
+}
+
+// redirectTarget выбирает ссылку для перехода. Первыми проверяются правила ссылки,
+// если ни одно не подошло - выбирается вариант ссылки с разделением трафика,
+// а для обычной ссылки переход идет на исходную ссылку.
+// Возвращает номер выбранного варианта или -1, если ссылка выбрана не из вариантов.
+func redirectTarget(w http.ResponseWriter, r *http.Request, url *model.URL) (string, int) {
+	if len(url.Rules) > 0 {
+		varyOnVisitor(w)
+		if target, ok := rules.Match(url.Rules, r, time.Now()); ok {
+			return target, -1
+		}
+	}
+	if len(url.Variants) > 0 {
+		variant := chooseVariant(w, r, url)
+		return url.Variants[variant].URL, variant
+	}
+	return url.OriginalURL, -1
+}
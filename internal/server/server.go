@@ -2,14 +2,22 @@
 package server
 
 import (
+	"context"
+	"net"
 	"net/http"
-	"net/http/pprof"
 	"strings"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/log"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/metrics"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/normalizer"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/pkg/config"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/policy"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/ratelimit"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -19,66 +27,146 @@ type Config struct {
 	URLRepo model.URLRepository // URLRepo - интерфейс хранилища.
 	Cfg     *config.Config      // Cfg - параметры создания сервера.
 	Logger  *log.Logger         // Logger - логгер сервера.
+	Policy  *policy.Policy      // Policy - политика доменов, если не задана, разрешены все.
+	// RateStore - хранилище лимитов запросов, если не задано, лимиты хранятся в памяти.
+	RateStore ratelimit.Store
+	// Metrics - метрики сервера, если не заданы, создаются новые.
+	Metrics *metrics.Metrics
+	// TracerProvider - источник трассировки, если не задан, используется глобальный.
+	TracerProvider trace.TracerProvider
 }
 
 type delURL struct {
+	ctx  context.Context
 	user string
 	keys []string
 }
 
 // Server содержит данные для запуска и работы сервера.
 type Server struct {
-	urlRepo  model.URLRepository
-	cfg      *config.Config
-	logger   *log.Logger
-	user     string
-	deleteCh chan delURL
+	urlRepo    model.URLRepository
+	cfg        *config.Config
+	logger     *log.Logger
+	normalizer *normalizer.Normalizer
+	policy     *policy.Policy
+	rateStore  ratelimit.Store
+	rateLimits map[string]ratelimit.Limit
+	metrics    *metrics.Metrics
+	tracer     trace.Tracer
+	deleteCh   chan delURL
+	// delWorkerStarted - фоновое удаление запущено.
+	delWorkerStarted atomic.Bool
+	// delWorkerBusySince - время (UnixNano), с которого фоновое удаление обрабатывает пачку ключей,
+	// 0 - ожидает следующую пачку. По нему /readyz находит зависшее удаление.
+	delWorkerBusySince atomic.Int64
+	// signKey - ключ подписи токенов ссылок: подтверждения перехода и доступа к ссылке с паролем.
+	signKey []byte
+	// trustedProxies - подсети прокси, которым доверяется X-Forwarded-For.
+	trustedProxies []*net.IPNet
 }
 
 // New создает и возвращает новый сервер.
 func New(c Config) *Server {
 	deleteCh := make(chan delURL)
-	return &Server{
-		urlRepo:  c.URLRepo,
-		cfg:      c.Cfg,
-		logger:   c.Logger,
-		deleteCh: deleteCh,
+	pol := c.Policy
+	if pol == nil {
+		pol = new(policy.Policy)
 	}
+	rateStore := c.RateStore
+	if rateStore == nil {
+		rateStore = ratelimit.NewMemoryStore()
+	}
+	m := c.Metrics
+	if m == nil {
+		m = metrics.New()
+	}
+	tp := c.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	s := &Server{
+		urlRepo: c.URLRepo,
+		cfg:     c.Cfg,
+		logger:  c.Logger,
+		normalizer: normalizer.New(normalizer.Config{
+			AllowedSchemes:  c.Cfg.AllowedSchemes,
+			SortQueryParams: c.Cfg.SortQueryParams,
+		}),
+		policy:    pol,
+		rateStore: rateStore,
+		metrics:   m,
+		tracer:    tp.Tracer("github.com/winkor4/taktaev-yandex-dev-uri.git/internal/server"),
+		deleteCh:  deleteCh,
+	}
+	s.rateLimits = rateLimits(s)
+	s.signKey = newSignKey(c.Cfg.LinkSecret)
+	for _, proxy := range c.Cfg.TrustedProxies {
+		// Подсети проверяются при разборе конфигурации.
+		if _, subnet, err := net.ParseCIDR(proxy); err == nil {
+			s.trustedProxies = append(s.trustedProxies, subnet)
+		}
+	}
+	return s
 }
 
-// Run запускает сервер.
+// Run запускает сервер и, если задан адрес, служебный сервер.
+// Возвращает ошибку того сервера, который остановился первым.
 func (s *Server) Run() error {
 	go s.Workers()
-	s.logger.Logw(s.cfg.LogLevel, "Starting server", "SrvAdr", s.cfg.SrvAdr)
-	return http.ListenAndServe(s.cfg.SrvAdr, SrvRouter(s))
+
+	errCh := make(chan error, 2)
+	if s.cfg.AdminAdr != "" {
+		go func() {
+			s.logger.Logw(s.cfg.LogLevel, "Starting admin server", "AdminAdr", s.cfg.AdminAdr)
+			errCh <- http.ListenAndServe(s.cfg.AdminAdr, AdminRouter(s))
+		}()
+	}
+	go func() {
+		s.logger.Logw(s.cfg.LogLevel, "Starting server", "SrvAdr", s.cfg.SrvAdr)
+		errCh <- http.ListenAndServe(s.cfg.SrvAdr, SrvRouter(s))
+	}()
+
+	return <-errCh
 }
 
 // Workers запускает фоновые обработчики.
 func (s *Server) Workers() {
+	s.delWorkerStarted.Store(true)
 	go delWorker(s)
+	go purgeWorker(s)
+	go policyWorker(s)
 }
 
 // SrvRouter возвращает описание (handler) сервера для запуска
 func SrvRouter(s *Server) *chi.Mux {
 	r := chi.NewRouter()
-	r.Use(authorizationMiddleware(s), gzipMiddleware, logMiddleware(s))
+	r.Use(
+		metricsMiddleware(s),
+		tracingMiddleware(s),
+		requestIDMiddleware(s),
+		authorizationMiddleware(s),
+		gzipMiddleware,
+		logMiddleware(s),
+		validateMiddleware(s),
+	)
 
-	r.Post("/", checkContentTypeMiddleware(shortURL(s), "text/plain"))
-	r.Get("/{id}", getURL(s))
+	r.With(rateLimitMiddleware(s, rateGroupShorten)).
+		Post("/", checkContentTypeMiddleware(s, shortURL(s), "text/plain"))
+	r.With(rateLimitMiddleware(s, rateGroupRedirect)).Get("/{id}", getURL(s))
+	r.With(rateLimitMiddleware(s, rateGroupRedirect)).Post("/{id}", postURLPassword(s))
+	r.With(rateLimitMiddleware(s, rateGroupRedirect)).Get("/{id}/qr", getURLQR(s))
 	r.Get("/ping", pingDB(s))
+	r.Get("/healthz", healthz(s))
+	r.Get("/readyz", readyz(s, false))
 	r.Mount("/api", apiRouter(s))
-
-	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	r.HandleFunc("/debug/pprof/", pprof.Index)
-	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	r.Mount("/api/v2", apiV2Router(s))
 
 	return r
 }
 
 func apiRouter(s *Server) *chi.Mux {
 	r := chi.NewRouter()
+	r.Get("/openapi.json", openAPI(s))
 	r.Mount("/shorten", apiShortenRouter(s))
 	r.Mount("/user", apiUserRouter(s))
 	return r
@@ -86,19 +174,37 @@ func apiRouter(s *Server) *chi.Mux {
 
 func apiShortenRouter(s *Server) *chi.Mux {
 	r := chi.NewRouter()
-	r.Post("/", checkContentTypeMiddleware(shortURL(s), "application/json"))
-	r.Post("/batch", checkContentTypeMiddleware(shortBatch(s), "application/json"))
+	r.With(rateLimitMiddleware(s, rateGroupShorten)).
+		Post("/", checkContentTypeMiddleware(s, shortURL(s), "application/json"))
+	r.With(rateLimitMiddleware(s, rateGroupBatch)).
+		Post("/batch", checkContentTypeMiddleware(s, shortBatch(s), "application/json"))
+	r.With(rateLimitMiddleware(s, rateGroupBatch)).
+		Post("/stream", checkContentTypeMiddleware(s, shortenStream(s), "application/x-ndjson"))
 	return r
 }
 
 func apiUserRouter(s *Server) *chi.Mux {
 	r := chi.NewRouter()
+	r.Use(rateLimitMiddleware(s, rateGroupUser))
 	r.Get("/urls", getUsersURL(s))
-	r.Delete("/urls", checkContentTypeMiddleware(deleteURL(s), "application/json"))
+	r.Delete("/urls", checkContentTypeMiddleware(s, deleteURL(s), "application/json"))
+	r.Post("/urls/restore", checkContentTypeMiddleware(s, restoreURL(s), "application/json"))
+	r.Get("/urls/export", exportUsersURL(s))
+	r.Post("/urls/import", importUsersURL(s))
+	r.Patch("/urls/{key}", checkContentTypeMiddleware(s, updateURL(s), "application/json"))
+	r.Get("/urls/{key}/revisions", getURLRevisions(s))
+	r.Get("/urls/{key}/rules", getURLRules(s))
+	r.Put("/urls/{key}/rules", checkContentTypeMiddleware(s, setURLRules(s), "application/json"))
+	r.Get("/urls/{key}/stats", getURLStats(s))
+	r.Get("/urls/{key}/qr", getUserURLQR(s))
+	r.Post("/urls/{key}/access-token", createAccessToken(s))
+	r.Get("/urls/{key}/template", getURLTemplate(s))
+	r.Put("/urls/{key}/template", checkContentTypeMiddleware(s, setURLTemplate(s), "application/json"))
+	r.Post("/urls/{key}/revisions/{revision}/rollback", rollbackURL(s))
 	return r
 }
 
-func checkContentTypeMiddleware(h http.HandlerFunc, exContentType string) http.HandlerFunc {
+func checkContentTypeMiddleware(s *Server, h http.HandlerFunc, exContentType string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		contentType := r.Header.Get("Content-Type")
 		if strings.Contains(contentType, "application/x-gzip") {
@@ -108,7 +214,7 @@ func checkContentTypeMiddleware(h http.HandlerFunc, exContentType string) http.H
 		}
 
 		if !strings.Contains(contentType, exContentType) {
-			http.Error(w, "unexpected Content-Type", http.StatusBadRequest)
+			writeError(s, w, r, newAPIError(http.StatusBadRequest, codeUnsupportedContent, "unexpected Content-Type"))
 			return
 		}
 		h(w, r)
@@ -121,7 +227,8 @@ func authorizationMiddleware(s *Server) func(h http.Handler) http.Handler {
 
 			user, err := parseUser(r, true)
 			if err != nil {
-				http.Error(w, "can't get cookie", http.StatusBadRequest)
+				writeError(s, w, r, newAPIError(http.StatusBadRequest, codeBadRequest, "can't get cookie"))
+				return
 			}
 
 			http.SetCookie(w, &http.Cookie{
@@ -129,13 +236,23 @@ func authorizationMiddleware(s *Server) func(h http.Handler) http.Handler {
 				Value: user,
 			})
 
-			s.user = user
-
-			h.ServeHTTP(w, r)
+			ctx := log.NewContext(r.Context(), requestLogger(s, r).With("user_id", user))
+			ctx = context.WithValue(ctx, userCtxKey{}, user)
+			h.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+// userCtxKey - ключ контекста для пользователя запроса.
+type userCtxKey struct{}
+
+// requestUser возвращает пользователя, которого authorizationMiddleware определил
+// по cookie или создал для запроса.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userCtxKey{}).(string)
+	return user
+}
+
 func parseUser(r *http.Request, createNew bool) (string, error) {
 
 	var user string
@@ -156,3 +273,16 @@ func parseUser(r *http.Request, createNew bool) (string, error) {
 
 	return user, nil
 }
+
+// authorizedUser возвращает пользователя из cookie запроса.
+// Если пользователь не определен, возвращает ошибку для ответа.
+func authorizedUser(r *http.Request) (string, error) {
+	user, err := parseUser(r, false)
+	if err != nil {
+		if err == http.ErrNoCookie {
+			return "", newAPIError(http.StatusUnauthorized, codeUnauthorized, "unauthorized user")
+		}
+		return "", newAPIError(http.StatusBadRequest, codeBadRequest, "can't parse cookie")
+	}
+	return user, nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
+// maxVariants - наибольшее количество вариантов у ссылки с разделением трафика.
+const maxVariants = 10
+
+// maxVariantWeight - наибольший вес варианта. Сумма весов всех вариантов
+// не переполняет int и подходит для rand.Intn.
+const maxVariantWeight = 10000
+
+// splitCookiePrefix - префикс cookie, в которой за посетителем закреплен вариант ссылки.
+// Cookie своя у каждой ссылки, а ее путь - весь сайт: ключ с суффиксом + для предпросмотра
+// не совпадает с путем ссылки, и предпросмотр должен показывать тот же вариант, что и переход.
+const splitCookiePrefix = "split_"
+
+// splitCookieMaxAge - срок, на который за посетителем закрепляется вариант.
+const splitCookieMaxAge = 30 * 24 * time.Hour
+
+// checkVariants проверяет варианты ссылки и приводит их адреса к каноничному виду.
+func checkVariants(s *Server, variants []model.URLVariant) ([]model.URLVariant, error) {
+	if len(variants) == 0 {
+		return nil, nil
+	}
+	if len(variants) < 2 {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidBody, "split link needs at least 2 variants")
+	}
+	if len(variants) > maxVariants {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidBody,
+			fmt.Sprintf("split link has more than %d variants", maxVariants))
+	}
+	checked := make([]model.URLVariant, len(variants))
+	for i, variant := range variants {
+		if variant.Weight < 1 {
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidBody,
+				fmt.Sprintf("variant %d: weight must be positive", i+1))
+		}
+		if variant.Weight > maxVariantWeight {
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidBody,
+				fmt.Sprintf("variant %d: weight must not exceed %d", i+1, maxVariantWeight))
+		}
+		target, err := checkURL(s, variant.URL)
+		if err != nil {
+			apiErr := checkError(err)
+			apiErr.Detail = fmt.Sprintf("variant %d: %s", i+1, apiErr.Detail)
+			return nil, apiErr
+		}
+		checked[i] = model.URLVariant{URL: target, Weight: variant.Weight}
+	}
+	return checked, nil
+}
+
+// chooseVariant выбирает вариант ссылки для посетителя и закрепляет его в cookie.
+// Посетитель с cookie получает тот же вариант, остальные - случайный по весам.
+func chooseVariant(w http.ResponseWriter, r *http.Request, url *model.URL) int {
+	name := splitCookiePrefix + url.Key
+	if cookie, err := r.Cookie(name); err == nil {
+		if variant, err := strconv.Atoi(cookie.Value); err == nil && variant >= 0 && variant < len(url.Variants) {
+			return variant
+		}
+	}
+
+	variant := weightedVariant(url.Variants)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    strconv.Itoa(variant),
+		Path:     "/",
+		MaxAge:   int(splitCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return variant
+}
+
+// weightedVariant возвращает случайный вариант с вероятностью, пропорциональной весу.
+func weightedVariant(variants []model.URLVariant) int {
+	total := 0
+	for _, variant := range variants {
+		total += variant.Weight
+	}
+	n := rand.Intn(total)
+	for i, variant := range variants {
+		if n < variant.Weight {
+			return i
+		}
+		n -= variant.Weight
+	}
+	return len(variants) - 1
+}
+
+// getURLStats возвращает переходы на варианты ссылки пользователя.
+// Переходы учитываются только для ссылок с разделением трафика.
+func getURLStats(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		key := chi.URLParam(r, "key")
+		stats, err := s.urlRepo.GetURLVariantStats(r.Context(), user, key)
+		if err != nil {
+			return updateError(err)
+		}
+		if stats == nil {
+			stats = []model.VariantStats{}
+		}
+		return writeJSON(w, http.StatusOK, linkStatsSchema{
+			ShortURL: fmt.Sprintf(s.cfg.ResSrvAdr+"/%s", key),
+			Variants: stats,
+		})
+	})
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
+// streamChunkSize - количество ссылок, которые сохраняются в хранилище за один вызов.
+const streamChunkSize = 100
+
+// shortenStream сокращает ссылки из тела в формате NDJSON по мере чтения.
+// Ссылки сохраняются пачками по streamChunkSize, результат каждой пишется в ответ
+// отдельной строкой сразу после сохранения ее пачки, поэтому память не зависит от размера загрузки.
+// Строки, которые не удалось разобрать, отдаются со статусом invalid.
+func shortenStream(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+		rc := http.NewResponseController(w)
+		// Ответ пишется до конца чтения тела.
+		_ = rc.EnableFullDuplex()
+
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		enc := json.NewEncoder(w)
+		user := requestUser(r)
+
+		started := false
+		items := make([]batchItem, 0, streamChunkSize)
+		flush := func() error {
+			if len(items) == 0 {
+				return nil
+			}
+			shortenBatch(s, r, user, items)
+			if !started {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				w.WriteHeader(http.StatusOK)
+				started = true
+			}
+			for _, item := range items {
+				if err := enc.Encode(newBatchResponse(s, item)); err != nil {
+					return fmt.Errorf("write stream: %w", err)
+				}
+			}
+			items = items[:0]
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return fmt.Errorf("flush stream: %w", err)
+			}
+			return nil
+		}
+
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var url model.URL
+			if err := json.Unmarshal([]byte(line), &url); err != nil {
+				items = append(items, batchItem{
+					Status: batchStatusInvalid,
+					Error:  fmt.Sprintf("can't unmarshal row %d", n),
+				})
+			} else {
+				items = append(items, batchItem{CorrelationID: url.CorrelationID, URL: url})
+			}
+			if len(items) == streamChunkSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			// Уже сохраненные пачки остаются сохраненными, клиент видит их строки в ответе.
+			if started {
+				return fmt.Errorf("read stream: %w", err)
+			}
+			return newAPIError(http.StatusBadRequest, codeInvalidBody, "Can't read body")
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+		}
+		return nil
+	})
+}
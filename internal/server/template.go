@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/urltemplate"
+)
+
+// getURLTemplate возвращает шаблон параметров запроса ссылки пользователя.
+func getURLTemplate(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		tpl, err := s.urlRepo.GetURLTemplate(r.Context(), user, chi.URLParam(r, "key"))
+		if err != nil {
+			return updateError(err)
+		}
+		if tpl == nil {
+			tpl = &model.RedirectTemplate{}
+		}
+		return writeJSON(w, http.StatusOK, tpl)
+	})
+}
+
+// setURLTemplate заменяет шаблон параметров запроса ссылки пользователя.
+// Пустой шаблон удаляет его.
+func setURLTemplate(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		tpl := new(model.RedirectTemplate)
+		if err := json.NewDecoder(r.Body).Decode(tpl); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidBody, "Can't unmarshal body")
+		}
+		if err := urltemplate.Validate(tpl); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+
+		stored := tpl
+		if tpl.Empty() {
+			stored = nil
+		}
+		if err := s.urlRepo.SetURLTemplate(r.Context(), user, chi.URLParam(r, "key"), stored); err != nil {
+			return updateError(err)
+		}
+		return writeJSON(w, http.StatusOK, tpl)
+	})
+}
+
+// applyTemplate добавляет к выбранной ссылке параметры по шаблону ссылки.
+// Пароль и токен доступа ссылки и параметры предпросмотра никогда не передаются дальше.
+func applyTemplate(w http.ResponseWriter, r *http.Request, url *model.URL, target string) (string, error) {
+	if url.Template.Empty() {
+		return target, nil
+	}
+	if len(url.Template.Params) > 0 {
+		// Плейсхолдеры {device} и {lang} зависят от заголовков посетителя.
+		varyOnVisitor(w)
+	}
+	query := r.URL.Query()
+	query.Del(linkPasswordParam)
+	query.Del(linkTokenParam)
+	query.Del(previewParam)
+	query.Del(confirmParam)
+	return urltemplate.Apply(target, url.Template, query, urltemplate.Vars(r, url.Key))
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Назначения токенов ссылок. Назначение входит в подпись, поэтому токен одного вида
+// не принимается вместо другого.
+const (
+	tokenConfirm = "confirm"
+	tokenAccess  = "access"
+)
+
+// newSignKey возвращает ключ подписи токенов ссылок. Без заданного секрета ключ случайный:
+// токены не переживают перезапуск и не принимаются другими экземплярами сервиса.
+func newSignKey(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+	key := make([]byte, sha256.Size)
+	_, _ = rand.Read(key)
+	return key
+}
+
+// linkToken возвращает токен назначения purpose для ссылки key, действующий до expires:
+// время истечения и HMAC назначения, ключа ссылки и этого времени.
+func linkToken(s *Server, purpose string, key string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + linkSign(s, purpose, key, exp)
+}
+
+func linkSign(s *Server, purpose string, key string, exp string) string {
+	mac := hmac.New(sha256.New, s.signKey)
+	mac.Write([]byte(purpose + "|" + key + "|" + exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validLinkToken проверяет, что токен выдан сервером с назначением purpose для ссылки key
+// и еще не истек.
+func validLinkToken(s *Server, purpose string, key string, token string) bool {
+	exp, sign, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(sign), []byte(linkSign(s, purpose, key, exp)))
+}
@@ -3,57 +3,90 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/pkg/config"
 
 	"github.com/go-chi/chi/v5"
 )
 
 func shortURL(s *Server) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
 
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, "Can't read body", http.StatusBadRequest)
-			return
+			return newAPIError(http.StatusBadRequest, codeBadRequest, "Can't read body")
 		}
 
 		contentType := r.Header.Get("Content-Type")
 
-		user := s.user
+		user := requestUser(r)
 
-		var ourl string
+		var ourl, password string
+		var maxClicks int
+		var variants []model.URLVariant
+		var redirectStatus int
+		var interstitial bool
 		switch {
 		case strings.Contains(contentType, "application/json"):
 			var schema urlSchema
 			if err = json.Unmarshal(body, &schema); err != nil {
-				http.Error(w, "Can't unmarshal body", http.StatusBadRequest)
-				return
+				return newAPIError(http.StatusBadRequest, codeInvalidBody, "Can't unmarshal body")
 			}
 			ourl = schema.URL
+			password = schema.Password
+			maxClicks = schema.MaxClicks
+			variants = schema.Variants
+			redirectStatus = schema.RedirectStatus
+			interstitial = schema.Interstitial
 			contentType = "application/json"
 		case strings.Contains(contentType, "text/plain"):
 			ourl = string(body)
 			contentType = "text/plain"
 		}
 
-		if ourl == "" {
-			http.Error(w, "URL parameter is missing", http.StatusBadRequest)
-			return
+		ourl, err = checkURL(s, ourl)
+		if err != nil {
+			return checkError(err)
+		}
+		passwordHash, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+		if err := checkMaxClicks(maxClicks); err != nil {
+			return err
+		}
+		variants, err = checkVariants(s, variants)
+		if err != nil {
+			return err
+		}
+		if err := checkRedirectStatus(redirectStatus); err != nil {
+			return err
 		}
 
 		urls := make([]model.URL, 1)
-		urls[0].Key = model.ShortKey(ourl)
 		urls[0].OriginalURL = ourl
 		urls[0].UserID = user
-
-		err = s.urlRepo.SaveURL(urls)
+		urls[0].PasswordHash = passwordHash
+		urls[0].MaxClicks = maxClicks
+		urls[0].Variants = variants
+		urls[0].RedirectStatus = redirectStatus
+		urls[0].Interstitial = interstitial
+		urls[0].Key = model.NewKey(&urls[0])
+
+		err = s.urlRepo.SaveURL(r.Context(), urls)
 		if err != nil {
-			http.Error(w, "Can't save data", http.StatusInternalServerError)
+			return internalError("Can't save data", err)
+		}
+		if urls[0].Err != nil {
+			return internalError("Can't save data", urls[0].Err)
 		}
 
 		result := fmt.Sprintf(s.cfg.ResSrvAdr+"/%s", urls[0].Key)
@@ -69,108 +102,204 @@ func shortURL(s *Server) http.HandlerFunc {
 		case "application/json":
 			var resSchema responseSchema
 			resSchema.Result = result
-			if err = json.NewEncoder(w).Encode(resSchema); err != nil {
-				http.Error(w, "Can't encode response", http.StatusInternalServerError)
-				return
-			}
+			return json.NewEncoder(w).Encode(resSchema)
 		case "text/plain":
-			data := []byte(result)
-			_, err = w.Write(data)
-			if err != nil {
-				http.Error(w, "Can't write response", http.StatusInternalServerError)
-				return
-			}
+			_, err = w.Write([]byte(result))
+			return err
 		}
+		return nil
+	})
+}
+
+// checkMaxClicks проверяет ограничение числа переходов. 0 - без ограничения.
+func checkMaxClicks(maxClicks int) error {
+	if maxClicks < 0 {
+		return newAPIError(http.StatusBadRequest, codeInvalidBody, "max_clicks must not be negative")
 	}
+	return nil
 }
 
+// checkRedirectStatus проверяет код перенаправления ссылки. 0 - код из настроек сервера.
+func checkRedirectStatus(status int) error {
+	if status != 0 && !config.ValidRedirectStatus(status) {
+		return newAPIError(http.StatusBadRequest, codeInvalidBody, "redirect_status must be one of 301, 302, 307, 308")
+	}
+	return nil
+}
+
+// redirectCacheControl возвращает Cache-Control для перенаправления с кодом status.
+// Постоянное перенаправление браузеры и прокси иначе хранят бессрочно, поэтому
+// оно сохраняется только с обязательной перепроверкой: удаленная или исчерпанная
+// ссылка перестает открываться при следующем же переходе.
+// Временные перенаправления не сохраняются совсем, каждый переход доходит до сервера.
+func redirectCacheControl(status int) string {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+		return "no-cache"
+	default:
+		return "no-store"
+	}
+}
+
+// getURL перенаправляет на исходную ссылку с кодом ссылки или кодом из настроек сервера.
 func getURL(s *Server) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		key := chi.URLParam(r, "id")
-		url, err := s.urlRepo.GetURL(key)
-		if err == model.ErrIsDeleted {
-			w.WriteHeader(http.StatusGone)
-			return
+	return redirectURL(s, 0)
+}
+
+// postURLPassword открывает защищенную ссылку по паролю из формы.
+// Ответ 303, чтобы браузер перешел на исходную ссылку GET запросом.
+func postURLPassword(s *Server) http.HandlerFunc {
+	return redirectURL(s, http.StatusSeeOther)
+}
+
+// redirectURL перенаправляет на исходную ссылку с кодом status.
+// Если status равен 0, используется код ссылки, а для ссылки без своего кода - код из настроек.
+// Для ключа с суффиксом "+", параметра preview=1 и ссылок с обязательным предпросмотром
+// вместо перехода отдается страница предпросмотра.
+func redirectURL(s *Server, status int) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+		// Ошибки перехода не кешируются: восстановленная ссылка должна открыться сразу.
+		w.Header().Set("Cache-Control", "no-store")
+		key, preview := previewKey(r, chi.URLParam(r, "id"))
+		url, err := s.urlRepo.GetURL(r.Context(), key)
+		if errors.Is(err, model.ErrIsDeleted) {
+			s.metrics.ObserveRedirect(redirectDeleted)
+			return newAPIError(http.StatusGone, codeURLDeleted, "url is deleted")
+		}
+		if errors.Is(err, model.ErrClicksExhausted) {
+			s.metrics.ObserveRedirect(redirectExhausted)
+			return newAPIError(http.StatusGone, codeClicksExhausted, "url clicks are exhausted")
+		}
+		if errors.Is(err, model.ErrNotFound) {
+			s.metrics.ObserveRedirect(redirectNotFound)
+			return newAPIError(http.StatusBadRequest, codeNotFound, "Not found")
 		}
 		if err != nil {
-			http.Error(w, "Not found", http.StatusBadRequest)
+			return internalError("Can't get url", err)
 		}
-		http.Redirect(w, r, url.OriginalURL, http.StatusTemporaryRedirect)
-	}
+		// Пароль проверяется первым: без него ответ не должен раскрывать исходную ссылку.
+		if ok, err := unlockURL(s, w, r, url); !ok {
+			return err
+		}
+		target, variant := redirectTarget(w, r, url)
+		// Политика проверяется повторно, чтобы ссылки на домены, запрещенные
+		// после сокращения, перестали открываться.
+		if err := s.policy.Check(target); err != nil {
+			s.metrics.ObserveRedirect(redirectBlocked)
+			return newAPIError(http.StatusForbidden, codeURLRejected, err.Error())
+		}
+		target, err = applyTemplate(w, r, url, target)
+		if err != nil {
+			return internalError("Can't apply template", err)
+		}
+		// Страница предпросмотра показывает ту же ссылку, на которую ведет переход,
+		// и не списывает переходы.
+		if preview || needsInterstitial(s, r, url, target) {
+			s.metrics.ObserveRedirect(redirectPreview)
+			return writePreview(s, w, r, url, target)
+		}
+		// Переход списывается последним, чтобы отказы выше не расходовали переходы.
+		// Остаток уменьшается в хранилище атомарно, поэтому параллельные переходы
+		// не откроют ссылку больше MaxClicks раз.
+		if url.MaxClicks > 0 {
+			err := s.urlRepo.ConsumeClick(r.Context(), key)
+			if errors.Is(err, model.ErrClicksExhausted) {
+				s.metrics.ObserveRedirect(redirectExhausted)
+				return newAPIError(http.StatusGone, codeClicksExhausted, "url clicks are exhausted")
+			}
+			if errors.Is(err, model.ErrIsDeleted) {
+				s.metrics.ObserveRedirect(redirectDeleted)
+				return newAPIError(http.StatusGone, codeURLDeleted, "url is deleted")
+			}
+			if err != nil {
+				return internalError("Can't consume click", err)
+			}
+		}
+		if variant >= 0 {
+			// Переход уже состоялся, ошибка учета не должна его отменять.
+			if err := s.urlRepo.RecordVariantClick(r.Context(), key, variant); err != nil {
+				requestLogger(s, r).Errorw("Can't record variant click", "error", err)
+			}
+		}
+		s.metrics.ObserveRedirect(redirectFound)
+		code := status
+		if code == 0 {
+			code = url.RedirectStatus
+		}
+		if code == 0 {
+			code = s.cfg.RedirectStatus
+		}
+		if code == 0 {
+			code = http.StatusTemporaryRedirect
+		}
+		w.Header().Set("Cache-Control", redirectCacheControl(code))
+		http.Redirect(w, r, target, code)
+		return nil
+	})
 }
 
 func pingDB(s *Server) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := context.Background()
-		if err := s.urlRepo.PingDB(ctx); err != nil {
-			http.Error(w, "connection could't be established", http.StatusInternalServerError)
-			return
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+		if err := s.urlRepo.PingDB(r.Context()); err != nil {
+			return internalError("connection could't be established", err)
 		}
 		w.WriteHeader(http.StatusOK)
-	}
+		return nil
+	})
 }
 
 func shortBatch(s *Server) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+		urls, err := readBatch[model.URL](s, w, r)
 		if err != nil {
-			http.Error(w, "Can't read body", http.StatusBadRequest)
-			return
+			return err
 		}
 
-		user := s.user
-
-		urls := make([]model.URL, 0)
-		if err = json.Unmarshal(body, &urls); err != nil {
-			http.Error(w, "Can't unmarshal body", http.StatusBadRequest)
-			return
-		}
-
-		data := make([]batchResponseSchema, 0, len(urls))
+		items := make([]batchItem, len(urls))
 		for i, url := range urls {
-			urls[i].Key = model.ShortKey(url.OriginalURL)
-			urls[i].UserID = user
-			data = append(data, batchResponseSchema{
-				CorrelationID: url.CorrelationID,
-				ShortURL:      fmt.Sprintf(s.cfg.ResSrvAdr+"/%s", urls[i].Key),
-			})
+			items[i] = batchItem{CorrelationID: url.CorrelationID, URL: url}
 		}
+		sum := shortenBatch(s, r, requestUser(r), items)
 
-		err = s.urlRepo.SaveURL(urls)
-		if err != nil {
-			http.Error(w, "Can't save data", http.StatusInternalServerError)
+		data := make([]batchResponseSchema, len(items))
+		for i, item := range items {
+			data[i] = newBatchResponse(s, item)
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		if err := json.NewEncoder(w).Encode(data); err != nil {
-			http.Error(w, "Can't encode response", http.StatusInternalServerError)
-			return
-		}
+		// Статус каждой ссылки в ее строке, в том числе при ответах 207 и 422.
+		return writeJSON(w, batchStatus(sum, http.StatusCreated), data)
+	})
+}
+
+// saveURLs вычисляет ключи ссылок и сохраняет их от имени пользователя.
+// Признак Conflict проставляется хранилищем для каждой ссылки.
+func saveURLs(ctx context.Context, s *Server, user string, urls []model.URL) error {
+	for i := range urls {
+		urls[i].Key = model.NewKey(&urls[i])
+		urls[i].UserID = user
 	}
+	return s.urlRepo.SaveURL(ctx, urls)
 }
 
 func getUsersURL(s *Server) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
 
-		var user string
-		user, err := parseUser(r, false)
+		user, err := authorizedUser(r)
 		if err != nil {
-			if err == http.ErrNoCookie {
-				http.Error(w, "unauthorized user", http.StatusUnauthorized)
-				return
-			}
-			http.Error(w, "can't parse cookie", http.StatusBadRequest)
-			return
+			return err
+		}
+
+		if isPageRequest(r) {
+			return getUsersURLPage(s, w, r, user)
 		}
 
-		urls, err := s.urlRepo.GetUsersURL(user)
+		urls, err := s.urlRepo.GetUsersURL(r.Context(), user)
 		if err != nil {
-			http.Error(w, "can't get user's urls", http.StatusInternalServerError)
-			return
+			return internalError("can't get user's urls", err)
 		}
 		if len(urls) == 0 {
-			http.Error(w, "no content", http.StatusNoContent)
+			w.WriteHeader(http.StatusNoContent)
+			return nil
 		}
 
 		for i := range urls {
@@ -179,54 +308,189 @@ func getUsersURL(s *Server) http.HandlerFunc {
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(urls); err != nil {
-			http.Error(w, "Can't encode response", http.StatusInternalServerError)
-			return
+		return json.NewEncoder(w).Encode(urls)
+	})
+}
+
+// pageParams - параметры запроса, включающие постраничную выдачу.
+var pageParams = []string{"limit", "cursor", "sort", "q", "domain"}
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+func isPageRequest(r *http.Request) bool {
+	query := r.URL.Query()
+	for _, param := range pageParams {
+		if query.Has(param) {
+			return true
 		}
 	}
+	return false
 }
 
-func deleteURL(s *Server) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+func parseUserURLsFilter(r *http.Request) (model.UserURLsFilter, error) {
+	query := r.URL.Query()
+	filter := model.UserURLsFilter{
+		Limit:  defaultPageLimit,
+		Query:  query.Get("q"),
+		Domain: query.Get("domain"),
+	}
 
-		var user string
-		user, err := parseUser(r, false)
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		filter.Limit = limit
+	}
+
+	switch query.Get("sort") {
+	case "", "created_at":
+	case "-created_at":
+		filter.Desc = true
+	default:
+		return filter, errors.New("sort must be created_at or -created_at")
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := model.DecodeCursor(v)
 		if err != nil {
-			if err == http.ErrNoCookie {
-				http.Error(w, "unauthorized user", http.StatusUnauthorized)
-				return
-			}
-			http.Error(w, "can't parse cookie", http.StatusBadRequest)
-			return
+			return filter, err
 		}
+		filter.After = cursor
+	}
 
-		body, err := io.ReadAll(r.Body)
+	return filter, nil
+}
+
+func getUsersURLPage(s *Server, w http.ResponseWriter, r *http.Request, user string) error {
+	filter, err := parseUserURLsFilter(r)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidParameter, err.Error())
+	}
+
+	page, err := s.urlRepo.GetUsersURLPage(r.Context(), user, filter)
+	if err != nil {
+		return internalError("can't get user's urls", err)
+	}
+
+	data := userURLsPageSchema{
+		Items:      make([]userURLSchema, 0, len(page.URLs)),
+		Total:      page.Total,
+		NextCursor: model.EncodeCursor(page.Next),
+	}
+	for _, url := range page.URLs {
+		data.Items = append(data.Items, userURLSchema{
+			ShortURL:    fmt.Sprintf(s.cfg.ResSrvAdr+"/%s", url.Key),
+			OriginalURL: url.OriginalURL,
+			CreatedAt:   url.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(data)
+}
+
+func deleteURL(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
 		if err != nil {
-			http.Error(w, "Can't read body", http.StatusBadRequest)
-			return
+			return err
 		}
 
-		keys := make([]string, 0)
-		if err := json.Unmarshal(body, &keys); err != nil {
-			http.Error(w, "Can't unmarshal body", http.StatusBadRequest)
-			return
+		keys, err := readKeys(r)
+		if err != nil {
+			return err
 		}
 
 		var data delURL
+		// Удаление выполняется после ответа, поэтому контекст не должен отменяться вместе с запросом.
+		data.ctx = context.WithoutCancel(r.Context())
 		data.user = user
 		data.keys = keys
 		go putDelURL(s, data)
 
 		w.WriteHeader(http.StatusAccepted)
+		return nil
+	})
+}
+
+func restoreURL(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		keys, err := readKeys(r)
+		if err != nil {
+			return err
+		}
+
+		since := time.Now().Add(-s.cfg.DeleteRetention)
+		restored, err := s.urlRepo.RestoreURL(r.Context(), user, keys, since)
+		if err != nil {
+			return internalError("Can't restore data", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return json.NewEncoder(w).Encode(restoreResponseSchema{Restored: restored})
+	})
+}
+
+// readKeys читает из тела запроса JSON массив ключей ссылок.
+func readKeys(r *http.Request) ([]string, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeBadRequest, "Can't read body")
 	}
+
+	keys := make([]string, 0)
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidBody, "Can't unmarshal body")
+	}
+	return keys, nil
 }
 
 func putDelURL(s *Server, data delURL) {
+	s.metrics.DeleteQueued()
 	s.deleteCh <- data
 }
 
 func delWorker(s *Server) {
 	for data := range s.deleteCh {
-		s.urlRepo.DeleteURL(data.user, data.keys)
+		s.metrics.DeleteDequeued()
+		s.delWorkerBusySince.Store(time.Now().UnixNano())
+		s.urlRepo.DeleteURL(data.ctx, data.user, data.keys)
+		s.delWorkerBusySince.Store(0)
+	}
+}
+
+// purgeWorker периодически удаляет ссылки, срок восстановления которых истек.
+func purgeWorker(s *Server) {
+	if s.cfg.PurgeInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.cfg.PurgeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		purgeDeleted(s)
+	}
+}
+
+func purgeDeleted(s *Server) {
+	count, err := s.urlRepo.PurgeDeleted(context.Background(), time.Now().Add(-s.cfg.DeleteRetention))
+	if err != nil {
+		s.logger.Errorw("Can't purge deleted urls", "error", err)
+		return
+	}
+	if count > 0 {
+		s.logger.Infow("Purged deleted urls", "count", count)
 	}
 }
@@ -1,14 +1,168 @@
 package server
 
+import (
+	"time"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
 type urlSchema struct {
-	URL string `json:"url"`
+	URL       string `json:"url"`
+	Password  string `json:"password,omitempty"`   // Password - пароль для открытия ссылки.
+	MaxClicks int    `json:"max_clicks,omitempty"` // MaxClicks - сколько раз можно перейти по ссылке.
+	// Variants - варианты перехода для разделения трафика.
+	Variants []model.URLVariant `json:"variants,omitempty"`
+	// RedirectStatus - код перенаправления ссылки.
+	RedirectStatus int `json:"redirect_status,omitempty"`
+	// Interstitial - показывать страницу предпросмотра перед переходом.
+	Interstitial bool `json:"interstitial,omitempty"`
 }
 
 type responseSchema struct {
 	Result string `json:"result"`
 }
 
+// accessTokenSchema - токен доступа к ссылке с паролем.
+type accessTokenSchema struct {
+	Token     string    `json:"token"`
+	ShortURL  string    `json:"short_url"` // ShortURL - короткая ссылка с токеном.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 type batchResponseSchema struct {
 	CorrelationID string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
+	Status        string `json:"status"`
+	ShortURL      string `json:"short_url,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// exportSchema - ссылка пользователя при выгрузке и загрузке.
+// При загрузке short_url, created_at и deleted_at не переносятся, удаленные ссылки не загружаются.
+type exportSchema struct {
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Deleted     bool       `json:"deleted,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	// PasswordHash - bcrypt хеш пароля ссылки, сам пароль сервер не хранит.
+	PasswordHash   string                  `json:"password_hash,omitempty"`
+	MaxClicks      int                     `json:"max_clicks,omitempty"`
+	Variants       []model.URLVariant      `json:"variants,omitempty"`
+	RedirectStatus int                     `json:"redirect_status,omitempty"`
+	Interstitial   bool                    `json:"interstitial,omitempty"`
+	Rules          []model.RedirectRule    `json:"rules,omitempty"`
+	Template       *model.RedirectTemplate `json:"template,omitempty"`
+}
+
+type importRowSchema struct {
+	Row         int    `json:"row"`
+	OriginalURL string `json:"original_url"`
+	ShortURL    string `json:"short_url,omitempty"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+type importResponseSchema struct {
+	Created  int               `json:"created"`
+	Conflict int               `json:"conflict"`
+	Invalid  int               `json:"invalid"`
+	Failed   int               `json:"failed"`
+	Rows     []importRowSchema `json:"rows"`
+}
+
+type userURLSchema struct {
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type userURLsPageSchema struct {
+	Items      []userURLSchema `json:"items"`
+	Total      int             `json:"total"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+type updateURLSchema struct {
+	OriginalURL string `json:"original_url"`
+}
+
+type revisionResponseSchema struct {
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+	Revision    int       `json:"revision"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type restoreResponseSchema struct {
+	Restored []string `json:"restored"`
+}
+
+// healthCheckSchema - результат одной проверки готовности.
+type healthCheckSchema struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthResponseSchema - ответ /healthz и /readyz.
+type healthResponseSchema struct {
+	Status string                       `json:"status"`
+	Checks map[string]healthCheckSchema `json:"checks,omitempty"`
+}
+
+// linkSchema - ссылка в API v2.
+type linkSchema struct {
+	ID          string    `json:"id"`
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type linkRequestSchema struct {
+	OriginalURL string `json:"original_url"`
+	Password    string `json:"password,omitempty"`   // Password - пароль для открытия ссылки.
+	MaxClicks   int    `json:"max_clicks,omitempty"` // MaxClicks - сколько раз можно перейти по ссылке.
+	// Variants - варианты перехода для разделения трафика.
+	Variants []model.URLVariant `json:"variants,omitempty"`
+	// RedirectStatus - код перенаправления ссылки.
+	RedirectStatus int `json:"redirect_status,omitempty"`
+	// Interstitial - показывать страницу предпросмотра перед переходом.
+	Interstitial bool `json:"interstitial,omitempty"`
+}
+
+// linkStatsSchema - статистика переходов по ссылке.
+type linkStatsSchema struct {
+	ShortURL string               `json:"short_url"`
+	Variants []model.VariantStats `json:"variants"`
+}
+
+type batchLinkRequestSchema struct {
+	CorrelationID string `json:"correlation_id"`
+	OriginalURL   string `json:"original_url"`
+}
+
+// batchLinkSchema - результат сокращения одной ссылки пачки в API v2.
+type batchLinkSchema struct {
+	CorrelationID string      `json:"correlation_id"`
+	Status        string      `json:"status"`
+	Link          *linkSchema `json:"link,omitempty"`
+	Error         string      `json:"error,omitempty"`
+}
+
+// batchSummarySchema - количество ссылок пачки в каждом статусе.
+type batchSummarySchema struct {
+	Created int `json:"created"`
+	Exists  int `json:"exists"`
+	Invalid int `json:"invalid"`
+	Failed  int `json:"failed"`
+}
+
+type batchLinksResponseSchema struct {
+	Items   []batchLinkSchema  `json:"items"`
+	Summary batchSummarySchema `json:"summary"`
+}
+
+type linksPageSchema struct {
+	Items      []linkSchema `json:"items"`
+	Total      int          `json:"total"`
+	NextCursor string       `json:"next_cursor,omitempty"`
 }
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
+// apiV2Router - API v2. Ответы v1 не меняются, исправления формата делаются здесь.
+func apiV2Router(s *Server) *chi.Mux {
+	r := chi.NewRouter()
+	r.With(rateLimitMiddleware(s, rateGroupShorten)).
+		Post("/links", checkContentTypeMiddleware(s, createLink(s), "application/json"))
+	r.With(rateLimitMiddleware(s, rateGroupBatch)).
+		Post("/links/batch", checkContentTypeMiddleware(s, createLinks(s), "application/json"))
+	r.With(rateLimitMiddleware(s, rateGroupUser)).Get("/links", listLinks(s))
+	r.With(rateLimitMiddleware(s, rateGroupUser)).Delete("/links/{id}", deleteLink(s))
+	return r
+}
+
+// createLink сокращает ссылку. Отвечает 201 для новой ссылки и 200 для уже существующей.
+func createLink(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+		var req linkRequestSchema
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidBody, "Can't unmarshal body")
+		}
+		ourl, err := checkURL(s, req.OriginalURL)
+		if err != nil {
+			return checkError(err)
+		}
+		passwordHash, err := hashPassword(req.Password)
+		if err != nil {
+			return err
+		}
+		if err := checkMaxClicks(req.MaxClicks); err != nil {
+			return err
+		}
+		variants, err := checkVariants(s, req.Variants)
+		if err != nil {
+			return err
+		}
+		if err := checkRedirectStatus(req.RedirectStatus); err != nil {
+			return err
+		}
+
+		urls := []model.URL{{
+			OriginalURL:    ourl,
+			PasswordHash:   passwordHash,
+			MaxClicks:      req.MaxClicks,
+			Variants:       variants,
+			RedirectStatus: req.RedirectStatus,
+			Interstitial:   req.Interstitial,
+		}}
+		if err := saveURLs(r.Context(), s, requestUser(r), urls); err != nil {
+			return internalError("Can't save data", err)
+		}
+		if urls[0].Err != nil {
+			return internalError("Can't save data", urls[0].Err)
+		}
+
+		status := http.StatusCreated
+		if urls[0].Conflict {
+			status = http.StatusOK
+		}
+		return writeJSON(w, status, newLink(s, urls[0].Key, urls[0].OriginalURL, urls[0].CreatedAt))
+	})
+}
+
+// createLinks сокращает пачку ссылок и возвращает статус каждой.
+// Отвечает 422, если все ссылки невалидны, 207, если часть ссылок невалидна или не сохранилась,
+// 201, если создана хотя бы одна ссылка, иначе 200.
+func createLinks(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+		req, err := readBatch[batchLinkRequestSchema](s, w, r)
+		if err != nil {
+			return err
+		}
+
+		items := make([]batchItem, len(req))
+		for i, item := range req {
+			items[i] = batchItem{CorrelationID: item.CorrelationID, URL: model.URL{OriginalURL: item.OriginalURL}}
+		}
+		res := batchLinksResponseSchema{
+			Items:   make([]batchLinkSchema, len(items)),
+			Summary: shortenBatch(s, r, requestUser(r), items),
+		}
+		for i, item := range items {
+			res.Items[i] = batchLinkSchema{
+				CorrelationID: item.CorrelationID,
+				Status:        item.Status,
+				Error:         item.Error,
+			}
+			if item.Status == batchStatusCreated || item.Status == batchStatusExists {
+				link := newLink(s, item.URL.Key, item.URL.OriginalURL, item.URL.CreatedAt)
+				res.Items[i].Link = &link
+			}
+		}
+
+		done := http.StatusOK
+		if res.Summary.Created > 0 {
+			done = http.StatusCreated
+		}
+		return writeJSON(w, batchStatus(res.Summary, done), res)
+	})
+}
+
+// listLinks возвращает страницу ссылок пользователя.
+func listLinks(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		filter, err := parseUserURLsFilter(r)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidParameter, err.Error())
+		}
+		page, err := s.urlRepo.GetUsersURLPage(r.Context(), user, filter)
+		if err != nil {
+			return internalError("can't get user's urls", err)
+		}
+
+		res := linksPageSchema{
+			Items:      make([]linkSchema, 0, len(page.URLs)),
+			Total:      page.Total,
+			NextCursor: model.EncodeCursor(page.Next),
+		}
+		for _, url := range page.URLs {
+			res.Items = append(res.Items, newLink(s, url.Key, url.OriginalURL, url.CreatedAt))
+		}
+		return writeJSON(w, http.StatusOK, res)
+	})
+}
+
+// deleteLink ставит ссылку пользователя в очередь на удаление.
+func deleteLink(s *Server) http.HandlerFunc {
+	return handle(s, func(w http.ResponseWriter, r *http.Request) error {
+		user, err := authorizedUser(r)
+		if err != nil {
+			return err
+		}
+
+		go putDelURL(s, delURL{
+			ctx:  context.WithoutCancel(r.Context()),
+			user: user,
+			keys: []string{chi.URLParam(r, "id")},
+		})
+
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	})
+}
+
+func newLink(s *Server, key string, ourl string, createdAt time.Time) linkSchema {
+	return linkSchema{
+		ID:          key,
+		ShortURL:    fmt.Sprintf(s.cfg.ResSrvAdr+"/%s", key),
+		OriginalURL: ourl,
+		CreatedAt:   createdAt,
+	}
+}
+
+// writeJSON отвечает статусом status и телом v в формате JSON.
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
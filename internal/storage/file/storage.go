@@ -4,26 +4,90 @@ package file
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"maps"
 	"os"
+	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
 )
 
+// errFileReplaced - файл по пути хранилища не тот, что открыт.
+var errFileReplaced = errors.New("storage file was replaced")
+
 // DB - описание файла-хранилища.
+// Доступ к данным защищен мьютексом: хранилище используют обработчики запросов и фоновые задачи.
 type DB struct {
+	mu sync.RWMutex
+	// fname - путь к файлу хранилища. Перезапись подменяет файл, поэтому путь хранится отдельно от него.
+	fname    string
 	file     *os.File
 	data     map[string]fileURL
 	usersMap map[string][]model.KeyAndOURL
+	// byURL - ключ ссылки без настроек по ее текущему исходному адресу.
+	// Ссылки с настройками (см. model.URL.Shared) в индекс не попадают.
+	byURL map[string]string
+	// appended - сколько записей дописано в файл после последней перезаписи.
+	appended int
+	// nextUUID - номер следующей записи. Номера не переиспользуются после очистки.
+	nextUUID int
 }
 
 type fileURL struct {
-	UUID        int    `json:"uuid"`
-	ShortKey    string `json:"short_key"`
-	OriginalURL string `json:"original_url"`
-	UserID      string `json:"user_id"`
-	IsDeleted   bool   `json:"is_deleted"`
+	UUID        int                 `json:"uuid"`
+	ShortKey    string              `json:"short_key"`
+	OriginalURL string              `json:"original_url"`
+	UserID      string              `json:"user_id"`
+	IsDeleted   bool                `json:"is_deleted"`
+	DeletedAt   time.Time           `json:"deleted_at"`
+	CreatedAt   time.Time           `json:"created_at"`
+	Revisions   []model.URLRevision `json:"revisions,omitempty"`
+	// PasswordHash - bcrypt хеш пароля ссылки.
+	PasswordHash string `json:"password_hash,omitempty"`
+	// MaxClicks - сколько раз можно перейти по ссылке, 0 - без ограничения.
+	MaxClicks int `json:"max_clicks,omitempty"`
+	// ClicksLeft - оставшиеся переходы по ссылке с ограничением.
+	ClicksLeft int `json:"clicks_left,omitempty"`
+	// Rules - правила перенаправления.
+	Rules []model.RedirectRule `json:"rules,omitempty"`
+	// Variants - варианты перехода, VariantClicks - переходы на каждый из них.
+	Variants      []model.URLVariant `json:"variants,omitempty"`
+	VariantClicks []int64            `json:"variant_clicks,omitempty"`
+	// RedirectStatus - код перенаправления ссылки, 0 - код по умолчанию.
+	RedirectStatus int `json:"redirect_status,omitempty"`
+	// Interstitial - показывать страницу предпросмотра перед переходом.
+	Interstitial bool `json:"interstitial,omitempty"`
+	// Template - шаблон параметров запроса.
+	Template *model.RedirectTemplate `json:"template,omitempty"`
+}
+
+// revisions возвращает историю редакций записи.
+// Для записей, созданных до появления истории, первая редакция восстанавливается из самой записи.
+func (u fileURL) revisions() []model.URLRevision {
+	if len(u.Revisions) > 0 {
+		return u.Revisions
+	}
+	return []model.URLRevision{{
+		Revision:    1,
+		OriginalURL: u.OriginalURL,
+		CreatedAt:   u.CreatedAt,
+	}}
+}
+
+// shared сообщает, что у ссылки нет собственных настроек.
+func (u fileURL) shared() bool {
+	url := model.URL{
+		PasswordHash:   u.PasswordHash,
+		MaxClicks:      u.MaxClicks,
+		Variants:       u.Variants,
+		RedirectStatus: u.RedirectStatus,
+		Interstitial:   u.Interstitial,
+	}
+	return url.Shared()
 }
 
 // New возвращает новый файл-хранилище.
@@ -34,6 +98,7 @@ func New(fname string) (*DB, error) {
 	}
 
 	out := new(DB)
+	out.fname = fname
 	out.file = file
 
 	err = readStorageFile(out, fname)
@@ -44,83 +109,243 @@ func New(fname string) (*DB, error) {
 	return out, nil
 }
 
+// Ping проверяет, что файл хранилища открыт и в него можно писать.
+func (db *DB) Ping() error {
+	if err := db.CheckOpen(); err != nil {
+		return err
+	}
+	return db.CheckWritable()
+}
+
+// CheckOpen проверяет, что открытый файл хранилища по-прежнему лежит по своему пути:
+// иначе записи уходят в удаленный или подмененный файл и пропадут при перезапуске.
+func (db *DB) CheckOpen() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	opened, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	onDisk, err := os.Stat(db.fname)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(opened, onDisk) {
+		return errFileReplaced
+	}
+	return nil
+}
+
+// CheckWritable проверяет, что в файл можно дописывать записи, а в его каталоге
+// создавать файлы: перезапись хранилища пишет новый файл рядом с прежним.
+func (db *DB) CheckWritable() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	file, err := os.OpenFile(db.fname, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(db.fname), ".health-*")
+	if err != nil {
+		return err
+	}
+	_ = tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
 // CloseFile закрывет файл.
 func (db *DB) CloseFile() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	return db.file.Close()
 }
 
 func readStorageFile(db *DB, fname string) error {
 	fileData := make(map[string]fileURL)
 	usersMap := make(map[string][]model.KeyAndOURL)
+	byURL := make(map[string]string)
 
 	strData, err := os.ReadFile(fname)
 	if err != nil {
 		return err
 	}
 
-	var schema fileURL
+	loadedAt := time.Now().UTC()
+	keys := make([]string, 0)
+	// legacy - записи, последняя версия которых удалена без deleted_at.
+	legacy := make(map[string]bool)
+	lines := 0
+	maxUUID := 0
 	sliceData := strings.Split(string(strData), "\n")
 	for _, data := range sliceData {
 		if data == "" {
 			continue
 		}
+		var schema fileURL
 		if err := json.Unmarshal([]byte(data), &schema); err != nil {
 			return err
 		}
+		legacy[schema.ShortKey] = schema.IsDeleted && schema.DeletedAt.IsZero()
+		if legacy[schema.ShortKey] {
+			// Записи, удаленные до появления deleted_at, хранятся полный срок с момента
+			// первой загрузки. Время дописывается в файл ниже, чтобы срок не начинался заново.
+			schema.DeletedAt = loadedAt
+		}
+		maxUUID = max(maxUUID, schema.UUID)
+		lines++
+		// Переходы дописывают в файл новую версию записи, действует последняя.
+		if _, ok := fileData[schema.ShortKey]; !ok {
+			keys = append(keys, schema.ShortKey)
+		}
 		fileData[schema.ShortKey] = schema
+	}
+
+	for _, key := range keys {
+		schema := fileData[key]
+		if schema.shared() {
+			byURL[schema.OriginalURL] = schema.ShortKey
+		}
+		if schema.IsDeleted {
+			continue
+		}
 
 		userURLS := usersMap[schema.UserID]
 		userURLS = append(userURLS, model.KeyAndOURL{
 			Key:         schema.ShortKey,
 			OriginalURL: schema.OriginalURL,
+			CreatedAt:   schema.CreatedAt,
 		})
 		usersMap[schema.UserID] = userURLS
 	}
 
 	db.data = fileData
 	db.usersMap = usersMap
+	db.byURL = byURL
+	db.appended = lines - len(fileData)
+	db.nextUUID = maxUUID + 1
+
+	for _, key := range keys {
+		if !legacy[key] {
+			continue
+		}
+		if err := db.update(fileData[key]); err != nil {
+			return fmt.Errorf("save deleted_at: %w", err)
+		}
+	}
 
 	return nil
 }
 
 // Get возвращает ссылку по ключу.
-func (db *DB) Get(key string) (string, error) {
+func (db *DB) Get(key string) (*model.URL, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
 	fileData, ok := db.data[key]
 	if !ok {
-		return "", errors.New("not found")
+		return nil, model.ErrNotFound
 	}
 	if fileData.IsDeleted {
-		return "", model.ErrIsDeleted
+		return nil, model.ErrIsDeleted
+	}
+	if fileData.MaxClicks > 0 && fileData.ClicksLeft <= 0 {
+		return nil, model.ErrClicksExhausted
+	}
+	return &model.URL{
+		OriginalURL:    fileData.OriginalURL,
+		Key:            key,
+		UserID:         fileData.UserID,
+		CreatedAt:      fileData.CreatedAt,
+		PasswordHash:   fileData.PasswordHash,
+		MaxClicks:      fileData.MaxClicks,
+		Rules:          fileData.Rules,
+		Variants:       fileData.Variants,
+		RedirectStatus: fileData.RedirectStatus,
+		Interstitial:   fileData.Interstitial,
+		Template:       fileData.Template,
+	}, nil
+}
+
+// ConsumeClick списывает переход по ссылке с ограничением числа переходов.
+// Остаток сравнивается и уменьшается под блокировкой записи. Новая версия записи
+// дописывается в файл и только после успешной записи заменяет прежнюю в памяти.
+func (db *DB) ConsumeClick(key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	url, ok := db.data[key]
+	if !ok {
+		return model.ErrNotFound
+	}
+	if url.IsDeleted {
+		return model.ErrIsDeleted
+	}
+	if url.MaxClicks == 0 {
+		return nil
+	}
+	if url.ClicksLeft <= 0 {
+		return model.ErrClicksExhausted
 	}
-	return fileData.OriginalURL, nil
+	url.ClicksLeft--
+	return db.update(url)
 }
 
 // Set записывает ссылки в файл.
+// Ошибка записи отдельной ссылки сохраняется в ее поле Err и не прерывает запись остальных.
+// Если исходный адрес уже сокращен ссылкой без настроек, а у новой ссылки настроек тоже нет,
+// в ней возвращается ключ существующей ссылки.
+// Если ключ занят ссылкой с другим адресом, ссылка получает случайный ключ.
 func (db *DB) Set(urls []model.URL) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	uuid := len(db.data) + 1
-
-	for i, url := range urls {
-		_, ok := db.data[url.Key]
-		if ok {
+	for i := range urls {
+		shared := urls[i].Shared()
+		if key, ok := db.byURL[urls[i].OriginalURL]; ok && shared {
+			urls[i].Key = key
 			urls[i].Conflict = true
+			urls[i].CreatedAt = db.data[key].CreatedAt
 			continue
 		}
+		for {
+			if _, ok := db.data[urls[i].Key]; !ok {
+				break
+			}
+			urls[i].Key = model.RandomKey()
+		}
+		url := urls[i]
 
 		URL := fileURL{
-			UUID:        uuid,
-			ShortKey:    url.Key,
-			OriginalURL: url.OriginalURL,
-			UserID:      url.UserID,
-			IsDeleted:   false,
+			UUID:           db.nextUUID,
+			ShortKey:       url.Key,
+			OriginalURL:    url.OriginalURL,
+			UserID:         url.UserID,
+			IsDeleted:      false,
+			CreatedAt:      time.Now().UTC(),
+			PasswordHash:   url.PasswordHash,
+			MaxClicks:      url.MaxClicks,
+			ClicksLeft:     url.MaxClicks,
+			Variants:       url.Variants,
+			RedirectStatus: url.RedirectStatus,
+			Interstitial:   url.Interstitial,
 		}
 
-		err := json.NewEncoder(db.file).Encode(&URL)
-		if err != nil {
-			return err
+		if err := json.NewEncoder(db.file).Encode(&URL); err != nil {
+			urls[i].Err = err
+			continue
 		}
 		db.data[URL.ShortKey] = URL
-		uuid++
+		if shared {
+			db.byURL[URL.OriginalURL] = URL.ShortKey
+		}
+		urls[i].CreatedAt = URL.CreatedAt
+		db.nextUUID++
 
 		if url.UserID == "" {
 			continue
@@ -129,6 +354,7 @@ func (db *DB) Set(urls []model.URL) error {
 		userURLS = append(userURLS, model.KeyAndOURL{
 			Key:         url.Key,
 			OriginalURL: url.OriginalURL,
+			CreatedAt:   URL.CreatedAt,
 		})
 		db.usersMap[url.UserID] = userURLS
 	}
@@ -138,21 +364,80 @@ func (db *DB) Set(urls []model.URL) error {
 
 // GetByUser возвращает все ссылки пользователя.
 func (db *DB) GetByUser(user string) []model.KeyAndOURL {
-	usersURLS := db.usersMap[user]
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	usersURLS := slices.Clone(db.usersMap[user])
 	return usersURLS
 }
 
+// GetPageByUser возвращает страницу ссылок пользователя.
+func (db *DB) GetPageByUser(user string, filter model.UserURLsFilter) *model.UserURLsPage {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return model.PageURLs(db.usersMap[user], filter)
+}
+
+// Export возвращает все ссылки пользователя, в том числе удаленные, в порядке создания.
+func (db *DB) Export(user string) []model.URL {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	rows := make([]fileURL, 0, len(db.usersMap[user]))
+	for _, url := range db.data {
+		if url.UserID == user {
+			rows = append(rows, url)
+		}
+	}
+	slices.SortFunc(rows, func(a, b fileURL) int {
+		return a.UUID - b.UUID
+	})
+
+	urls := make([]model.URL, len(rows))
+	for i, url := range rows {
+		urls[i] = model.URL{
+			OriginalURL:    url.OriginalURL,
+			Key:            url.ShortKey,
+			UserID:         url.UserID,
+			IsDeleted:      url.IsDeleted,
+			DeletedAt:      url.DeletedAt,
+			CreatedAt:      url.CreatedAt,
+			PasswordHash:   url.PasswordHash,
+			MaxClicks:      url.MaxClicks,
+			Rules:          url.Rules,
+			Variants:       url.Variants,
+			RedirectStatus: url.RedirectStatus,
+			Interstitial:   url.Interstitial,
+			Template:       url.Template,
+		}
+	}
+	return urls
+}
+
 // UpdateDeleteFlag удаляет ссылки.
+// Признак удаления дописывается в файл отдельной версией записи. Ссылка, которую
+// не удалось записать, остается неудаленной и в памяти.
 func (db *DB) UpdateDeleteFlag(user string, keys []string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	userURLS, ok := db.usersMap[user]
 
+	deletedAt := time.Now().UTC()
 	for _, key := range keys {
-		url := db.data[key]
+		url, found := db.data[key]
+		if !found || url.IsDeleted {
+			continue
+		}
 		if url.UserID != user && user != "" {
 			continue
 		}
 		url.IsDeleted = true
-		db.data[key] = url
+		url.DeletedAt = deletedAt
+		if err := db.update(url); err != nil {
+			continue
+		}
 
 		if ok {
 			idx := slices.IndexFunc(userURLS, func(v model.KeyAndOURL) bool { return v.Key == key })
@@ -169,29 +454,307 @@ func (db *DB) UpdateDeleteFlag(user string, keys []string) {
 	default:
 		db.usersMap = make(map[string][]model.KeyAndOURL, 0)
 	}
+}
 
-	fname := db.file.Name()
+// Update меняет исходную ссылку по ключу и добавляет новую редакцию.
+func (db *DB) Update(user string, key string, ourl string) (*model.URLRevision, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	err := db.file.Close()
-	if err != nil {
-		return
+	url, ok := db.data[key]
+	if !ok || url.UserID != user {
+		return nil, model.ErrNotFound
 	}
-	err = os.Remove(fname)
-	if err != nil {
-		return
+	if url.IsDeleted {
+		return nil, model.ErrIsDeleted
 	}
 
-	file, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	revisions := url.revisions()
+	last := revisions[len(revisions)-1]
+	if url.OriginalURL == ourl {
+		return &last, nil
+	}
+	indexed := db.byURL[url.OriginalURL] == key
+	if _, ok := db.byURL[ourl]; ok && indexed {
+		return nil, model.ErrConflict
+	}
+
+	rev := model.URLRevision{
+		Revision:    last.Revision + 1,
+		OriginalURL: ourl,
+		CreatedAt:   time.Now().UTC(),
+	}
+	prev := url.OriginalURL
+	url.OriginalURL = ourl
+	url.Revisions = append(slices.Clip(revisions), rev)
+	if err := db.update(url); err != nil {
+		return nil, err
+	}
+
+	if indexed {
+		delete(db.byURL, prev)
+		db.byURL[ourl] = key
+	}
+	userURLS := db.usersMap[user]
+	idx := slices.IndexFunc(userURLS, func(v model.KeyAndOURL) bool { return v.Key == key })
+	if idx >= 0 {
+		userURLS[idx].OriginalURL = ourl
+	}
+	return &rev, nil
+}
+
+// Revisions возвращает историю редакций ссылки пользователя.
+func (db *DB) Revisions(user string, key string) ([]model.URLRevision, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.data[key]
+	if !ok || url.UserID != user {
+		return nil, model.ErrNotFound
+	}
+	return slices.Clone(url.revisions()), nil
+}
+
+// CheckOwner проверяет, что ссылка, в том числе удаленная, принадлежит пользователю.
+func (db *DB) CheckOwner(user string, key string) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.data[key]
+	if !ok || url.UserID != user {
+		return model.ErrNotFound
+	}
+	return nil
+}
+
+// Rules возвращает правила перенаправления ссылки пользователя.
+func (db *DB) Rules(user string, key string) ([]model.RedirectRule, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.data[key]
+	if !ok || url.UserID != user {
+		return nil, model.ErrNotFound
+	}
+	return slices.Clone(url.Rules), nil
+}
+
+// SetRules заменяет правила перенаправления ссылки пользователя.
+func (db *DB) SetRules(user string, key string, rules []model.RedirectRule) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	url, ok := db.data[key]
+	if !ok || url.UserID != user {
+		return model.ErrNotFound
+	}
+	if url.IsDeleted {
+		return model.ErrIsDeleted
+	}
+	url.Rules = slices.Clone(rules)
+	return db.update(url)
+}
+
+// Template возвращает шаблон параметров запроса ссылки пользователя.
+func (db *DB) Template(user string, key string) (*model.RedirectTemplate, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.data[key]
+	if !ok || url.UserID != user {
+		return nil, model.ErrNotFound
+	}
+	return url.Template, nil
+}
+
+// SetTemplate заменяет шаблон параметров запроса ссылки пользователя.
+func (db *DB) SetTemplate(user string, key string, tpl *model.RedirectTemplate) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	url, ok := db.data[key]
+	if !ok || url.UserID != user {
+		return model.ErrNotFound
+	}
+	if url.IsDeleted {
+		return model.ErrIsDeleted
+	}
+	url.Template = tpl
+	return db.update(url)
+}
+
+// RecordVariantClick учитывает переход на вариант ссылки.
+// Как и в ConsumeClick, новая версия записи дописывается в файл без его перезаписи.
+func (db *DB) RecordVariantClick(key string, variant int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	url, ok := db.data[key]
+	if !ok || variant < 0 || variant >= len(url.Variants) {
+		return model.ErrNotFound
+	}
+	clicks := make([]int64, len(url.Variants))
+	copy(clicks, url.VariantClicks)
+	clicks[variant]++
+	url.VariantClicks = clicks
+	return db.update(url)
+}
+
+// VariantStats возвращает переходы на варианты ссылки пользователя.
+func (db *DB) VariantStats(user string, key string) ([]model.VariantStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.data[key]
+	if !ok || url.UserID != user {
+		return nil, model.ErrNotFound
+	}
+	stats := make([]model.VariantStats, len(url.Variants))
+	for i, variant := range url.Variants {
+		stats[i].URLVariant = variant
+		if i < len(url.VariantClicks) {
+			stats[i].Clicks = url.VariantClicks[i]
+		}
+	}
+	return stats, nil
+}
+
+// Restore снимает признак удаления со ссылок пользователя, удаленных не раньше since.
+// Возвращает ключи восстановленных ссылок.
+func (db *DB) Restore(user string, keys []string, since time.Time) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	restored := make([]string, 0, len(keys))
+	for _, key := range keys {
+		url, ok := db.data[key]
+		if !ok || url.UserID != user || !url.IsDeleted || url.DeletedAt.Before(since) {
+			continue
+		}
+		url.IsDeleted = false
+		url.DeletedAt = time.Time{}
+		if err := db.update(url); err != nil {
+			return nil, err
+		}
+
+		db.usersMap[user] = append(db.usersMap[user], model.KeyAndOURL{
+			Key:         url.ShortKey,
+			OriginalURL: url.OriginalURL,
+			CreatedAt:   url.CreatedAt,
+		})
+		restored = append(restored, key)
+	}
+	return restored, nil
+}
+
+// Purge удаляет из файла ссылки, удаленные раньше before.
+// Возвращает количество удаленных ссылок.
+func (db *DB) Purge(before time.Time) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Ссылки удаляются из памяти только после того, как файл перезаписан без них.
+	data := maps.Clone(db.data)
+	purged := make([]fileURL, 0)
+	for key, url := range data {
+		if url.IsDeleted && url.DeletedAt.Before(before) {
+			delete(data, key)
+			purged = append(purged, url)
+		}
+	}
+
+	if len(purged) == 0 {
+		return 0, nil
+	}
+	if err := db.rewrite(data); err != nil {
+		return 0, err
+	}
+	db.data = data
+	for _, url := range purged {
+		if db.byURL[url.OriginalURL] == url.ShortKey {
+			delete(db.byURL, url.OriginalURL)
+		}
+	}
+	return len(purged), nil
+}
+
+// update дописывает в файл новую версию записи и после успешной записи заменяет ею прежнюю.
+// Когда дописанных версий становится больше, чем записей, файл сжимается перезаписью.
+// Ошибка сжатия не возвращается: версия уже записана, а прежний файл остается на месте,
+// и сжатие повторится при следующей записи.
+func (db *DB) update(url fileURL) error {
+	if err := json.NewEncoder(db.file).Encode(&url); err != nil {
+		return err
+	}
+	db.data[url.ShortKey] = url
+	db.appended++
+	if db.appended > len(db.data) {
+		_ = db.rewrite(db.data)
+	}
+	return nil
+}
+
+// rewrite заменяет файл хранилища записями data. Записи пишутся во временный файл
+// в том же каталоге, который после fsync переименовывается поверх прежнего, поэтому
+// при любой ошибке прежний файл и открытый для дописывания файл остаются рабочими.
+func (db *DB) rewrite(data map[string]fileURL) error {
+	perm := os.FileMode(0666)
+	if info, err := db.file.Stat(); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(db.fname), filepath.Base(db.fname)+".*.tmp")
 	if err != nil {
-		return
+		return err
 	}
+	file, err := writeFile(tmp, data, perm)
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), db.fname); err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	syncDir(filepath.Dir(db.fname))
 
+	_ = db.file.Close()
 	db.file = file
+	db.appended = 0
+	return nil
+}
 
-	for _, fileURL := range db.data {
-		err := json.NewEncoder(db.file).Encode(&fileURL)
-		if err != nil {
-			return
+// writeFile записывает data во временный файл tmp, выдает ему права perm, сбрасывает на диск
+// и закрывает. Возвращает тот же файл, открытый для дописывания, как в New.
+func writeFile(tmp *os.File, data map[string]fileURL, perm os.FileMode) (*os.File, error) {
+	enc := json.NewEncoder(tmp)
+	for _, fileURL := range data {
+		if err := enc.Encode(&fileURL); err != nil {
+			_ = tmp.Close()
+			return nil, err
 		}
 	}
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(tmp.Name(), os.O_WRONLY|os.O_APPEND, 0)
+}
+
+// syncDir сбрасывает на диск каталог, чтобы переименование файла пережило сбой питания.
+// Не на всех системах каталог можно открыть для этого, поэтому ошибки не возвращаются.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
 }
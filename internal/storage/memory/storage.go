@@ -2,16 +2,24 @@
 package memory
 
 import (
-	"errors"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
 )
 
 // DB - описание хранилища.
+// Доступ к данным защищен мьютексом: хранилище используют обработчики запросов и фоновые задачи.
 type DB struct {
+	mu       sync.RWMutex
 	dbMap    map[string]memoryURL
 	usersMap map[string][]model.KeyAndOURL
+	// byURL - ключ ссылки без настроек по ее текущему исходному адресу.
+	// Ссылки с настройками (см. model.URL.Shared) в индекс не попадают.
+	byURL map[string]string
 }
 
 type memoryURL struct {
@@ -19,6 +27,28 @@ type memoryURL struct {
 	ShortKey    string
 	UserID      string
 	IsDeleted   bool
+	DeletedAt   time.Time
+	CreatedAt   time.Time
+	Revisions   []model.URLRevision
+	// PasswordHash - bcrypt хеш пароля ссылки.
+	PasswordHash string
+	// MaxClicks - сколько раз можно перейти по ссылке, 0 - без ограничения.
+	MaxClicks int
+	// ClicksLeft - оставшиеся переходы. Счетчик общий для всех копий записи
+	// и меняется сравнением с обменом, поэтому переходам хватает блокировки на чтение.
+	ClicksLeft *atomic.Int64
+	// Rules - правила перенаправления. Список заменяется целиком и не меняется на месте.
+	Rules []model.RedirectRule
+	// Variants - варианты перехода, VariantClicks - переходы на каждый из них.
+	// Счетчики общие для всех копий записи, как и ClicksLeft.
+	Variants      []model.URLVariant
+	VariantClicks []atomic.Int64
+	// RedirectStatus - код перенаправления ссылки, 0 - код по умолчанию.
+	RedirectStatus int
+	// Interstitial - показывать страницу предпросмотра перед переходом.
+	Interstitial bool
+	// Template - шаблон параметров запроса. Шаблон заменяется целиком и не меняется на месте.
+	Template *model.RedirectTemplate
 }
 
 // New возвращает новое хранилище (map).
@@ -26,33 +56,115 @@ func New() *DB {
 	return &DB{
 		dbMap:    make(map[string]memoryURL),
 		usersMap: make(map[string][]model.KeyAndOURL, 0),
+		byURL:    make(map[string]string),
 	}
 }
 
 // Get возвращает ссылку по ключу.
-func (db *DB) Get(key string) (string, error) {
-	ourl, ok := db.dbMap[key]
+func (db *DB) Get(key string) (*model.URL, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.dbMap[key]
 	if !ok {
-		return "", errors.New("not found")
+		return nil, model.ErrNotFound
+	}
+	if url.IsDeleted {
+		return nil, model.ErrIsDeleted
 	}
-	if ourl.IsDeleted {
-		return "", model.ErrIsDeleted
+	if url.ClicksLeft != nil && url.ClicksLeft.Load() <= 0 {
+		return nil, model.ErrClicksExhausted
 	}
-	return ourl.OriginalURL, nil
+	return &model.URL{
+		OriginalURL:    url.OriginalURL,
+		Key:            key,
+		UserID:         url.UserID,
+		CreatedAt:      url.CreatedAt,
+		PasswordHash:   url.PasswordHash,
+		MaxClicks:      url.MaxClicks,
+		Rules:          url.Rules,
+		Variants:       url.Variants,
+		RedirectStatus: url.RedirectStatus,
+		Interstitial:   url.Interstitial,
+		Template:       url.Template,
+	}, nil
 }
 
-// Set записывает ссылки в файл.
+// ConsumeClick списывает переход по ссылке с ограничением числа переходов.
+func (db *DB) ConsumeClick(key string) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.dbMap[key]
+	if !ok {
+		return model.ErrNotFound
+	}
+	if url.IsDeleted {
+		return model.ErrIsDeleted
+	}
+	if url.ClicksLeft == nil {
+		return nil
+	}
+	for {
+		left := url.ClicksLeft.Load()
+		if left <= 0 {
+			return model.ErrClicksExhausted
+		}
+		if url.ClicksLeft.CompareAndSwap(left, left-1) {
+			return nil
+		}
+	}
+}
+
+// Set записывает ссылку в хранилище.
+// Если исходный адрес уже сокращен ссылкой без настроек, а у url настроек тоже нет,
+// в url возвращается ключ существующей ссылки.
+// Если ключ занят ссылкой с другим адресом, ссылка получает случайный ключ.
 func (db *DB) Set(url *model.URL) {
-	_, ok := db.dbMap[url.Key]
-	if ok {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	shared := url.Shared()
+	if key, ok := db.byURL[url.OriginalURL]; ok && shared {
+		url.Key = key
 		url.Conflict = true
+		url.CreatedAt = db.dbMap[key].CreatedAt
 		return
 	}
+	for {
+		if _, ok := db.dbMap[url.Key]; !ok {
+			break
+		}
+		url.Key = model.RandomKey()
+	}
+	createdAt := time.Now().UTC()
+	url.CreatedAt = createdAt
+	var clicksLeft *atomic.Int64
+	if url.MaxClicks > 0 {
+		clicksLeft = new(atomic.Int64)
+		clicksLeft.Store(int64(url.MaxClicks))
+	}
 	db.dbMap[url.Key] = memoryURL{
-		OriginalURL: url.OriginalURL,
-		ShortKey:    url.Key,
-		UserID:      url.UserID,
-		IsDeleted:   false,
+		OriginalURL:    url.OriginalURL,
+		ShortKey:       url.Key,
+		UserID:         url.UserID,
+		IsDeleted:      false,
+		CreatedAt:      createdAt,
+		PasswordHash:   url.PasswordHash,
+		MaxClicks:      url.MaxClicks,
+		ClicksLeft:     clicksLeft,
+		Variants:       slices.Clone(url.Variants),
+		VariantClicks:  make([]atomic.Int64, len(url.Variants)),
+		RedirectStatus: url.RedirectStatus,
+		Interstitial:   url.Interstitial,
+		Revisions: []model.URLRevision{{
+			Revision:    1,
+			OriginalURL: url.OriginalURL,
+			CreatedAt:   createdAt,
+		}},
+	}
+	if shared {
+		db.byURL[url.OriginalURL] = url.Key
 	}
 
 	if url.UserID == "" {
@@ -62,6 +174,7 @@ func (db *DB) Set(url *model.URL) {
 	userURLS = append(userURLS, model.KeyAndOURL{
 		Key:         url.Key,
 		OriginalURL: url.OriginalURL,
+		CreatedAt:   createdAt,
 	})
 	db.usersMap[url.UserID] = userURLS
 }
@@ -73,20 +186,229 @@ func (db *DB) Close() error {
 
 // GetByUser возвращает все ссылки пользователя.
 func (db *DB) GetByUser(user string) []model.KeyAndOURL {
-	usersURLS := db.usersMap[user]
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	usersURLS := slices.Clone(db.usersMap[user])
 	return usersURLS
 }
 
+// GetPageByUser возвращает страницу ссылок пользователя.
+func (db *DB) GetPageByUser(user string, filter model.UserURLsFilter) *model.UserURLsPage {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return model.PageURLs(db.usersMap[user], filter)
+}
+
+// Export возвращает все ссылки пользователя, в том числе удаленные, в порядке создания.
+func (db *DB) Export(user string) []model.URL {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	urls := make([]model.URL, 0, len(db.usersMap[user]))
+	for key, url := range db.dbMap {
+		if url.UserID != user {
+			continue
+		}
+		urls = append(urls, model.URL{
+			OriginalURL:    url.OriginalURL,
+			Key:            key,
+			UserID:         url.UserID,
+			IsDeleted:      url.IsDeleted,
+			DeletedAt:      url.DeletedAt,
+			CreatedAt:      url.CreatedAt,
+			PasswordHash:   url.PasswordHash,
+			MaxClicks:      url.MaxClicks,
+			Rules:          url.Rules,
+			Variants:       url.Variants,
+			RedirectStatus: url.RedirectStatus,
+			Interstitial:   url.Interstitial,
+			Template:       url.Template,
+		})
+	}
+	slices.SortFunc(urls, func(a, b model.URL) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return urls
+}
+
+// Update меняет исходную ссылку по ключу и добавляет новую редакцию.
+func (db *DB) Update(user string, key string, ourl string) (*model.URLRevision, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	url, ok := db.dbMap[key]
+	if !ok || url.UserID != user {
+		return nil, model.ErrNotFound
+	}
+	if url.IsDeleted {
+		return nil, model.ErrIsDeleted
+	}
+
+	last := url.Revisions[len(url.Revisions)-1]
+	if url.OriginalURL == ourl {
+		return &last, nil
+	}
+	indexed := db.byURL[url.OriginalURL] == key
+	if _, ok := db.byURL[ourl]; ok && indexed {
+		return nil, model.ErrConflict
+	}
+
+	rev := model.URLRevision{
+		Revision:    last.Revision + 1,
+		OriginalURL: ourl,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if indexed {
+		delete(db.byURL, url.OriginalURL)
+		db.byURL[ourl] = key
+	}
+	url.OriginalURL = ourl
+	url.Revisions = append(slices.Clip(url.Revisions), rev)
+	db.dbMap[key] = url
+
+	userURLS := db.usersMap[user]
+	idx := slices.IndexFunc(userURLS, func(v model.KeyAndOURL) bool { return v.Key == key })
+	if idx >= 0 {
+		userURLS[idx].OriginalURL = ourl
+	}
+
+	return &rev, nil
+}
+
+// Revisions возвращает историю редакций ссылки пользователя.
+func (db *DB) Revisions(user string, key string) ([]model.URLRevision, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.dbMap[key]
+	if !ok || url.UserID != user {
+		return nil, model.ErrNotFound
+	}
+	return slices.Clone(url.Revisions), nil
+}
+
+// CheckOwner проверяет, что ссылка, в том числе удаленная, принадлежит пользователю.
+func (db *DB) CheckOwner(user string, key string) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.dbMap[key]
+	if !ok || url.UserID != user {
+		return model.ErrNotFound
+	}
+	return nil
+}
+
+// Rules возвращает правила перенаправления ссылки пользователя.
+func (db *DB) Rules(user string, key string) ([]model.RedirectRule, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.dbMap[key]
+	if !ok || url.UserID != user {
+		return nil, model.ErrNotFound
+	}
+	return slices.Clone(url.Rules), nil
+}
+
+// SetRules заменяет правила перенаправления ссылки пользователя.
+func (db *DB) SetRules(user string, key string, rules []model.RedirectRule) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	url, ok := db.dbMap[key]
+	if !ok || url.UserID != user {
+		return model.ErrNotFound
+	}
+	if url.IsDeleted {
+		return model.ErrIsDeleted
+	}
+	url.Rules = slices.Clone(rules)
+	db.dbMap[key] = url
+	return nil
+}
+
+// Template возвращает шаблон параметров запроса ссылки пользователя.
+func (db *DB) Template(user string, key string) (*model.RedirectTemplate, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.dbMap[key]
+	if !ok || url.UserID != user {
+		return nil, model.ErrNotFound
+	}
+	return url.Template, nil
+}
+
+// SetTemplate заменяет шаблон параметров запроса ссылки пользователя.
+func (db *DB) SetTemplate(user string, key string, tpl *model.RedirectTemplate) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	url, ok := db.dbMap[key]
+	if !ok || url.UserID != user {
+		return model.ErrNotFound
+	}
+	if url.IsDeleted {
+		return model.ErrIsDeleted
+	}
+	url.Template = tpl
+	db.dbMap[key] = url
+	return nil
+}
+
+// RecordVariantClick учитывает переход на вариант ссылки.
+func (db *DB) RecordVariantClick(key string, variant int) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.dbMap[key]
+	if !ok || variant < 0 || variant >= len(url.VariantClicks) {
+		return model.ErrNotFound
+	}
+	url.VariantClicks[variant].Add(1)
+	return nil
+}
+
+// VariantStats возвращает переходы на варианты ссылки пользователя.
+func (db *DB) VariantStats(user string, key string) ([]model.VariantStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	url, ok := db.dbMap[key]
+	if !ok || url.UserID != user {
+		return nil, model.ErrNotFound
+	}
+	stats := make([]model.VariantStats, len(url.Variants))
+	for i, variant := range url.Variants {
+		stats[i] = model.VariantStats{URLVariant: variant, Clicks: url.VariantClicks[i].Load()}
+	}
+	return stats, nil
+}
+
 // UpdateDeleteFlag удаляет ссылки.
 func (db *DB) UpdateDeleteFlag(user string, keys []string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	userURLS, ok := db.usersMap[user]
 
+	deletedAt := time.Now().UTC()
 	for _, key := range keys {
-		url := db.dbMap[key]
+		url, found := db.dbMap[key]
+		if !found || url.IsDeleted {
+			continue
+		}
 		if url.UserID != user && user != "" {
 			continue
 		}
 		url.IsDeleted = true
+		url.DeletedAt = deletedAt
 		db.dbMap[key] = url
 
 		if ok {
@@ -104,5 +426,49 @@ func (db *DB) UpdateDeleteFlag(user string, keys []string) {
 	default:
 		db.usersMap = make(map[string][]model.KeyAndOURL, 0)
 	}
+}
+
+// Restore снимает признак удаления со ссылок пользователя, удаленных не раньше since.
+// Возвращает ключи восстановленных ссылок.
+func (db *DB) Restore(user string, keys []string, since time.Time) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
+	restored := make([]string, 0, len(keys))
+	for _, key := range keys {
+		url, ok := db.dbMap[key]
+		if !ok || url.UserID != user || !url.IsDeleted || url.DeletedAt.Before(since) {
+			continue
+		}
+		url.IsDeleted = false
+		url.DeletedAt = time.Time{}
+		db.dbMap[key] = url
+
+		db.usersMap[user] = append(db.usersMap[user], model.KeyAndOURL{
+			Key:         url.ShortKey,
+			OriginalURL: url.OriginalURL,
+			CreatedAt:   url.CreatedAt,
+		})
+		restored = append(restored, key)
+	}
+	return restored
+}
+
+// Purge удаляет из хранилища ссылки, удаленные раньше before.
+// Возвращает количество удаленных ссылок.
+func (db *DB) Purge(before time.Time) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	count := 0
+	for key, url := range db.dbMap {
+		if url.IsDeleted && url.DeletedAt.Before(before) {
+			delete(db.dbMap, key)
+			if db.byURL[url.OriginalURL] == key {
+				delete(db.byURL, url.OriginalURL)
+			}
+			count++
+		}
+	}
+	return count
 }
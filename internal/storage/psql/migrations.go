@@ -7,30 +7,150 @@ var migrations = []string{
 	user_id text,
 	is_deleted bool NOT NULL
 );`,
+	`ALTER TABLE shorten_urls
+	ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now();`,
+	`CREATE INDEX IF NOT EXISTS shorten_urls_user_created_idx
+	ON shorten_urls (user_id, created_at, short_key);`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS shorten_urls_short_key_idx
+	ON shorten_urls (short_key);`,
+	`CREATE TABLE IF NOT EXISTS url_revisions (
+	short_key text NOT NULL,
+	revision int NOT NULL,
+	original_url text NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (short_key, revision)
+);`,
+	`ALTER TABLE shorten_urls
+	ADD COLUMN IF NOT EXISTS deleted_at timestamptz;`,
+	`UPDATE shorten_urls
+	SET deleted_at = now()
+	WHERE is_deleted AND deleted_at IS NULL;`,
+	`CREATE INDEX IF NOT EXISTS shorten_urls_deleted_at_idx
+	ON shorten_urls (deleted_at) WHERE is_deleted;`,
+	`CREATE TABLE IF NOT EXISTS schema_version (
+	version int NOT NULL
+);`,
+	`ALTER TABLE shorten_urls
+	ADD COLUMN IF NOT EXISTS password_hash text NOT NULL DEFAULT '';`,
+	`ALTER TABLE shorten_urls
+	ADD COLUMN IF NOT EXISTS max_clicks int NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS clicks_left int NOT NULL DEFAULT 0;`,
+	`ALTER TABLE shorten_urls
+	ADD COLUMN IF NOT EXISTS rules jsonb NOT NULL DEFAULT '[]';`,
+	`ALTER TABLE shorten_urls
+	ADD COLUMN IF NOT EXISTS variants jsonb NOT NULL DEFAULT '[]';`,
+	`CREATE TABLE IF NOT EXISTS url_variant_clicks (
+	short_key text NOT NULL,
+	variant int NOT NULL,
+	clicks bigint NOT NULL DEFAULT 0,
+	PRIMARY KEY (short_key, variant)
+);`,
+	`ALTER TABLE shorten_urls
+	ADD COLUMN IF NOT EXISTS redirect_status int NOT NULL DEFAULT 0;`,
+	`ALTER TABLE shorten_urls
+	ADD COLUMN IF NOT EXISTS template jsonb;`,
+	`ALTER TABLE shorten_urls
+	ADD COLUMN IF NOT EXISTS interstitial boolean NOT NULL DEFAULT false;`,
+	`ALTER TABLE shorten_urls
+	ADD COLUMN IF NOT EXISTS shared boolean NOT NULL DEFAULT true;`,
+	`UPDATE shorten_urls
+	SET shared = false
+	WHERE password_hash <> '' OR max_clicks > 0 OR variants <> '[]' OR redirect_status <> 0 OR interstitial;`,
+	`ALTER TABLE shorten_urls
+	DROP CONSTRAINT IF EXISTS shorten_urls_original_url_key;`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS shorten_urls_shared_original_url_idx
+	ON shorten_urls (original_url) WHERE shared;`,
 }
 
+// Версия схемы - число примененных миграций.
+// queryRaiseSchemaVersion записывает версию $1, если записанная версия меньше.
+var queryRaiseSchemaVersion = `WITH lowered AS (
+		DELETE FROM schema_version
+		WHERE version < $1
+		RETURNING version
+	)
+	INSERT INTO schema_version (version)
+	SELECT $1
+	WHERE NOT EXISTS (SELECT 1 FROM schema_version WHERE version >= $1);`
+
+var querySelectSchemaVersion = `SELECT COALESCE(max(version), 0) FROM schema_version;`
+
 var queryInsert = `INSERT INTO shorten_urls 
 	(
 		original_url, 
 		short_key,
 		user_id,
-		is_deleted
+		is_deleted,
+		password_hash,
+		max_clicks,
+		clicks_left,
+		variants,
+		redirect_status,
+		interstitial,
+		shared
 	)
 	VALUES 
 	(
 		$1, 
 		$2,
 		$3,
-		$4
+		$4,
+		$5,
+		$6,
+		$6,
+		$7,
+		$8,
+		$9,
+		$10
 	)
-	ON CONFLICT (original_url) DO NOTHING;`
+	ON CONFLICT DO NOTHING
+	RETURNING created_at;`
+
+// Точка сохранения для вставки одной ссылки пачки.
+var (
+	querySavepoint           = `SAVEPOINT insert_url;`
+	queryRollbackToSavepoint = `ROLLBACK TO SAVEPOINT insert_url;`
+	queryReleaseSavepoint    = `RELEASE SAVEPOINT insert_url;`
+)
+
+// querySelectConflict возвращает ключ и время создания ссылки без настроек с тем же исходным адресом.
+var querySelectConflict = `SELECT 
+		short_key,
+		created_at
+	FROM shorten_urls
+	WHERE 
+		original_url = $1
+		AND shared
+	LIMIT 1`
 
 var querySelectURL = `SELECT 
 		original_url,
-		is_deleted
+		is_deleted,
+		user_id,
+		created_at,
+		password_hash,
+		max_clicks,
+		clicks_left,
+		rules,
+		variants,
+		redirect_status,
+		template,
+		interstitial
 	FROM shorten_urls
 	WHERE short_key = $1`
 
+// queryConsumeClick списывает переход одним условным обновлением,
+// поэтому параллельные переходы не могут списать больше, чем осталось.
+var queryConsumeClick = `UPDATE shorten_urls
+	SET
+		clicks_left = clicks_left - 1
+	WHERE
+		short_key = $1
+		AND NOT is_deleted
+		AND max_clicks > 0
+		AND clicks_left > 0
+	RETURNING clicks_left`
+
 var querySelectUsersURL = `SELECT 
 		original_url,
 		short_key
@@ -39,15 +159,219 @@ var querySelectUsersURL = `SELECT
 		user_id = $1
 		AND not is_deleted`
 
-var queryUpdateDeleteFlagUser = `UPDATE shorten_urls
+var queryExportUsersURL = `SELECT 
+		short_key,
+		original_url,
+		is_deleted,
+		deleted_at,
+		created_at,
+		password_hash,
+		max_clicks,
+		rules,
+		variants,
+		redirect_status,
+		template,
+		interstitial
+	FROM shorten_urls
+	WHERE 
+		user_id = $1
+	ORDER BY created_at, short_key`
+
+var querySelectUsersURLPage = `SELECT 
+		original_url,
+		short_key,
+		created_at
+	FROM shorten_urls
+	WHERE %s
+	ORDER BY 
+		created_at %s,
+		short_key %[2]s
+	LIMIT %s`
+
+var queryCountUsersURL = `SELECT 
+		count(*)
+	FROM shorten_urls
+	WHERE %s`
+
+// queryURLHost выделяет домен из original_url.
+var queryURLHost = `lower(substring(original_url from '^[^:]+://(?:[^@/]*@)?([^/:?#]+)'))`
+
+var querySelectURLForUpdate = `SELECT 
+		original_url,
+		is_deleted,
+		created_at
+	FROM shorten_urls
+	WHERE 
+		short_key = $1
+		AND user_id = $2
+	FOR UPDATE`
+
+var queryInsertFirstRevision = `INSERT INTO url_revisions 
+	(
+		short_key,
+		revision,
+		original_url,
+		created_at
+	)
+	VALUES 
+	(
+		$1,
+		1,
+		$2,
+		$3
+	)
+	ON CONFLICT DO NOTHING;`
+
+var queryUpdateURL = `UPDATE shorten_urls
 	SET
-		is_deleted = true
+		original_url = $2
 	WHERE
+		short_key = $1`
+
+var queryInsertRevision = `INSERT INTO url_revisions 
+	(
+		short_key,
+		revision,
+		original_url
+	)
+	SELECT 
+		$1,
+		coalesce(max(revision), 0) + 1,
+		$2
+	FROM url_revisions
+	WHERE short_key = $1
+	RETURNING 
+		revision,
+		created_at`
+
+var querySelectLastRevision = `SELECT 
+		revision,
+		original_url,
+		created_at
+	FROM url_revisions
+	WHERE short_key = $1
+	ORDER BY revision DESC
+	LIMIT 1`
+
+var querySelectRevisions = `SELECT 
+		revision,
+		original_url,
+		created_at
+	FROM url_revisions
+	WHERE short_key = $1
+	ORDER BY revision`
+
+var querySelectURLRules = `SELECT 
+		rules
+	FROM shorten_urls
+	WHERE 
 		short_key = $1
 		AND user_id = $2`
 
-var queryUpdateDeleteFlag = `UPDATE shorten_urls
+var queryUpdateURLRules = `UPDATE shorten_urls
 	SET
-		is_deleted = true
+		rules = $2
 	WHERE
 		short_key = $1`
+
+// queryRecordVariantClick увеличивает счетчик одной строкой, поэтому параллельные переходы не теряются.
+var queryRecordVariantClick = `INSERT INTO url_variant_clicks
+	(
+		short_key,
+		variant,
+		clicks
+	)
+	VALUES
+	(
+		$1,
+		$2,
+		1
+	)
+	ON CONFLICT (short_key, variant) DO UPDATE
+	SET clicks = url_variant_clicks.clicks + 1`
+
+var querySelectURLVariants = `SELECT 
+		variants
+	FROM shorten_urls
+	WHERE 
+		short_key = $1
+		AND user_id = $2`
+
+var querySelectVariantClicks = `SELECT 
+		variant,
+		clicks
+	FROM url_variant_clicks
+	WHERE
+		short_key = $1`
+
+var querySelectURLTemplate = `SELECT 
+		template
+	FROM shorten_urls
+	WHERE 
+		short_key = $1
+		AND user_id = $2`
+
+var queryUpdateURLTemplate = `UPDATE shorten_urls
+	SET
+		template = $2
+	WHERE
+		short_key = $1`
+
+var querySelectURLOwner = `SELECT 
+		original_url,
+		created_at
+	FROM shorten_urls
+	WHERE 
+		short_key = $1
+		AND user_id = $2`
+
+var queryUpdateDeleteFlagUser = `UPDATE shorten_urls
+	SET
+		is_deleted = true,
+		deleted_at = now()
+	WHERE
+		short_key = $1
+		AND user_id = $2
+		AND NOT is_deleted`
+
+var queryUpdateDeleteFlag = `UPDATE shorten_urls
+	SET
+		is_deleted = true,
+		deleted_at = now()
+	WHERE
+		short_key = $1
+		AND NOT is_deleted`
+
+var queryRestore = `UPDATE shorten_urls
+	SET
+		is_deleted = false,
+		deleted_at = NULL
+	WHERE
+		short_key = ANY($1)
+		AND user_id = $2
+		AND is_deleted
+		AND deleted_at >= $3
+	RETURNING short_key`
+
+var queryPurgeRevisions = `DELETE FROM url_revisions
+	WHERE short_key IN (
+		SELECT short_key
+		FROM shorten_urls
+		WHERE 
+			is_deleted
+			AND deleted_at < $1
+	)`
+
+var queryPurgeVariantClicks = `DELETE FROM url_variant_clicks
+	WHERE short_key IN (
+		SELECT short_key
+		FROM shorten_urls
+		WHERE 
+			is_deleted
+			AND deleted_at < $1
+	)`
+
+var queryPurge = `DELETE FROM shorten_urls
+	WHERE
+		is_deleted
+		AND deleted_at < $1`
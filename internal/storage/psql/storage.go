@@ -4,10 +4,19 @@ package psql
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
 )
 
+// uniqueViolation - код ошибки PostgreSQL при нарушении уникальности.
+const uniqueViolation = "23505"
+
 // DB - описание БД-хранилища.
 type DB struct {
 	db *sql.DB
@@ -39,6 +48,12 @@ func New(dsn string) (*DB, error) {
 			return nil, err
 		}
 	}
+	// Версия только повышается: экземпляр старой версии сервиса не должен
+	// понижать ее после миграций новой, чтобы CheckMigrations это заметил.
+	if _, err := tx.Exec(queryRaiseSchemaVersion, len(migrations)); err != nil {
+		err = tx.Rollback()
+		return nil, err
+	}
 	if err := tx.Commit(); err != nil {
 		err = tx.Rollback()
 		return nil, err
@@ -60,30 +75,53 @@ func (db *DB) Ping(ctx context.Context) error {
 	return nil
 }
 
-// Set записывает ссылки в файл.
-func (db *DB) Set(urls []model.URL) error {
-	tx, err := db.db.Begin()
+// CheckMigrations проверяет, что в БД применены все миграции этой версии сервиса.
+func (db *DB) CheckMigrations(ctx context.Context) error {
+	var version int
+	if err := traced(db.db).QueryRowContext(ctx, querySelectSchemaVersion).Scan(&version); err != nil {
+		return err
+	}
+	switch {
+	case version < len(migrations):
+		return fmt.Errorf("schema version %d, expected %d: migrations are not applied", version, len(migrations))
+	case version > len(migrations):
+		return fmt.Errorf("schema version %d is newer than expected %d: service is outdated", version, len(migrations))
+	}
+	return nil
+}
+
+// Set записывает ссылки в БД.
+// Каждая ссылка вставляется после точки сохранения: ошибка отдельной ссылки откатывает
+// только ее, сохраняется в поле Err, а остальные ссылки фиксируются.
+func (db *DB) Set(ctx context.Context, urls []model.URL) error {
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
 	for i, url := range urls {
-		result, err := tx.ExecContext(ctx, queryInsert,
-			url.OriginalURL,
-			url.Key,
-			url.UserID,
-			false)
+		variants, err := marshalVariants(url.Variants)
 		if err != nil {
-			err = tx.Rollback()
+			urls[i].Err = err
+			continue
+		}
+		if _, err := traced(tx).ExecContext(ctx, querySavepoint); err != nil {
+			_ = tx.Rollback()
 			return err
 		}
-		rowsAffected, err := result.RowsAffected()
+		err = db.insert(ctx, tx, &urls[i], variants)
 		if err != nil {
-			err = tx.Rollback()
+			urls[i].Err = err
+			if _, err := traced(tx).ExecContext(ctx, queryRollbackToSavepoint); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			continue
+		}
+		if _, err := traced(tx).ExecContext(ctx, queryReleaseSavepoint); err != nil {
+			_ = tx.Rollback()
 			return err
 		}
-		urls[i].Conflict = rowsAffected == 0
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -94,19 +132,88 @@ func (db *DB) Set(urls []model.URL) error {
 	return nil
 }
 
+// insert вставляет одну ссылку пачки.
+// Если исходный адрес уже сокращен ссылкой без настроек, а у url настроек тоже нет,
+// в url возвращается ключ существующей ссылки.
+// Если ключ занят ссылкой с другим адресом, ссылка получает случайный ключ.
+func (db *DB) insert(ctx context.Context, tx *sql.Tx, url *model.URL, variants string) error {
+	shared := url.Shared()
+	for {
+		err := traced(tx).QueryRowContext(ctx, queryInsert,
+			url.OriginalURL,
+			url.Key,
+			url.UserID,
+			false,
+			url.PasswordHash,
+			url.MaxClicks,
+			variants,
+			url.RedirectStatus,
+			url.Interstitial,
+			shared).Scan(&url.CreatedAt)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if !shared {
+			url.Key = model.RandomKey()
+			continue
+		}
+		err = traced(tx).QueryRowContext(ctx, querySelectConflict, url.OriginalURL).Scan(&url.Key, &url.CreatedAt)
+		if err == nil {
+			url.Conflict = true
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		url.Key = model.RandomKey()
+	}
+}
+
 // Get возвращает ссылку по ключу.
-func (db *DB) Get(key string) (string, error) {
-	row := db.db.QueryRowContext(context.Background(), querySelectURL, key)
-	ourl := new(string)
-	isDeleted := new(bool)
-	err := row.Scan(ourl, isDeleted)
+func (db *DB) Get(ctx context.Context, key string) (*model.URL, error) {
+	row := traced(db.db).QueryRowContext(ctx, querySelectURL, key)
+	url := &model.URL{Key: key}
+	var isDeleted bool
+	var userID sql.NullString
+	var clicksLeft int
+	var rules, variants, template []byte
+	err := row.Scan(&url.OriginalURL, &isDeleted, &userID, &url.CreatedAt, &url.PasswordHash, &url.MaxClicks, &clicksLeft,
+		&rules, &variants, &url.RedirectStatus, &template, &url.Interstitial)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, model.ErrNotFound
+	}
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if isDeleted {
+		return nil, model.ErrIsDeleted
+	}
+	if url.MaxClicks > 0 && clicksLeft <= 0 {
+		return nil, model.ErrClicksExhausted
+	}
+	if err := json.Unmarshal(rules, &url.Rules); err != nil {
+		return nil, fmt.Errorf("unmarshal rules: %w", err)
 	}
-	if *isDeleted {
-		return "", model.ErrIsDeleted
+	if err := json.Unmarshal(variants, &url.Variants); err != nil {
+		return nil, fmt.Errorf("unmarshal variants: %w", err)
+	}
+	if url.Template, err = unmarshalTemplate(template); err != nil {
+		return nil, err
+	}
+	url.UserID = userID.String
+	return url, nil
+}
+
+// ConsumeClick списывает переход по ссылке с ограничением числа переходов.
+// Ссылки без ограничения сюда не передаются, поэтому отсутствие строки означает,
+// что переходы закончились.
+func (db *DB) ConsumeClick(ctx context.Context, key string) error {
+	var left int
+	err := traced(db.db).QueryRowContext(ctx, queryConsumeClick, key).Scan(&left)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.ErrClicksExhausted
 	}
-	return *ourl, nil
+	return err
 }
 
 // DeleteTable очищает таблицу.
@@ -131,8 +238,8 @@ func (db *DB) DeleteTable() error {
 }
 
 // GetByUser возвращает все ссылки пользователя.
-func (db *DB) GetByUser(user string) ([]model.KeyAndOURL, error) {
-	rows, err := db.db.QueryContext(context.Background(), querySelectUsersURL, user)
+func (db *DB) GetByUser(ctx context.Context, user string) ([]model.KeyAndOURL, error) {
+	rows, err := traced(db.db).QueryContext(ctx, querySelectUsersURL, user)
 	if err != nil {
 		return nil, err
 	}
@@ -155,23 +262,404 @@ func (db *DB) GetByUser(user string) ([]model.KeyAndOURL, error) {
 	return urls, nil
 }
 
+// Export возвращает все ссылки пользователя, в том числе удаленные, в порядке создания.
+func (db *DB) Export(ctx context.Context, user string) ([]model.URL, error) {
+	rows, err := traced(db.db).QueryContext(ctx, queryExportUsersURL, user)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = rows.Close() }()
+
+	urls := make([]model.URL, 0)
+	for rows.Next() {
+		url := model.URL{UserID: user}
+		var deletedAt sql.NullTime
+		var rules, variants, template []byte
+		err := rows.Scan(&url.Key, &url.OriginalURL, &url.IsDeleted, &deletedAt, &url.CreatedAt, &url.PasswordHash,
+			&url.MaxClicks, &rules, &variants, &url.RedirectStatus, &template, &url.Interstitial)
+		if err != nil {
+			return nil, err
+		}
+		url.DeletedAt = deletedAt.Time
+		if err := json.Unmarshal(rules, &url.Rules); err != nil {
+			return nil, fmt.Errorf("unmarshal rules: %w", err)
+		}
+		if err := json.Unmarshal(variants, &url.Variants); err != nil {
+			return nil, fmt.Errorf("unmarshal variants: %w", err)
+		}
+		if url.Template, err = unmarshalTemplate(template); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return urls, nil
+}
+
+// GetPageByUser возвращает страницу ссылок пользователя.
+// Используется keyset-пагинация по индексу (user_id, created_at, short_key).
+func (db *DB) GetPageByUser(ctx context.Context, user string, filter model.UserURLsFilter) (*model.UserURLsPage, error) {
+
+	where := []string{"user_id = $1", "NOT is_deleted"}
+	args := []any{user}
+	if filter.Query != "" {
+		args = append(args, filter.Query)
+		where = append(where, fmt.Sprintf("strpos(lower(original_url), lower($%d)) > 0", len(args)))
+	}
+	if filter.Domain != "" {
+		args = append(args, strings.ToLower(filter.Domain))
+		where = append(where, fmt.Sprintf("(%[1]s = $%[2]d OR right(%[1]s, length($%[2]d) + 1) = '.' || $%[2]d)",
+			queryURLHost, len(args)))
+	}
+
+	page := new(model.UserURLsPage)
+	row := traced(db.db).QueryRowContext(ctx, fmt.Sprintf(queryCountUsersURL, strings.Join(where, " AND ")), args...)
+	if err := row.Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	order, cmp := "ASC", ">"
+	if filter.Desc {
+		order, cmp = "DESC", "<"
+	}
+	if filter.After != nil {
+		args = append(args, filter.After.CreatedAt, filter.After.Key)
+		where = append(where, fmt.Sprintf("(created_at, short_key) %s ($%d, $%d)", cmp, len(args)-1, len(args)))
+	}
+	limit := "ALL"
+	if filter.Limit > 0 {
+		limit = fmt.Sprint(filter.Limit + 1)
+	}
+	query := fmt.Sprintf(querySelectUsersURLPage, strings.Join(where, " AND "), order, limit)
+
+	rows, err := traced(db.db).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = rows.Close() }()
+
+	urls := make([]model.KeyAndOURL, 0)
+	for rows.Next() {
+		var url model.KeyAndOURL
+		if err := rows.Scan(&url.OriginalURL, &url.Key, &url.CreatedAt); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	if filter.Limit > 0 && len(urls) > filter.Limit {
+		urls = urls[:filter.Limit]
+		last := urls[len(urls)-1]
+		page.Next = &model.Cursor{CreatedAt: last.CreatedAt, Key: last.Key}
+	}
+	page.URLs = urls
+
+	return page, nil
+}
+
+// Update меняет исходную ссылку по ключу и добавляет новую редакцию.
+// Первая редакция записывается в историю при первом изменении ссылки.
+func (db *DB) Update(ctx context.Context, user string, key string, ourl string) (*model.URLRevision, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var (
+		current   string
+		isDeleted bool
+		createdAt time.Time
+	)
+	err = traced(tx).QueryRowContext(ctx, querySelectURLForUpdate, key, user).Scan(&current, &isDeleted, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, model.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isDeleted {
+		return nil, model.ErrIsDeleted
+	}
+
+	if _, err := traced(tx).ExecContext(ctx, queryInsertFirstRevision, key, current, createdAt); err != nil {
+		return nil, err
+	}
+
+	rev := model.URLRevision{OriginalURL: ourl}
+	if current == ourl {
+		err = traced(tx).QueryRowContext(ctx, querySelectLastRevision, key).Scan(&rev.Revision, &rev.OriginalURL, &rev.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		return &rev, tx.Commit()
+	}
+
+	if _, err := traced(tx).ExecContext(ctx, queryUpdateURL, key, ourl); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return nil, model.ErrConflict
+		}
+		return nil, err
+	}
+	if err := traced(tx).QueryRowContext(ctx, queryInsertRevision, key, ourl).Scan(&rev.Revision, &rev.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &rev, nil
+}
+
+// CheckOwner проверяет, что ссылка, в том числе удаленная, принадлежит пользователю.
+func (db *DB) CheckOwner(ctx context.Context, user string, key string) error {
+	var ourl string
+	var createdAt time.Time
+	err := traced(db.db).QueryRowContext(ctx, querySelectURLOwner, key, user).Scan(&ourl, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.ErrNotFound
+	}
+	return err
+}
+
+// Revisions возвращает историю редакций ссылки пользователя.
+func (db *DB) Revisions(ctx context.Context, user string, key string) ([]model.URLRevision, error) {
+
+	first := model.URLRevision{Revision: 1}
+	err := traced(db.db).QueryRowContext(ctx, querySelectURLOwner, key, user).Scan(&first.OriginalURL, &first.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, model.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := traced(db.db).QueryContext(ctx, querySelectRevisions, key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = rows.Close() }()
+
+	revisions := make([]model.URLRevision, 0)
+	for rows.Next() {
+		var rev model.URLRevision
+		if err := rows.Scan(&rev.Revision, &rev.OriginalURL, &rev.CreatedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	if len(revisions) == 0 {
+		revisions = append(revisions, first)
+	}
+
+	return revisions, nil
+}
+
+// Rules возвращает правила перенаправления ссылки пользователя.
+func (db *DB) Rules(ctx context.Context, user string, key string) ([]model.RedirectRule, error) {
+	var data []byte
+	err := traced(db.db).QueryRowContext(ctx, querySelectURLRules, key, user).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, model.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rules []model.RedirectRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("unmarshal rules: %w", err)
+	}
+	return rules, nil
+}
+
+// SetRules заменяет правила перенаправления ссылки пользователя.
+func (db *DB) SetRules(ctx context.Context, user string, key string, rules []model.RedirectRule) error {
+	if rules == nil {
+		rules = []model.RedirectRule{}
+	}
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var (
+		current   string
+		isDeleted bool
+		createdAt time.Time
+	)
+	err = traced(tx).QueryRowContext(ctx, querySelectURLForUpdate, key, user).Scan(&current, &isDeleted, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if isDeleted {
+		return model.ErrIsDeleted
+	}
+	if _, err := traced(tx).ExecContext(ctx, queryUpdateURLRules, key, string(data)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// unmarshalTemplate разбирает шаблон параметров запроса. NULL - ссылка без шаблона.
+func unmarshalTemplate(data []byte) (*model.RedirectTemplate, error) {
+	if data == nil {
+		return nil, nil
+	}
+	var tpl *model.RedirectTemplate
+	if err := json.Unmarshal(data, &tpl); err != nil {
+		return nil, fmt.Errorf("unmarshal template: %w", err)
+	}
+	return tpl, nil
+}
+
+// Template возвращает шаблон параметров запроса ссылки пользователя.
+func (db *DB) Template(ctx context.Context, user string, key string) (*model.RedirectTemplate, error) {
+	var data []byte
+	err := traced(db.db).QueryRowContext(ctx, querySelectURLTemplate, key, user).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, model.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalTemplate(data)
+}
+
+// SetTemplate заменяет шаблон параметров запроса ссылки пользователя. nil удаляет шаблон.
+func (db *DB) SetTemplate(ctx context.Context, user string, key string, tpl *model.RedirectTemplate) error {
+	var data sql.NullString
+	if tpl != nil {
+		b, err := json.Marshal(tpl)
+		if err != nil {
+			return err
+		}
+		data = sql.NullString{String: string(b), Valid: true}
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var (
+		current   string
+		isDeleted bool
+		createdAt time.Time
+	)
+	err = traced(tx).QueryRowContext(ctx, querySelectURLForUpdate, key, user).Scan(&current, &isDeleted, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if isDeleted {
+		return model.ErrIsDeleted
+	}
+	if _, err := traced(tx).ExecContext(ctx, queryUpdateURLTemplate, key, data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// marshalVariants возвращает варианты ссылки для колонки jsonb.
+func marshalVariants(variants []model.URLVariant) (string, error) {
+	if variants == nil {
+		variants = []model.URLVariant{}
+	}
+	data, err := json.Marshal(variants)
+	if err != nil {
+		return "", fmt.Errorf("marshal variants: %w", err)
+	}
+	return string(data), nil
+}
+
+// RecordVariantClick учитывает переход на вариант ссылки.
+func (db *DB) RecordVariantClick(ctx context.Context, key string, variant int) error {
+	_, err := traced(db.db).ExecContext(ctx, queryRecordVariantClick, key, variant)
+	return err
+}
+
+// VariantStats возвращает переходы на варианты ссылки пользователя.
+func (db *DB) VariantStats(ctx context.Context, user string, key string) ([]model.VariantStats, error) {
+	var data []byte
+	err := traced(db.db).QueryRowContext(ctx, querySelectURLVariants, key, user).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, model.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var variants []model.URLVariant
+	if err := json.Unmarshal(data, &variants); err != nil {
+		return nil, fmt.Errorf("unmarshal variants: %w", err)
+	}
+	stats := make([]model.VariantStats, len(variants))
+	for i, variant := range variants {
+		stats[i].URLVariant = variant
+	}
+
+	rows, err := traced(db.db).QueryContext(ctx, querySelectVariantClicks, key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var (
+			variant int
+			clicks  int64
+		)
+		if err := rows.Scan(&variant, &clicks); err != nil {
+			return nil, err
+		}
+		if variant >= 0 && variant < len(stats) {
+			stats[variant].Clicks = clicks
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
 // UpdateDeleteFlag удаляет ссылки.
-func (db *DB) UpdateDeleteFlag(user string, keys []string) {
-	tx, err := db.db.Begin()
+func (db *DB) UpdateDeleteFlag(ctx context.Context, user string, keys []string) {
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return
 	}
 
-	ctx := context.Background()
 	for _, key := range keys {
 		var err error
 		switch {
 		case user != "":
-			_, err = tx.ExecContext(ctx, queryUpdateDeleteFlagUser,
+			_, err = traced(tx).ExecContext(ctx, queryUpdateDeleteFlagUser,
 				key,
 				user)
 		default:
-			_, err = tx.ExecContext(ctx, queryUpdateDeleteFlag,
+			_, err = traced(tx).ExecContext(ctx, queryUpdateDeleteFlag,
 				key)
 		}
 		if err != nil {
@@ -185,3 +673,57 @@ func (db *DB) UpdateDeleteFlag(user string, keys []string) {
 		return
 	}
 }
+
+// Restore снимает признак удаления со ссылок пользователя, удаленных не раньше since.
+// Возвращает ключи восстановленных ссылок.
+func (db *DB) Restore(ctx context.Context, user string, keys []string, since time.Time) ([]string, error) {
+	rows, err := traced(db.db).QueryContext(ctx, queryRestore, keys, user, since)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = rows.Close() }()
+
+	restored := make([]string, 0, len(keys))
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		restored = append(restored, key)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return restored, nil
+}
+
+// Purge удаляет из БД ссылки, удаленные раньше before, вместе с историей редакций.
+// Возвращает количество удаленных ссылок.
+func (db *DB) Purge(ctx context.Context, before time.Time) (int, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := traced(tx).ExecContext(ctx, queryPurgeRevisions, before); err != nil {
+		return 0, err
+	}
+	if _, err := traced(tx).ExecContext(ctx, queryPurgeVariantClicks, before); err != nil {
+		return 0, err
+	}
+	result, err := traced(tx).ExecContext(ctx, queryPurge, before)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return int(count), nil
+}
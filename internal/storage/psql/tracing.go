@@ -0,0 +1,77 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer использует глобальный TracerProvider, который устанавливает tracing.Setup.
+var tracer = otel.Tracer("github.com/winkor4/taktaev-yandex-dev-uri.git/internal/storage/psql")
+
+// conn - общие методы *sql.DB и *sql.Tx.
+type conn interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// tracedConn открывает спан на каждый SQL запрос.
+type tracedConn struct {
+	c conn
+}
+
+func traced(c conn) tracedConn {
+	return tracedConn{c: c}
+}
+
+// ExecContext выполняет запрос без результата.
+func (tc tracedConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := startQuery(ctx, query)
+	res, err := tc.c.ExecContext(ctx, query, args...)
+	endQuery(span, err)
+	return res, err
+}
+
+// QueryContext выполняет запрос, возвращающий строки.
+// Спан закрывается после выполнения запроса, чтение строк в него не входит.
+func (tc tracedConn) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, span := startQuery(ctx, query)
+	rows, err := tc.c.QueryContext(ctx, query, args...)
+	endQuery(span, err)
+	return rows, err
+}
+
+// QueryRowContext выполняет запрос, возвращающий одну строку.
+func (tc tracedConn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := startQuery(ctx, query)
+	row := tc.c.QueryRowContext(ctx, query, args...)
+	endQuery(span, row.Err())
+	return row
+}
+
+func startQuery(ctx context.Context, query string) (context.Context, trace.Span) {
+	query = strings.TrimSpace(query)
+	operation, _, _ := strings.Cut(query, " ")
+	return tracer.Start(ctx, "psql "+strings.ToUpper(operation),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBStatement(query),
+		),
+	)
+}
+
+func endQuery(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,210 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Repository оборачивает model.URLRepository и открывает спан на каждую операцию.
+type Repository struct {
+	repo    model.URLRepository
+	backend string
+	tracer  trace.Tracer
+}
+
+// NewRepository возвращает хранилище, которое трассирует операции repo через tp.
+// backend - имя хранилища в атрибутах спанов: memory, file или psql.
+func NewRepository(repo model.URLRepository, backend string, tp trace.TracerProvider) *Repository {
+	return &Repository{
+		repo:    repo,
+		backend: backend,
+		tracer:  tp.Tracer(instrumentationName),
+	}
+}
+
+func (r *Repository) start(ctx context.Context, method string) (context.Context, trace.Span) {
+	return r.tracer.Start(ctx, "URLRepository."+method,
+		trace.WithAttributes(attribute.String("storage.backend", r.backend)))
+}
+
+// end закрывает спан. Отсутствие ссылки - штатный ответ хранилища, а не ошибка.
+func end(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, model.ErrNotFound) && !errors.Is(err, model.ErrIsDeleted) &&
+		!errors.Is(err, model.ErrClicksExhausted) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// GetURL возвращает ссылку по ключу
+func (r *Repository) GetURL(ctx context.Context, key string) (*model.URL, error) {
+	ctx, span := r.start(ctx, "GetURL")
+	url, err := r.repo.GetURL(ctx, key)
+	end(span, err)
+	return url, err
+}
+
+// SaveURL созраняет ссылку в бд
+func (r *Repository) SaveURL(ctx context.Context, urls []model.URL) error {
+	ctx, span := r.start(ctx, "SaveURL")
+	span.SetAttributes(attribute.Int("urls.count", len(urls)))
+	err := r.repo.SaveURL(ctx, urls)
+	end(span, err)
+	return err
+}
+
+// PingDB проверяет соединение с бд
+func (r *Repository) PingDB(ctx context.Context) error {
+	ctx, span := r.start(ctx, "PingDB")
+	err := r.repo.PingDB(ctx)
+	end(span, err)
+	return err
+}
+
+// GetUsersURL возвращает все ссылки пользователя
+func (r *Repository) GetUsersURL(ctx context.Context, user string) ([]model.KeyAndOURL, error) {
+	ctx, span := r.start(ctx, "GetUsersURL")
+	urls, err := r.repo.GetUsersURL(ctx, user)
+	end(span, err)
+	return urls, err
+}
+
+// ExportURLs возвращает все ссылки пользователя с настройками
+func (r *Repository) ExportURLs(ctx context.Context, user string) ([]model.URL, error) {
+	ctx, span := r.start(ctx, "ExportURLs")
+	urls, err := r.repo.ExportURLs(ctx, user)
+	end(span, err)
+	return urls, err
+}
+
+// GetUsersURLPage возвращает страницу ссылок пользователя
+func (r *Repository) GetUsersURLPage(ctx context.Context, user string, filter model.UserURLsFilter) (*model.UserURLsPage, error) {
+	ctx, span := r.start(ctx, "GetUsersURLPage")
+	page, err := r.repo.GetUsersURLPage(ctx, user, filter)
+	end(span, err)
+	return page, err
+}
+
+// DeleteURL помечает ссылки пользователя удаленными
+func (r *Repository) DeleteURL(ctx context.Context, user string, keys []string) {
+	ctx, span := r.start(ctx, "DeleteURL")
+	span.SetAttributes(attribute.Int("urls.count", len(keys)))
+	r.repo.DeleteURL(ctx, user, keys)
+	end(span, nil)
+}
+
+// UpdateURL меняет исходный адрес ссылки пользователя
+func (r *Repository) UpdateURL(ctx context.Context, user string, key string, ourl string) (*model.URLRevision, error) {
+	ctx, span := r.start(ctx, "UpdateURL")
+	rev, err := r.repo.UpdateURL(ctx, user, key, ourl)
+	end(span, err)
+	return rev, err
+}
+
+// GetURLRevisions возвращает историю изменений ссылки пользователя
+func (r *Repository) GetURLRevisions(ctx context.Context, user string, key string) ([]model.URLRevision, error) {
+	ctx, span := r.start(ctx, "GetURLRevisions")
+	revisions, err := r.repo.GetURLRevisions(ctx, user, key)
+	end(span, err)
+	return revisions, err
+}
+
+// CheckURLOwner проверяет, что ссылка принадлежит пользователю
+func (r *Repository) CheckURLOwner(ctx context.Context, user string, key string) error {
+	ctx, span := r.start(ctx, "CheckURLOwner")
+	err := r.repo.CheckURLOwner(ctx, user, key)
+	end(span, err)
+	return err
+}
+
+// RestoreURL восстанавливает удаленные ссылки пользователя
+func (r *Repository) RestoreURL(ctx context.Context, user string, keys []string, since time.Time) ([]string, error) {
+	ctx, span := r.start(ctx, "RestoreURL")
+	restored, err := r.repo.RestoreURL(ctx, user, keys, since)
+	end(span, err)
+	return restored, err
+}
+
+// PurgeDeleted окончательно удаляет ссылки, удаленные раньше before
+func (r *Repository) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	ctx, span := r.start(ctx, "PurgeDeleted")
+	n, err := r.repo.PurgeDeleted(ctx, before)
+	end(span, err)
+	return n, err
+}
+
+// CheckHealth проверяет готовность хранилища
+func (r *Repository) CheckHealth(ctx context.Context) []model.HealthCheck {
+	ctx, span := r.start(ctx, "CheckHealth")
+	checks := r.repo.CheckHealth(ctx)
+	for _, check := range checks {
+		if check.Err != nil {
+			span.SetStatus(codes.Error, check.Name+": "+check.Err.Error())
+		}
+	}
+	span.End()
+	return checks
+}
+
+// ConsumeClick списывает переход по ссылке с ограничением числа переходов
+func (r *Repository) ConsumeClick(ctx context.Context, key string) error {
+	ctx, span := r.start(ctx, "ConsumeClick")
+	err := r.repo.ConsumeClick(ctx, key)
+	end(span, err)
+	return err
+}
+
+// GetURLRules возвращает правила перенаправления ссылки пользователя
+func (r *Repository) GetURLRules(ctx context.Context, user string, key string) ([]model.RedirectRule, error) {
+	ctx, span := r.start(ctx, "GetURLRules")
+	rules, err := r.repo.GetURLRules(ctx, user, key)
+	end(span, err)
+	return rules, err
+}
+
+// SetURLRules заменяет правила перенаправления ссылки пользователя
+func (r *Repository) SetURLRules(ctx context.Context, user string, key string, rules []model.RedirectRule) error {
+	ctx, span := r.start(ctx, "SetURLRules")
+	err := r.repo.SetURLRules(ctx, user, key, rules)
+	end(span, err)
+	return err
+}
+
+// RecordVariantClick учитывает переход на вариант ссылки
+func (r *Repository) RecordVariantClick(ctx context.Context, key string, variant int) error {
+	ctx, span := r.start(ctx, "RecordVariantClick")
+	err := r.repo.RecordVariantClick(ctx, key, variant)
+	end(span, err)
+	return err
+}
+
+// GetURLVariantStats возвращает переходы на варианты ссылки пользователя
+func (r *Repository) GetURLVariantStats(ctx context.Context, user string, key string) ([]model.VariantStats, error) {
+	ctx, span := r.start(ctx, "GetURLVariantStats")
+	stats, err := r.repo.GetURLVariantStats(ctx, user, key)
+	end(span, err)
+	return stats, err
+}
+
+// GetURLTemplate возвращает шаблон параметров запроса ссылки пользователя
+func (r *Repository) GetURLTemplate(ctx context.Context, user string, key string) (*model.RedirectTemplate, error) {
+	ctx, span := r.start(ctx, "GetURLTemplate")
+	tpl, err := r.repo.GetURLTemplate(ctx, user, key)
+	end(span, err)
+	return tpl, err
+}
+
+// SetURLTemplate заменяет шаблон параметров запроса ссылки пользователя
+func (r *Repository) SetURLTemplate(ctx context.Context, user string, key string, tpl *model.RedirectTemplate) error {
+	ctx, span := r.start(ctx, "SetURLTemplate")
+	err := r.repo.SetURLTemplate(ctx, user, key, tpl)
+	end(span, err)
+	return err
+}
@@ -0,0 +1,102 @@
+// Модуль tracing настраивает трассировку OpenTelemetry и экспорт спанов.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// Способы экспорта спанов.
+const (
+	ExporterNone   = "none"   // ExporterNone - трассировка выключена, заголовки traceparent все равно передаются дальше.
+	ExporterStdout = "stdout" // ExporterStdout - спаны пишутся в stdout в формате JSON.
+	ExporterFile   = "file"   // ExporterFile - спаны пишутся в файл в формате JSON.
+	ExporterOTLP   = "otlp"   // ExporterOTLP - спаны отправляются в коллектор по OTLP/HTTP.
+)
+
+// instrumentationName - имя библиотеки инструментирования в спанах сервиса.
+const instrumentationName = "github.com/winkor4/taktaev-yandex-dev-uri.git"
+
+// Propagator разбирает и передает контекст трассировки в заголовках W3C traceparent и baggage.
+var Propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Config хранит параметры трассировки.
+type Config struct {
+	Exporter    string // Exporter - способ экспорта спанов.
+	File        string // File - файл для ExporterFile.
+	Endpoint    string // Endpoint - адрес коллектора для ExporterOTLP, если пустой, берется из OTEL_EXPORTER_OTLP_*.
+	ServiceName string // ServiceName - имя сервиса в спанах.
+}
+
+// ShutdownFunc выгружает оставшиеся спаны и освобождает ресурсы экспорта.
+type ShutdownFunc func(ctx context.Context) error
+
+// Setup создает экспорт спанов и устанавливает глобальные TracerProvider и propagator.
+func Setup(c Config) (ShutdownFunc, error) {
+	otel.SetTextMapPropagator(Propagator)
+
+	var (
+		exporter sdktrace.SpanExporter
+		closer   func() error
+		err      error
+	)
+	switch c.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		if c.File == "" {
+			return nil, errors.New("trace file is not set")
+		}
+		f, ferr := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if ferr != nil {
+			return nil, ferr
+		}
+		closer = f.Close
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(c.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", c.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(c.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			err = errors.Join(err, closer())
+		}
+		return err
+	}, nil
+}
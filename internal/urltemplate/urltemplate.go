@@ -0,0 +1,163 @@
+// Модуль urltemplate добавляет к ссылке параметры запроса по шаблону ссылки.
+//
+// Правила слияния параметров:
+//   - параметры шаблона заменяют одноименные параметры ссылки;
+//   - параметры посетителя из PassQuery добавляются, только если такого параметра
+//     нет ни в ссылке, ни в шаблоне: посетитель не может переопределить параметры владельца;
+//   - остальные параметры ссылки сохраняются без изменений и в исходном порядке,
+//     добавленные параметры идут после них по алфавиту, параметры посетителя - после параметров шаблона.
+//
+// Правила кодирования: плейсхолдеры подставляются в значения шаблона как есть,
+// затем имя и значение каждого добавленного параметра кодируются один раз (url.QueryEscape).
+// Параметры посетителя передаются с теми же значениями, которые пришли в запросе.
+package urltemplate
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/rules"
+)
+
+// MaxParams - наибольшее количество параметров и передаваемых параметров в шаблоне.
+const MaxParams = 20
+
+// PassAll - значение PassQuery, при котором передаются все параметры посетителя.
+const PassAll = "*"
+
+// Плейсхолдеры значений параметров.
+const (
+	PlaceholderKey    = "key"    // PlaceholderKey - ключ короткой ссылки.
+	PlaceholderDevice = "device" // PlaceholderDevice - класс устройства посетителя.
+	PlaceholderLang   = "lang"   // PlaceholderLang - предпочитаемый язык посетителя.
+)
+
+// placeholderPattern - плейсхолдер в значении параметра.
+var placeholderPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// Ошибки проверки шаблона.
+var (
+	ErrTooManyParams      = fmt.Errorf("template has more than %d params", MaxParams)
+	ErrEmptyParamName     = errors.New("param name is empty")
+	ErrUnknownPlaceholder = errors.New("unknown placeholder, expected {key}, {device} or {lang}")
+)
+
+// Validate проверяет шаблон.
+func Validate(tpl *model.RedirectTemplate) error {
+	if tpl == nil {
+		return nil
+	}
+	if len(tpl.Params) > MaxParams || len(tpl.PassQuery) > MaxParams {
+		return ErrTooManyParams
+	}
+	for name, value := range tpl.Params {
+		if strings.TrimSpace(name) == "" {
+			return ErrEmptyParamName
+		}
+		for _, m := range placeholderPattern.FindAllStringSubmatch(value, -1) {
+			switch m[1] {
+			case PlaceholderKey, PlaceholderDevice, PlaceholderLang:
+			default:
+				return fmt.Errorf("param %s: %w", name, ErrUnknownPlaceholder)
+			}
+		}
+	}
+	for _, name := range tpl.PassQuery {
+		if strings.TrimSpace(name) == "" {
+			return ErrEmptyParamName
+		}
+	}
+	return nil
+}
+
+// Vars возвращает значения плейсхолдеров для запроса посетителя.
+func Vars(r *http.Request, key string) map[string]string {
+	lang := ""
+	if languages := rules.AcceptLanguages(r.Header.Get("Accept-Language")); len(languages) > 0 {
+		lang = languages[0]
+	}
+	return map[string]string{
+		PlaceholderKey:    key,
+		PlaceholderDevice: rules.Device(r.UserAgent()),
+		PlaceholderLang:   lang,
+	}
+}
+
+// Apply добавляет к ссылке target параметры шаблона и параметры посетителя query.
+// Параметры сервиса, например пароль ссылки, вызывающий должен убрать из query сам.
+func Apply(target string, tpl *model.RedirectTemplate, query url.Values, vars map[string]string) (string, error) {
+	if tpl.Empty() {
+		return target, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	// Параметры ссылки в исходном виде, кроме замененных шаблоном.
+	pieces := make([]string, 0)
+	existing := make(map[string]bool)
+	for _, piece := range strings.Split(u.RawQuery, "&") {
+		if piece == "" {
+			continue
+		}
+		rawName, _, _ := strings.Cut(piece, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		if _, ok := tpl.Params[name]; ok {
+			continue
+		}
+		existing[name] = true
+		pieces = append(pieces, piece)
+	}
+
+	names := make([]string, 0, len(tpl.Params))
+	for name := range tpl.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pieces = append(pieces, url.QueryEscape(name)+"="+url.QueryEscape(expand(tpl.Params[name], vars)))
+	}
+
+	if len(tpl.PassQuery) > 0 {
+		passAll := slices.Contains(tpl.PassQuery, PassAll)
+		visitor := make([]string, 0, len(query))
+		for name := range query {
+			_, own := tpl.Params[name]
+			if own || existing[name] || !passAll && !slices.Contains(tpl.PassQuery, name) {
+				continue
+			}
+			visitor = append(visitor, name)
+		}
+		sort.Strings(visitor)
+		for _, name := range visitor {
+			for _, value := range query[name] {
+				pieces = append(pieces, url.QueryEscape(name)+"="+url.QueryEscape(value))
+			}
+		}
+	}
+
+	u.RawQuery = strings.Join(pieces, "&")
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+// expand подставляет значения плейсхолдеров. Неизвестные плейсхолдеры остаются как есть.
+func expand(value string, vars map[string]string) string {
+	return placeholderPattern.ReplaceAllStringFunc(value, func(m string) string {
+		if v, ok := vars[m[1:len(m)-1]]; ok {
+			return v
+		}
+		return m
+	})
+}
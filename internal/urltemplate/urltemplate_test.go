@@ -0,0 +1,132 @@
+package urltemplate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/winkor4/taktaev-yandex-dev-uri.git/internal/model"
+)
+
+func TestApply(t *testing.T) {
+	vars := map[string]string{PlaceholderKey: "abc", PlaceholderDevice: "mobile", PlaceholderLang: "ru-ru"}
+
+	type testData struct {
+		name   string
+		target string
+		tpl    *model.RedirectTemplate
+		query  string
+		want   string
+	}
+
+	testTable := []testData{
+		{
+			name:   "Без шаблона ссылка не меняется",
+			target: "https://example.com/a?b=1",
+			query:  "utm_source=x",
+			want:   "https://example.com/a?b=1",
+		},
+		{
+			name:   "Параметры шаблона добавляются по алфавиту",
+			target: "https://example.com/a",
+			tpl:    &model.RedirectTemplate{Params: map[string]string{"utm_source": "short", "utm_medium": "link"}},
+			want:   "https://example.com/a?utm_medium=link&utm_source=short",
+		},
+		{
+			name:   "Параметры ссылки сохраняют порядок и вид",
+			target: "https://example.com/a?z=1&a=%2F",
+			tpl:    &model.RedirectTemplate{Params: map[string]string{"utm_source": "short"}},
+			want:   "https://example.com/a?z=1&a=%2F&utm_source=short",
+		},
+		{
+			name:   "Параметр шаблона заменяет параметр ссылки",
+			target: "https://example.com/a?utm_source=old&x=1&utm_source=older",
+			tpl:    &model.RedirectTemplate{Params: map[string]string{"utm_source": "new"}},
+			want:   "https://example.com/a?x=1&utm_source=new",
+		},
+		{
+			name:   "Плейсхолдеры подставляются и кодируются",
+			target: "https://example.com/a",
+			tpl:    &model.RedirectTemplate{Params: map[string]string{"utm_campaign": "{key}/{device} {lang}"}},
+			want:   "https://example.com/a?utm_campaign=abc%2Fmobile+ru-ru",
+		},
+		{
+			name:   "Передаются только разрешенные параметры посетителя",
+			target: "https://example.com/a",
+			tpl:    &model.RedirectTemplate{PassQuery: []string{"gclid"}},
+			query:  "gclid=123&other=1",
+			want:   "https://example.com/a?gclid=123",
+		},
+		{
+			name:   "Все параметры посетителя с повторами",
+			target: "https://example.com/a",
+			tpl:    &model.RedirectTemplate{PassQuery: []string{PassAll}},
+			query:  "b=2&a=1&b=3",
+			want:   "https://example.com/a?a=1&b=2&b=3",
+		},
+		{
+			name:   "Посетитель не переопределяет параметры ссылки и шаблона",
+			target: "https://example.com/a?ref=owner",
+			tpl:    &model.RedirectTemplate{Params: map[string]string{"utm_source": "short"}, PassQuery: []string{PassAll}},
+			query:  "ref=visitor&utm_source=visitor&q=1",
+			want:   "https://example.com/a?ref=owner&utm_source=short&q=1",
+		},
+		{
+			name:   "Значения посетителя кодируются",
+			target: "https://example.com/a",
+			tpl:    &model.RedirectTemplate{PassQuery: []string{"q"}},
+			query:  "q=a%26b%3Dc",
+			want:   "https://example.com/a?q=a%26b%3Dc",
+		},
+		{
+			name:   "Фрагмент сохраняется",
+			target: "https://example.com/a#section",
+			tpl:    &model.RedirectTemplate{Params: map[string]string{"utm_source": "short"}},
+			want:   "https://example.com/a?utm_source=short#section",
+		},
+	}
+
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			query, err := url.ParseQuery(testData.query)
+			require.NoError(t, err)
+			got, err := Apply(testData.target, testData.tpl, query, vars)
+			require.NoError(t, err)
+			assert.Equal(t, testData.want, got)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testTable := []struct {
+		name    string
+		tpl     *model.RedirectTemplate
+		wantErr error
+	}{
+		{"Пустой шаблон", nil, nil},
+		{"Корректный шаблон", &model.RedirectTemplate{Params: map[string]string{"utm_campaign": "{key}-{lang}"}, PassQuery: []string{"gclid"}}, nil},
+		{"Неизвестный плейсхолдер", &model.RedirectTemplate{Params: map[string]string{"utm_campaign": "{user}"}}, ErrUnknownPlaceholder},
+		{"Пустое имя параметра", &model.RedirectTemplate{Params: map[string]string{"": "x"}}, ErrEmptyParamName},
+		{"Пустое имя передаваемого параметра", &model.RedirectTemplate{PassQuery: []string{" "}}, ErrEmptyParamName},
+	}
+	for _, testData := range testTable {
+		t.Run(testData.name, func(t *testing.T) {
+			err := Validate(testData.tpl)
+			if testData.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, testData.wantErr)
+		})
+	}
+}
+
+func TestVars(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/abc", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (iPhone) Mobile")
+	r.Header.Set("Accept-Language", "en;q=0.5, de-AT")
+	assert.Equal(t, map[string]string{"key": "abc", "device": "mobile", "lang": "de-at"}, Vars(r, "abc"))
+}